@@ -0,0 +1,203 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - "alerts apply" creates or updates one metric alert rule per rule of an alert profile,
+//   named <server>-<rule>, so running it again only updates thresholds
+// - the profile is the built-in default below or a JSON file of the same shape:
+//     {"emails": ["dba@example.com"], "rules": [
+//       {"name": "cpu", "metric": "cpu_percent", "operator": "GreaterThan",
+//        "threshold": 80, "window": "PT15M", "aggregation": "Average"}]}
+// - the vendored monitor models have no fields for the threshold condition and the
+//   actions (RuleCondition and RuleAction lack the polymorphic odata.type properties), so
+//   the request is prepared with AlertRulesClient and sent with a body built here
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/arm/monitor"
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// odata.type discriminators of the classic alert rule API
+const (
+	odataThresholdRuleCondition = "Microsoft.Azure.Management.Insights.Models.ThresholdRuleCondition"
+	odataRuleMetricDataSource   = "Microsoft.Azure.Management.Insights.Models.RuleMetricDataSource"
+	odataRuleEmailAction        = "Microsoft.Azure.Management.Insights.Models.RuleEmailAction"
+)
+
+func init() {
+	registerCommand(command{
+		name:         "alerts apply",
+		summary:      "create or update the standard metric alert rules of a server from a profile",
+		needsClients: true,
+		run:          runAlertsApply,
+	})
+}
+
+// alertRuleSpec is one alert of a profile
+type alertRuleSpec struct {
+	Name        string                          `json:"name"`
+	Metric      string                          `json:"metric"`
+	Operator    monitor.ConditionOperator       `json:"operator"`
+	Threshold   float64                         `json:"threshold"`
+	Window      string                          `json:"window"`
+	Aggregation monitor.TimeAggregationOperator `json:"aggregation"`
+}
+
+// alertProfile is the set of alerts every server gets
+type alertProfile struct {
+	Emails       []string        `json:"emails,omitempty"`
+	NotifyOwners bool            `json:"notifyOwners"`
+	Rules        []alertRuleSpec `json:"rules"`
+}
+
+// defaultAlertProfile is used when no profile file is given
+var defaultAlertProfile = alertProfile{
+	NotifyOwners: true,
+	Rules: []alertRuleSpec{
+		{Name: "cpu", Metric: "cpu_percent", Operator: monitor.ConditionOperatorGreaterThan, Threshold: 80, Window: "PT15M", Aggregation: monitor.TimeAggregationOperatorAverage},
+		{Name: "storage", Metric: "storage_percent", Operator: monitor.ConditionOperatorGreaterThan, Threshold: 85, Window: "PT15M", Aggregation: monitor.TimeAggregationOperatorMaximum},
+		{Name: "connections", Metric: "active_connections", Operator: monitor.ConditionOperatorGreaterThan, Threshold: 100, Window: "PT15M", Aggregation: monitor.TimeAggregationOperatorAverage},
+		{Name: "failed-connections", Metric: "connections_failed", Operator: monitor.ConditionOperatorGreaterThan, Threshold: 10, Window: "PT5M", Aggregation: monitor.TimeAggregationOperatorTotal},
+	},
+}
+
+// loadAlertProfile reads a profile file, an empty name is the default profile
+func loadAlertProfile(name string) (*alertProfile, error) {
+	if name == "" || name == "default" {
+		profile := defaultAlertProfile
+		return &profile, nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	profile := &alertProfile{}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for _, rule := range profile.Rules {
+		if rule.Name == "" || rule.Metric == "" || rule.Operator == "" || rule.Window == "" {
+			return nil, fmt.Errorf("%s: every rule needs name, metric, operator and window", name)
+		}
+	}
+	return profile, nil
+}
+
+func runAlertsApply(args []string) {
+	flags := newFlagSet("alerts apply")
+	group := flags.String("resource-group", resourceGroupName, "resource group of the server")
+	name := flags.String("server", "", "server the alerts are for")
+	profileFile := flags.String("profile", "default", "alert profile file, or default")
+	var emails stringsFlag
+	flags.Var(&emails, "email", "additional address notified by every alert (repeatable)")
+	dryRun := flags.Bool("dry-run", false, "only print the rules")
+	flags.Parse(args)
+	if *name == "" {
+		fmt.Println("Missing -server")
+		os.Exit(2)
+	}
+
+	profile, err := loadAlertProfile(*profileFile)
+	onErrorFail(err, "Reading alert profile failed")
+	profile.Emails = append(profile.Emails, emails...)
+	server, err := serversClient.Get(*group, *name)
+	onErrorFail(err, "Get server details failed")
+	if *dryRun {
+		for _, rule := range profile.Rules {
+			fmt.Printf("would apply %s: %s\n", alertRuleName(*name, rule), toJSON(alertRuleBody(server, profile, rule)))
+		}
+		return
+	}
+	requirePermissions("alerts apply", []string{*group})
+	onErrorFail(applyAlerts(*group, server, profile), "Applying alerts failed")
+}
+
+// applyAlerts creates or updates the alert rules of profile for a server
+func applyAlerts(resourceGroup string, server postgresql.Server, profile *alertProfile) error {
+	client := monitor.AlertRulesClient{ManagementClient: monitorClient}
+	for _, rule := range profile.Rules {
+		ruleName := alertRuleName(to.String(server.Name), rule)
+		fmt.Printf("Applying alert %s (%s %s %v over %s)\n", ruleName, rule.Metric, rule.Operator, rule.Threshold, rule.Window)
+		req, err := client.CreateOrUpdatePreparer(resourceGroup, ruleName, monitor.AlertRuleResource{})
+		if err == nil {
+			req, err = autorest.Prepare(req, autorest.WithJSON(alertRuleBody(server, profile, rule)))
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := client.CreateOrUpdateSender(req)
+		if err == nil {
+			_, err = client.CreateOrUpdateResponder(resp)
+		}
+		if err != nil {
+			return withRemediation(err, "creating alert rule "+ruleName)
+		}
+		activeTransaction.recordAlertRule(resourceGroup, ruleName)
+	}
+	return nil
+}
+
+func alertRuleName(serverName string, rule alertRuleSpec) string {
+	return serverName + "-" + rule.Name
+}
+
+// alertRuleBody is the alert rule resource with the typed condition and action
+func alertRuleBody(server postgresql.Server, profile *alertProfile, rule alertRuleSpec) map[string]interface{} {
+	aggregation := rule.Aggregation
+	if aggregation == "" {
+		aggregation = monitor.TimeAggregationOperatorAverage
+	}
+	emails := profile.Emails
+	if emails == nil {
+		emails = []string{}
+	}
+	return map[string]interface{}{
+		"location": to.String(server.Location),
+		"properties": map[string]interface{}{
+			"name":        alertRuleName(to.String(server.Name), rule),
+			"description": fmt.Sprintf("%s %s %v over %s", rule.Metric, rule.Operator, rule.Threshold, rule.Window),
+			"isEnabled":   true,
+			"condition": map[string]interface{}{
+				"odata.type": odataThresholdRuleCondition,
+				"dataSource": map[string]interface{}{
+					"odata.type":  odataRuleMetricDataSource,
+					"resourceUri": to.String(server.ID),
+					"metricName":  rule.Metric,
+				},
+				"operator":        rule.Operator,
+				"threshold":       rule.Threshold,
+				"windowSize":      rule.Window,
+				"timeAggregation": aggregation,
+			},
+			"actions": []interface{}{
+				map[string]interface{}{
+					"odata.type":          odataRuleEmailAction,
+					"sendToServiceOwners": profile.NotifyOwners,
+					"customEmails":        emails,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/monitor"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// encodedAlertRule is the part of an alert rule body the API looks at, as sent
+type encodedAlertRule struct {
+	Location   string `json:"location"`
+	Properties struct {
+		Name      string `json:"name"`
+		IsEnabled bool   `json:"isEnabled"`
+		Condition struct {
+			ODataType  string `json:"odata.type"`
+			DataSource struct {
+				ODataType   string `json:"odata.type"`
+				ResourceURI string `json:"resourceUri"`
+				MetricName  string `json:"metricName"`
+			} `json:"dataSource"`
+			Operator        string  `json:"operator"`
+			Threshold       float64 `json:"threshold"`
+			WindowSize      string  `json:"windowSize"`
+			TimeAggregation string  `json:"timeAggregation"`
+		} `json:"condition"`
+		Actions []struct {
+			ODataType           string          `json:"odata.type"`
+			SendToServiceOwners bool            `json:"sendToServiceOwners"`
+			CustomEmails        json.RawMessage `json:"customEmails"`
+		} `json:"actions"`
+	} `json:"properties"`
+}
+
+func TestAlertRuleBody(t *testing.T) {
+	server := testStandardServer("orders", 200)
+	server.Location = to.StringPtr("westus")
+	cpu := alertRuleSpec{Name: "cpu", Metric: "cpu_percent", Operator: monitor.ConditionOperatorGreaterThan, Threshold: 80, Window: "PT15M"}
+	storage := alertRuleSpec{Name: "storage", Metric: "storage_percent", Operator: monitor.ConditionOperatorGreaterThan, Threshold: 85, Window: "PT15M", Aggregation: monitor.TimeAggregationOperatorMaximum}
+	cases := []struct {
+		name            string
+		profile         alertProfile
+		rule            alertRuleSpec
+		wantAggregation string
+		wantEmails      string
+	}{
+		// the API rejects a null customEmails
+		{"no emails", alertProfile{NotifyOwners: true}, cpu, "Average", `[]`},
+		{"emails", alertProfile{Emails: []string{"dba@example.com"}}, cpu, "Average", `["dba@example.com"]`},
+		{"aggregation", alertProfile{NotifyOwners: true}, storage, "Maximum", `[]`},
+	}
+	for _, c := range cases {
+		data, err := json.Marshal(alertRuleBody(server, &c.profile, c.rule))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body encodedAlertRule
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatal(err)
+		}
+		p := body.Properties
+		if body.Location != "westus" || p.Name != "orders-"+c.rule.Name || !p.IsEnabled {
+			t.Errorf("%s: rule %s", c.name, data)
+		}
+		if p.Condition.ODataType != odataThresholdRuleCondition || p.Condition.DataSource.ODataType != odataRuleMetricDataSource {
+			t.Errorf("%s: condition types %s", c.name, data)
+		}
+		if p.Condition.DataSource.ResourceURI != to.String(server.ID) || p.Condition.DataSource.MetricName != c.rule.Metric {
+			t.Errorf("%s: data source %s", c.name, data)
+		}
+		if p.Condition.Operator != "GreaterThan" || p.Condition.Threshold != c.rule.Threshold || p.Condition.WindowSize != "PT15M" || p.Condition.TimeAggregation != c.wantAggregation {
+			t.Errorf("%s: condition %s", c.name, data)
+		}
+		if len(p.Actions) != 1 {
+			t.Fatalf("%s: actions %s", c.name, data)
+		}
+		action := p.Actions[0]
+		if action.ODataType != odataRuleEmailAction || action.SendToServiceOwners != c.profile.NotifyOwners || string(action.CustomEmails) != c.wantEmails {
+			t.Errorf("%s: action %s", c.name, data)
+		}
+	}
+}
+
+func TestLoadAlertProfile(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name      string
+		file      string
+		wantRules int
+		wantErr   string
+	}{
+		{"valid", `{"emails": ["dba@example.com"], "rules": [{"name": "cpu", "metric": "cpu_percent", "operator": "GreaterThan", "threshold": 80, "window": "PT15M"}]}`, 1, ""},
+		{"no rules", `{"emails": ["dba@example.com"]}`, 0, ""},
+		{"not json", `rules: cpu`, 0, "invalid character"},
+		{"missing metric", `{"rules": [{"name": "cpu", "operator": "GreaterThan", "window": "PT15M"}]}`, 0, "needs name, metric, operator and window"},
+		{"missing window", `{"rules": [{"name": "cpu", "metric": "cpu_percent", "operator": "GreaterThan"}]}`, 0, "needs name, metric, operator and window"},
+	}
+	for _, c := range cases {
+		path := filepath.Join(dir, strings.Replace(c.name, " ", "-", -1)+".json")
+		if err := ioutil.WriteFile(path, []byte(c.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		profile, err := loadAlertProfile(path)
+		if c.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("%s: error %v, want %q", c.name, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if len(profile.Rules) != c.wantRules {
+			t.Errorf("%s: %d rules", c.name, len(profile.Rules))
+		}
+	}
+
+	if _, err := loadAlertProfile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("a missing profile file is accepted")
+	}
+	// the default profile is a copy, adding -email to it leaves the next one alone
+	for _, name := range []string{"", "default"} {
+		profile, err := loadAlertProfile(name)
+		if err != nil || len(profile.Rules) != len(defaultAlertProfile.Rules) || !profile.NotifyOwners {
+			t.Fatalf("default profile %q: %+v %v", name, profile, err)
+		}
+		profile.Emails = append(profile.Emails, "dba@example.com")
+	}
+	if len(defaultAlertProfile.Emails) != 0 {
+		t.Errorf("default profile changed: %v", defaultAlertProfile.Emails)
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - the autoscaler evaluates every -interval: it averages a metric of each selected server
+//   over -window and moves the compute units one step of the tier up or down
+// - scaling waits -cooldown after the previous scaling of a server and only happens within
+//   -allowed-hours (UTC), capacity stays between -min-capacity and -max-capacity
+// - every decision other than "steady" is appended to the audit trail (JSON lines), the
+//   last scaling time of each server is read back from it on start
+// - metrics come from a metricSource: "monitor" reads the Azure Monitor metrics API through
+//   the monitor client (the vendored monitor package has no metrics operation, the request
+//   is built here), "file:<path>" reads values from a JSON file, e.g. to simulate load:
+//     {"my-server": {"cpu_percent": 91.5}}
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// autoscaler actions
+const (
+	autoscaleSteady     = "steady"
+	autoscaleUp         = "scale-up"
+	autoscaleDown       = "scale-down"
+	autoscaleCooldown   = "skipped-cooldown"
+	autoscaleOutsideWin = "skipped-window"
+	autoscaleAtLimit    = "skipped-limit"
+	autoscaleNoData     = "no-data"
+	autoscaleFailed     = "failed"
+)
+
+// api version of the Azure Monitor metrics API
+const metricsAPIVersion = "2018-01-01"
+
+func init() {
+	registerCommand(command{
+		name:         "autoscale",
+		summary:      "run the compute unit autoscaler for servers selected by filter",
+		needsClients: true,
+		run:          runAutoscale,
+	})
+}
+
+// metricSource returns the average of a server metric over the window ending now
+type metricSource interface {
+	average(server postgresql.Server, metric string, window time.Duration) (float64, bool, error)
+}
+
+// monitorMetricSource reads metrics from Azure Monitor
+type monitorMetricSource struct {
+	client autorest.Client
+	base   string
+}
+
+func (s *monitorMetricSource) average(server postgresql.Server, metric string, window time.Duration) (float64, bool, error) {
+	end := time.Now().UTC()
+	start := end.Add(-window)
+	req, err := autorest.Prepare(&http.Request{},
+		autorest.AsGet(),
+		autorest.WithBaseURL(s.base),
+		autorest.WithPath(to.String(server.ID)+"/providers/microsoft.insights/metrics"),
+		autorest.WithQueryParameters(map[string]interface{}{
+			"api-version": metricsAPIVersion,
+			"metricnames": autorest.Encode("query", metric),
+			"timespan":    autorest.Encode("query", start.Format(time.RFC3339)+"/"+end.Format(time.RFC3339)),
+			"interval":    "PT1M",
+			"aggregation": "Average",
+		}))
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := autorest.SendWithSender(s.client, req)
+	if err != nil {
+		return 0, false, err
+	}
+	var result struct {
+		Value []struct {
+			Timeseries []struct {
+				Data []struct {
+					Average *float64 `json:"average"`
+				} `json:"data"`
+			} `json:"timeseries"`
+		} `json:"value"`
+	}
+	err = autorest.Respond(resp,
+		s.client.ByInspecting(),
+		azure.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(&result),
+		autorest.ByClosing())
+	if err != nil {
+		return 0, false, err
+	}
+	sum, n := 0.0, 0
+	for _, v := range result.Value {
+		for _, ts := range v.Timeseries {
+			for _, d := range ts.Data {
+				if d.Average != nil {
+					sum += *d.Average
+					n++
+				}
+			}
+		}
+	}
+	if n == 0 {
+		return 0, false, nil
+	}
+	return sum / float64(n), true, nil
+}
+
+// fileMetricSource reads current values from a JSON file, read again on every call
+type fileMetricSource struct {
+	path string
+}
+
+func (s *fileMetricSource) average(server postgresql.Server, metric string, window time.Duration) (float64, bool, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return 0, false, err
+	}
+	values := map[string]map[string]float64{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return 0, false, fmt.Errorf("%s: %v", s.path, err)
+	}
+	v, ok := values[to.String(server.Name)][metric]
+	return v, ok, nil
+}
+
+// newMetricSource creates the source named by spec, "monitor" or "file:<path>"
+func newMetricSource(spec string) (metricSource, error) {
+	if spec == "monitor" {
+		return &monitorMetricSource{client: monitorClient.Client, base: monitorClient.BaseURI}, nil
+	}
+	if strings.HasPrefix(spec, "file:") {
+		return &fileMetricSource{path: strings.TrimPrefix(spec, "file:")}, nil
+	}
+	return nil, fmt.Errorf("Unknown metric source %q, expected monitor or file:<path>", spec)
+}
+
+// timeWindow is a daily UTC time range, it may wrap around midnight
+type timeWindow struct {
+	from, to time.Duration
+	always   bool
+}
+
+// parseTimeWindow parses "22:00-06:00"; an empty string means always
+func parseTimeWindow(s string) (timeWindow, error) {
+	if s == "" {
+		return timeWindow{always: true}, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("Invalid time window %q, expected HH:MM-HH:MM", s)
+	}
+	var w timeWindow
+	var err error
+	if w.from, err = parseClock(from); err != nil {
+		return w, err
+	}
+	if w.to, err = parseClock(to); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	hh, mm, _ := strings.Cut(strings.TrimSpace(s), ":")
+	h, err := strconv.Atoi(hh)
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("Invalid time %q, expected HH:MM", s)
+	}
+	m := 0
+	if mm != "" {
+		if m, err = strconv.Atoi(mm); err != nil || m < 0 || m > 59 {
+			return 0, fmt.Errorf("Invalid time %q, expected HH:MM", s)
+		}
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// contains reports whether t falls in the window
+func (w timeWindow) contains(t time.Time) bool {
+	if w.always {
+		return true
+	}
+	t = t.UTC()
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.from <= w.to {
+		return clock >= w.from && clock < w.to
+	}
+	return clock >= w.from || clock < w.to
+}
+
+// autoscalePolicy decides when and how far to scale
+type autoscalePolicy struct {
+	metric         string
+	scaleUpAbove   float64
+	scaleDownBelow float64
+	window         time.Duration
+	cooldown       time.Duration
+	minCapacity    int32
+	maxCapacity    int32
+	allowed        timeWindow
+}
+
+// validate reports thresholds or capacities that contradict each other
+func (p *autoscalePolicy) validate() error {
+	if p.scaleDownBelow >= p.scaleUpAbove {
+		return fmt.Errorf("-scale-down-below %.1f must be below -scale-up-above %.1f", p.scaleDownBelow, p.scaleUpAbove)
+	}
+	if p.minCapacity > 0 && p.maxCapacity > 0 && p.minCapacity > p.maxCapacity {
+		return fmt.Errorf("-min-capacity %d is above -max-capacity %d", p.minCapacity, p.maxCapacity)
+	}
+	return nil
+}
+
+// decide returns the compute units a server should have, the action and why
+func (p *autoscalePolicy) decide(tier *skuTier, current int32, value float64, lastScaled time.Time, now time.Time) (int32, string, string) {
+	direction := 0
+	reason := ""
+	switch {
+	case value > p.scaleUpAbove:
+		direction = 1
+		reason = fmt.Sprintf("%s %.1f > %.1f", p.metric, value, p.scaleUpAbove)
+	case value < p.scaleDownBelow:
+		direction = -1
+		reason = fmt.Sprintf("%s %.1f < %.1f", p.metric, value, p.scaleDownBelow)
+	default:
+		return current, autoscaleSteady, fmt.Sprintf("%s %.1f within %.1f-%.1f", p.metric, value, p.scaleDownBelow, p.scaleUpAbove)
+	}
+
+	target := nextComputeUnits(tier, current, direction)
+	if target == current || (p.maxCapacity > 0 && target > p.maxCapacity) || (p.minCapacity > 0 && target < p.minCapacity) {
+		return current, autoscaleAtLimit, reason + fmt.Sprintf(", no step from %d within %d-%d", current, p.minCapacity, p.maxCapacity)
+	}
+	if !lastScaled.IsZero() && now.Sub(lastScaled) < p.cooldown {
+		return current, autoscaleCooldown, reason + fmt.Sprintf(", last scaled %s ago", now.Sub(lastScaled).Truncate(time.Second))
+	}
+	if !p.allowed.contains(now) {
+		return current, autoscaleOutsideWin, reason + ", outside the allowed hours"
+	}
+	if direction > 0 {
+		return target, autoscaleUp, reason
+	}
+	return target, autoscaleDown, reason
+}
+
+// nextComputeUnits returns the neighbouring compute units of the tier, current if there is none
+func nextComputeUnits(tier *skuTier, current int32, direction int) int32 {
+	for i, cu := range tier.ComputeUnits {
+		if cu != current {
+			continue
+		}
+		if j := i + direction; j >= 0 && j < len(tier.ComputeUnits) {
+			return tier.ComputeUnits[j]
+		}
+	}
+	return current
+}
+
+// autoscaleRecord is one entry of the audit trail
+type autoscaleRecord struct {
+	Time          time.Time `json:"time"`
+	ResourceGroup string    `json:"resourceGroup"`
+	Server        string    `json:"server"`
+	Metric        string    `json:"metric"`
+	Value         float64   `json:"value"`
+	From          int32     `json:"fromComputeUnits"`
+	To            int32     `json:"toComputeUnits"`
+	Action        string    `json:"action"`
+	Reason        string    `json:"reason"`
+	DryRun        bool      `json:"dryRun,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// autoscaler applies the policy to the servers selected by filter
+type autoscaler struct {
+	policy     autoscalePolicy
+	source     metricSource
+	filter     *serverFilter
+	auditPath  string
+	dryRun     bool
+	lastScaled map[string]time.Time
+	// scale applies a plan, applyScale unless replaced
+	scale func(plan *scalePlan) error
+	// preflight checks the permissions in resource groups not seen before, nil to skip
+	preflight func(resourceGroups []string)
+	checked   map[string]bool
+}
+
+func runAutoscale(args []string) {
+	flags := newFlagSet("autoscale")
+	filter := addServerFilterFlags(flags)
+	all := flags.Bool("all", false, "autoscale every server in the subscription when no filter is given")
+	source := flags.String("metrics", "monitor", "metric source: monitor or file:<path>")
+	metric := flags.String("metric", "cpu_percent", "metric to scale on")
+	up := flags.Float64("scale-up-above", 80, "scale up when the average is above this")
+	down := flags.Float64("scale-down-below", 20, "scale down when the average is below this")
+	window := flags.Duration("window", 15*time.Minute, "period the metric is averaged over")
+	cooldown := flags.Duration("cooldown", time.Hour, "minimum time between two scalings of a server")
+	minCapacity := flags.Int("min-capacity", 0, "never scale below these compute units")
+	maxCapacity := flags.Int("max-capacity", 0, "never scale above these compute units (default tier maximum)")
+	allowed := flags.String("allowed-hours", "", "UTC time window scaling may happen in, e.g. 22:00-06:00 (default always)")
+	interval := flags.Duration("interval", 5*time.Minute, "time between evaluations")
+	once := flags.Bool("once", false, "evaluate once and exit")
+	audit := flags.String("audit-log", "autoscale-audit.jsonl", "file the decisions are appended to")
+	dryRun := flags.Bool("dry-run", false, "only record what would be scaled")
+	flags.Parse(args)
+
+	if !*all && filter.empty() {
+		fmt.Println("Select servers with -server, -tag, -name or -resource-group, or pass -all")
+		os.Exit(2)
+	}
+	allowedWindow, err := parseTimeWindow(*allowed)
+	onErrorFail(err, "Invalid -allowed-hours")
+	metrics, err := newMetricSource(*source)
+	onErrorFail(err, "Invalid -metrics")
+
+	a := &autoscaler{
+		policy: autoscalePolicy{
+			metric:         *metric,
+			scaleUpAbove:   *up,
+			scaleDownBelow: *down,
+			window:         *window,
+			cooldown:       *cooldown,
+			minCapacity:    int32(*minCapacity),
+			maxCapacity:    int32(*maxCapacity),
+			allowed:        allowedWindow,
+		},
+		source:    metrics,
+		filter:    filter,
+		auditPath: *audit,
+		dryRun:    *dryRun,
+		scale:     applyScale,
+	}
+	if err := a.policy.validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	a.lastScaled, err = readLastScaled(*audit)
+	onErrorFail(err, "Reading audit log failed")
+	if !*dryRun {
+		var metricActions []string
+		if *source == "monitor" {
+			metricActions = append(metricActions, actionMetricsRead)
+		}
+		// servers matched later, e.g. by -tag, may be in resource groups not checked yet
+		a.checked = map[string]bool{}
+		a.preflight = func(resourceGroups []string) {
+			requirePermissions("autoscale", resourceGroups, metricActions...)
+		}
+	}
+
+	for {
+		if err := a.evaluate(time.Now().UTC()); err != nil {
+			fmt.Printf("Evaluation failed: %v\n", err)
+		}
+		if *once {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// evaluate makes one decision for every selected server
+func (a *autoscaler) evaluate(now time.Time) error {
+	servers, err := listServers(serversClient, a.filter)
+	if err != nil {
+		return err
+	}
+	if a.preflight != nil {
+		var unchecked []string
+		for _, group := range serverResourceGroups(servers) {
+			if !a.checked[strings.ToLower(group)] {
+				a.checked[strings.ToLower(group)] = true
+				unchecked = append(unchecked, group)
+			}
+		}
+		if len(unchecked) > 0 {
+			a.preflight(unchecked)
+		}
+	}
+	for _, server := range servers {
+		record := a.evaluateServer(server, now)
+		fmt.Printf("%s/%s: %s %d->%d %s %s\n", record.ResourceGroup, record.Server, record.Action, record.From, record.To, record.Reason, record.Error)
+		if record.Action == autoscaleSteady {
+			continue
+		}
+		if err := appendAuditRecord(a.auditPath, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *autoscaler) evaluateServer(server postgresql.Server, now time.Time) autoscaleRecord {
+	group := resourceGroupFromID(to.String(server.ID))
+	record := autoscaleRecord{
+		Time:          now,
+		ResourceGroup: group,
+		Server:        to.String(server.Name),
+		Metric:        a.policy.metric,
+		DryRun:        a.dryRun,
+	}
+	fail := func(err error) autoscaleRecord {
+		record.Action = autoscaleFailed
+		record.Error = err.Error()
+		return record
+	}
+	if server.Sku == nil {
+		return fail(fmt.Errorf("server has no SKU"))
+	}
+	record.From = to.Int32(server.Sku.Capacity)
+	record.To = record.From
+	tier, err := findSkuTier(server.Sku.Tier)
+	if err != nil {
+		return fail(err)
+	}
+	value, ok, err := a.source.average(server, a.policy.metric, a.policy.window)
+	if err != nil {
+		return fail(err)
+	}
+	if !ok {
+		record.Action = autoscaleNoData
+		return record
+	}
+	record.Value = value
+
+	key := credentialKey(group, record.Server)
+	record.To, record.Action, record.Reason = a.policy.decide(tier, record.From, value, a.lastScaled[key], now)
+	if record.To == record.From || a.dryRun {
+		return record
+	}
+	plan, err := planScale(group, server, record.To, 0)
+	if err != nil {
+		return fail(err)
+	}
+	if err := a.scale(plan); err != nil {
+		return fail(err)
+	}
+	a.lastScaled[key] = now
+	return record
+}
+
+// appendAuditRecord appends one JSON line to the audit trail
+func appendAuditRecord(name string, record autoscaleRecord) error {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err == nil {
+		_, err = f.Write(append(data, '\n'))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readLastScaled returns the time of the last real scaling of each server in the audit trail
+func readLastScaled(name string) (map[string]time.Time, error) {
+	last := map[string]time.Time{}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return last, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record autoscaleRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if record.DryRun || (record.Action != autoscaleUp && record.Action != autoscaleDown) {
+			continue
+		}
+		key := credentialKey(record.ResourceGroup, record.Server)
+		if record.Time.After(last[key]) {
+			last[key] = record.Time
+		}
+	}
+	return last, scanner.Err()
+}
@@ -0,0 +1,231 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// fakeMetricSource returns fixed values by server name
+type fakeMetricSource struct {
+	values map[string]float64
+	err    error
+}
+
+func (s *fakeMetricSource) average(server postgresql.Server, metric string, window time.Duration) (float64, bool, error) {
+	v, ok := s.values[to.String(server.Name)]
+	return v, ok, s.err
+}
+
+// recordingScale stands in for applyScale
+type recordingScale struct {
+	plans []*scalePlan
+	err   error
+}
+
+func (r *recordingScale) scale(plan *scalePlan) error {
+	r.plans = append(r.plans, plan)
+	return r.err
+}
+
+func testStandardServer(name string, computeUnits int32) postgresql.Server {
+	return postgresql.Server{
+		ID:   to.StringPtr("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg/providers/Microsoft.DBforPostgreSQL/servers/" + name),
+		Name: to.StringPtr(name),
+		Sku:  &postgresql.Sku{Tier: postgresql.Standard, Capacity: to.Int32Ptr(computeUnits)},
+		ServerProperties: &postgresql.ServerProperties{
+			Version:   postgresql.NineFullStopSix,
+			StorageMB: to.Int64Ptr(storageIncrementMB),
+		},
+	}
+}
+
+func testAutoscalePolicy() autoscalePolicy {
+	return autoscalePolicy{
+		metric:         "cpu_percent",
+		scaleUpAbove:   80,
+		scaleDownBelow: 20,
+		window:         15 * time.Minute,
+		cooldown:       time.Hour,
+		allowed:        timeWindow{always: true},
+	}
+}
+
+func TestAutoscaleDecide(t *testing.T) {
+	tier, err := findSkuTier(postgresql.Standard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2017, 9, 26, 12, 0, 0, 0, time.UTC)
+	nightOnly, _ := parseTimeWindow("22:00-06:00")
+	tests := []struct {
+		name       string
+		adjust     func(p *autoscalePolicy)
+		current    int32
+		value      float64
+		lastScaled time.Time
+		want       int32
+		action     string
+	}{
+		{"steady", nil, 200, 50, time.Time{}, 200, autoscaleSteady},
+		{"up", nil, 200, 91, time.Time{}, 400, autoscaleUp},
+		{"down", nil, 200, 5, time.Time{}, 100, autoscaleDown},
+		{"tier maximum", nil, 800, 91, time.Time{}, 800, autoscaleAtLimit},
+		{"tier minimum", nil, 100, 5, time.Time{}, 100, autoscaleAtLimit},
+		{"max capacity", func(p *autoscalePolicy) { p.maxCapacity = 200 }, 200, 91, time.Time{}, 200, autoscaleAtLimit},
+		{"min capacity", func(p *autoscalePolicy) { p.minCapacity = 200 }, 200, 5, time.Time{}, 200, autoscaleAtLimit},
+		{"cooldown", nil, 200, 91, now.Add(-30 * time.Minute), 200, autoscaleCooldown},
+		{"cooldown over", nil, 200, 91, now.Add(-2 * time.Hour), 400, autoscaleUp},
+		{"outside window", func(p *autoscalePolicy) { p.allowed = nightOnly }, 200, 91, time.Time{}, 200, autoscaleOutsideWin},
+	}
+	for _, test := range tests {
+		p := testAutoscalePolicy()
+		if test.adjust != nil {
+			test.adjust(&p)
+		}
+		got, action, reason := p.decide(tier, test.current, test.value, test.lastScaled, now)
+		if got != test.want || action != test.action {
+			t.Errorf("%s: decide = %d %s (%s), want %d %s", test.name, got, action, reason, test.want, test.action)
+		}
+	}
+}
+
+func TestAutoscaleScalesThroughScaleFunc(t *testing.T) {
+	scale := &recordingScale{}
+	a := &autoscaler{
+		policy:     testAutoscalePolicy(),
+		source:     &fakeMetricSource{values: map[string]float64{"busy": 91, "idle": 50}},
+		lastScaled: map[string]time.Time{},
+		scale:      scale.scale,
+	}
+	now := time.Date(2017, 9, 26, 12, 0, 0, 0, time.UTC)
+
+	if record := a.evaluateServer(testStandardServer("idle", 200), now); record.Action != autoscaleSteady || len(scale.plans) != 0 {
+		t.Fatalf("idle server: %+v, %d plans", record, len(scale.plans))
+	}
+	record := a.evaluateServer(testStandardServer("busy", 200), now)
+	if record.Action != autoscaleUp || record.To != 400 {
+		t.Fatalf("busy server: %+v", record)
+	}
+	if len(scale.plans) != 1 || scale.plans[0].ToComputeUnits != 400 || scale.plans[0].ResourceGroup != "rg" {
+		t.Fatalf("plans %+v", scale.plans)
+	}
+
+	// the next evaluation is within the cooldown
+	if record := a.evaluateServer(testStandardServer("busy", 400), now.Add(10*time.Minute)); record.Action != autoscaleCooldown || len(scale.plans) != 1 {
+		t.Errorf("second evaluation: %+v, %d plans", record, len(scale.plans))
+	}
+	if record := a.evaluateServer(testStandardServer("silent", 200), now); record.Action != autoscaleNoData {
+		t.Errorf("server without data: %+v", record)
+	}
+}
+
+func TestAutoscaleFailures(t *testing.T) {
+	a := &autoscaler{
+		policy:     testAutoscalePolicy(),
+		source:     &fakeMetricSource{values: map[string]float64{"busy": 91}},
+		lastScaled: map[string]time.Time{},
+		scale:      (&recordingScale{err: errors.New("throttled")}).scale,
+	}
+	now := time.Date(2017, 9, 26, 12, 0, 0, 0, time.UTC)
+	record := a.evaluateServer(testStandardServer("busy", 200), now)
+	if record.Action != autoscaleFailed || record.Error != "throttled" {
+		t.Errorf("failed scale: %+v", record)
+	}
+	if _, ok := a.lastScaled[credentialKey("rg", "busy")]; ok {
+		t.Error("a failed scaling starts the cooldown")
+	}
+
+	a.source = &fakeMetricSource{err: errors.New("metrics unavailable")}
+	if record := a.evaluateServer(testStandardServer("busy", 200), now); record.Action != autoscaleFailed {
+		t.Errorf("failed metric: %+v", record)
+	}
+}
+
+// a restarted autoscaler reads the cooldown back from the audit trail
+func TestAutoscaleCooldownRecovery(t *testing.T) {
+	audit := filepath.Join(t.TempDir(), "audit.jsonl")
+	scaledAt := time.Date(2017, 9, 26, 12, 0, 0, 0, time.UTC)
+	records := []autoscaleRecord{
+		{Time: scaledAt.Add(-3 * time.Hour), ResourceGroup: "rg", Server: "busy", Action: autoscaleUp, From: 100, To: 200},
+		{Time: scaledAt, ResourceGroup: "rg", Server: "busy", Action: autoscaleUp, From: 200, To: 400},
+		// not real scalings
+		{Time: scaledAt.Add(20 * time.Minute), ResourceGroup: "rg", Server: "busy", Action: autoscaleUp, DryRun: true},
+		{Time: scaledAt.Add(25 * time.Minute), ResourceGroup: "rg", Server: "busy", Action: autoscaleFailed},
+		{Time: scaledAt.Add(-30 * time.Minute), ResourceGroup: "rg", Server: "other", Action: autoscaleCooldown},
+	}
+	for _, record := range records {
+		if err := appendAuditRecord(audit, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last, err := readLastScaled(audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := last[credentialKey("rg", "busy")]; !got.Equal(scaledAt) {
+		t.Errorf("last scaled %v, want %v", got, scaledAt)
+	}
+	if _, ok := last[credentialKey("rg", "other")]; ok {
+		t.Error("a skipped decision counts as scaling")
+	}
+
+	scale := &recordingScale{}
+	a := &autoscaler{
+		policy:     testAutoscalePolicy(),
+		source:     &fakeMetricSource{values: map[string]float64{"busy": 91}},
+		lastScaled: last,
+		scale:      scale.scale,
+	}
+	if record := a.evaluateServer(testStandardServer("busy", 400), scaledAt.Add(30*time.Minute)); record.Action != autoscaleCooldown {
+		t.Errorf("within the recovered cooldown: %+v", record)
+	}
+	if record := a.evaluateServer(testStandardServer("busy", 400), scaledAt.Add(61*time.Minute)); record.Action != autoscaleUp || len(scale.plans) != 1 {
+		t.Errorf("after the recovered cooldown: %+v", record)
+	}
+
+	if last, err := readLastScaled(filepath.Join(t.TempDir(), "missing.jsonl")); err != nil || len(last) != 0 {
+		t.Errorf("missing audit trail: %v, %v", last, err)
+	}
+}
+
+func TestAutoscalePolicyValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		change   func(p *autoscalePolicy)
+		rejected bool
+	}{
+		{"defaults", func(p *autoscalePolicy) {}, false},
+		{"down equals up", func(p *autoscalePolicy) { p.scaleDownBelow = 80 }, true},
+		{"down above up", func(p *autoscalePolicy) { p.scaleDownBelow, p.scaleUpAbove = 60, 40 }, true},
+		{"min below max", func(p *autoscalePolicy) { p.minCapacity, p.maxCapacity = 100, 400 }, false},
+		{"min equals max", func(p *autoscalePolicy) { p.minCapacity, p.maxCapacity = 200, 200 }, false},
+		{"min above max", func(p *autoscalePolicy) { p.minCapacity, p.maxCapacity = 400, 200 }, true},
+		{"only min", func(p *autoscalePolicy) { p.minCapacity = 400 }, false},
+	}
+	for _, c := range cases {
+		p := testAutoscalePolicy()
+		c.change(&p)
+		if err := p.validate(); (err != nil) != c.rejected {
+			t.Errorf("%s: validate() = %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - bootstrap checks that Microsoft.DBforPostgreSQL is registered in the subscription
+//   (optionally registering it) and creates the resource group if it is missing
+// - failures come with a remediation message saying what to run or which role is missing
+//
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	postgresqlProviderNamespace = "Microsoft.DBforPostgreSQL"
+	providerRegistered          = "Registered"
+	providerPollingDelay        = 10 * time.Second
+	providerPollingDuration     = 10 * time.Minute
+)
+
+func init() {
+	registerCommand(command{
+		name:         "bootstrap",
+		summary:      "check/register the Microsoft.DBforPostgreSQL provider and create the resource group",
+		needsClients: true,
+		run:          runBootstrap,
+	})
+}
+
+// bootstrapOptions says what bootstrap may change
+type bootstrapOptions struct {
+	resourceGroup    string
+	location         string
+	tags             map[string]string
+	registerProvider bool
+}
+
+func runBootstrap(args []string) {
+	flags := newFlagSet("bootstrap")
+	group := flags.String("resource-group", resourceGroupName, "resource group to create if missing")
+	loc := flags.String("location", location, "location of the resource group and servers")
+	register := flags.Bool("register-provider", false, "register "+postgresqlProviderNamespace+" if it is not registered")
+	var tags stringsFlag
+	flags.Var(&tags, "tag", "tag key=value set on a created resource group (repeatable)")
+	flags.Parse(args)
+
+	options := bootstrapOptions{
+		resourceGroup:    *group,
+		location:         *loc,
+		tags:             parseTags(tags),
+		registerProvider: *register,
+	}
+	onErrorFail(bootstrap(options), "Bootstrap failed")
+	fmt.Println("Bootstrap done")
+}
+
+// parseTags turns key=value flags into a map
+func parseTags(values []string) map[string]string {
+	tags := map[string]string{}
+	for _, v := range values {
+		key, value, _ := strings.Cut(v, "=")
+		tags[key] = value
+	}
+	return tags
+}
+
+// toTagPtrs converts tags to the map type used by the models
+func toTagPtrs(tags map[string]string) *map[string]*string {
+	m := map[string]*string{}
+	for k, v := range tags {
+		m[k] = to.StringPtr(v)
+	}
+	return &m
+}
+
+// bootstrap prepares the subscription for creating servers in options.location
+func bootstrap(options bootstrapOptions) error {
+	if err := ensureProviderRegistered(options.registerProvider, options.location); err != nil {
+		return err
+	}
+	return ensureResourceGroup(options.resourceGroup, options.location, options.tags)
+}
+
+// ensureProviderRegistered checks the provider registration, registering it and waiting if allowed
+func ensureProviderRegistered(register bool, location string) error {
+	provider, err := providersClient.Get(postgresqlProviderNamespace, "")
+	if err != nil {
+		return withRemediation(err, "reading provider "+postgresqlProviderNamespace)
+	}
+	if err := checkProviderLocation(provider, location); err != nil {
+		return err
+	}
+	state := to.String(provider.RegistrationState)
+	if state == providerRegistered {
+		fmt.Printf("Provider %s is registered\n", postgresqlProviderNamespace)
+		return nil
+	}
+	if !register {
+		return fmt.Errorf("Provider %s is %s.\nRemediation: run 'az provider register --namespace %s' or pass -register-provider",
+			postgresqlProviderNamespace, state, postgresqlProviderNamespace)
+	}
+
+	fmt.Printf("Registering provider %s (state %s)\n", postgresqlProviderNamespace, state)
+	if _, err := providersClient.Register(postgresqlProviderNamespace); err != nil {
+		return withRemediation(err, "registering provider "+postgresqlProviderNamespace)
+	}
+	deadline := time.Now().Add(providerPollingDuration)
+	for time.Now().Before(deadline) {
+		time.Sleep(providerPollingDelay)
+		provider, err = providersClient.Get(postgresqlProviderNamespace, "")
+		if err != nil {
+			return withRemediation(err, "reading provider "+postgresqlProviderNamespace)
+		}
+		state = to.String(provider.RegistrationState)
+		fmt.Printf("Provider %s is %s\n", postgresqlProviderNamespace, state)
+		if state == providerRegistered {
+			return nil
+		}
+	}
+	return fmt.Errorf("Provider %s still %s after %v.\nRemediation: check 'az provider show --namespace %s' and retry",
+		postgresqlProviderNamespace, state, providerPollingDuration, postgresqlProviderNamespace)
+}
+
+// checkProviderLocation fails if the provider does not offer servers in location
+func checkProviderLocation(provider resources.Provider, location string) error {
+	if provider.ResourceTypes == nil || location == "" {
+		return nil
+	}
+	for _, rt := range *provider.ResourceTypes {
+		if !strings.EqualFold(to.String(rt.ResourceType), "servers") || rt.Locations == nil {
+			continue
+		}
+		var names []string
+		for _, l := range *rt.Locations {
+			if normalizeLocation(l) == normalizeLocation(location) {
+				return nil
+			}
+			names = append(names, normalizeLocation(l))
+		}
+		return fmt.Errorf("Location %s does not offer %s servers.\nRemediation: use one of %s",
+			location, postgresqlProviderNamespace, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// normalizeLocation turns display names like "West US" into names like "westus"
+func normalizeLocation(location string) string {
+	return strings.ToLower(strings.Replace(location, " ", "", -1))
+}
+
+// ensureResourceGroup creates the resource group with tags if it does not exist
+func ensureResourceGroup(name string, location string, tags map[string]string) error {
+	response, err := groupsClient.CheckExistence(name)
+	if err != nil {
+		return withRemediation(err, "checking resource group "+name)
+	}
+	if response.StatusCode == http.StatusNoContent || response.StatusCode == http.StatusOK {
+		group, err := groupsClient.Get(name)
+		if err != nil {
+			return withRemediation(err, "reading resource group "+name)
+		}
+		if normalizeLocation(to.String(group.Location)) != normalizeLocation(location) {
+			fmt.Printf("Note: resource group %s is in %s, servers will be created in %s\n", name, to.String(group.Location), location)
+		}
+		fmt.Printf("Resource group %s exists\n", name)
+		return nil
+	}
+
+	fmt.Printf("Creating resource group %s in %s\n", name, location)
+	group := resources.Group{
+		Location: to.StringPtr(location),
+		Tags:     toTagPtrs(tags),
+	}
+	if _, err := groupsClient.CreateOrUpdate(name, group); err != nil {
+		return withRemediation(err, "creating resource group "+name)
+	}
+	activeTransaction.recordResourceGroup(name)
+	return nil
+}
+
+// armError returns the HTTP status and ARM error code of an error returned by a client
+func armError(err error) (int, string) {
+	statusCode := 0
+	code := ""
+	switch e := err.(type) {
+	case autorest.DetailedError:
+		if sc, ok := e.StatusCode.(int); ok {
+			statusCode = sc
+		}
+		if re, ok := e.Original.(*azure.RequestError); ok && re.ServiceError != nil {
+			code = re.ServiceError.Code
+		}
+	case *azure.RequestError:
+		if sc, ok := e.StatusCode.(int); ok {
+			statusCode = sc
+		}
+		if e.ServiceError != nil {
+			code = e.ServiceError.Code
+		}
+	}
+	return statusCode, code
+}
+
+// withRemediation wraps err with what was being done and, for well known failures, how to fix it
+func withRemediation(err error, doing string) error {
+	statusCode, code := armError(err)
+	remediation := ""
+	switch {
+	case code == "AuthorizationFailed" || statusCode == http.StatusForbidden:
+		remediation = fmt.Sprintf("the service principal %s needs a role such as Contributor on subscription %s", os.Getenv("AZURE_CLIENT_ID"), armSubscriptionID)
+	case code == "InvalidAuthenticationToken" || code == "ExpiredAuthenticationToken" || statusCode == http.StatusUnauthorized:
+		remediation = "check AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET"
+	case code == "SubscriptionNotFound" || code == "InvalidSubscriptionId":
+		remediation = "check AZURE_SUBSCRIPTION_ID"
+	case code == "MissingSubscriptionRegistration":
+		remediation = fmt.Sprintf("run 'az provider register --namespace %s' or pass -register-provider", postgresqlProviderNamespace)
+	case code == "LocationNotAvailableForResourceGroup" || code == "NoRegisteredProviderFound":
+		remediation = "choose another location"
+	}
+	if remediation == "" {
+		return fmt.Errorf("%s: %v", doing, err)
+	}
+	return fmt.Errorf("%s: %v\nRemediation: %s", doing, err, remediation)
+}
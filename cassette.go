@@ -0,0 +1,287 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - RECORD_CASSETTE=<file> records every request sent to ARM and its response into a
+//   cassette, the shape of the go-vcr recordings of the vendored storage package but JSON
+//   (go-vcr and a YAML package are not vendored)
+// - cassettes are sanitized when recorded: the headers and JSON paths redacted by --debug
+//   (debuglog.go) and SAS signatures are replaced, subscription ids become
+//   cassetteSubscriptionID
+// - REPLAY_CASSETTE=<file> answers the requests of ServersClient and the clients converted
+//   from it (FirewallRulesClient, DatabasesClient, ConfigurationsClient, LogFilesClient) and
+//   of every other ARM client from a cassette without credentials or network; requests are
+//   matched by method and URL, in recorded order for repeated requests such as polls
+// - the recorder sits next to the HTTP client, so each retry is an interaction of its own
+//   and replays the same way
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const (
+	cassetteVersion = 1
+	// subscription id of recorded and replayed requests
+	cassetteSubscriptionID = "00000000-0000-0000-0000-000000000000"
+)
+
+var subscriptionPathPattern = regexp.MustCompile(`(?i)/subscriptions/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+// cassette is a recording of ARM interactions
+type cassette struct {
+	Version      int            `json:"version"`
+	Interactions []*interaction `json:"interactions"`
+}
+
+type interaction struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+}
+
+type recordedResponse struct {
+	Status  string      `json:"status"`
+	Code    int         `json:"code"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+}
+
+var (
+	// cassetteRecorder of RECORD_CASSETTE, nil when not recording
+	armRecorder *cassetteRecorder
+	// cassettePlayer of REPLAY_CASSETTE, nil when sending to ARM
+	armPlayer *cassettePlayer
+)
+
+// cassetteRecorder appends sanitized interactions to a cassette file
+type cassetteRecorder struct {
+	mu       sync.Mutex
+	path     string
+	cassette cassette
+	redactor *requestLogger
+}
+
+func newCassetteRecorder(path string) (*cassetteRecorder, error) {
+	redactor, err := newRequestLogger(ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+	r := &cassetteRecorder{path: path, cassette: cassette{Version: cassetteVersion}, redactor: redactor}
+	// an empty cassette right away shows a wrong path before any request is sent
+	return r, r.save()
+}
+
+// sendDecorator returns the SendDecorator recording each request and its response
+func (c *cassetteRecorder) sendDecorator() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			var requestBody []byte
+			if r.Body != nil {
+				var err error
+				if requestBody, err = ioutil.ReadAll(r.Body); err != nil {
+					return nil, err
+				}
+				r.Body.Close()
+				r.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+			}
+			resp, err := s.Do(r)
+			if err != nil || resp == nil {
+				return resp, err
+			}
+			var responseBody []byte
+			if resp.Body != nil {
+				responseBody, err = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				resp.Body = ioutil.NopCloser(bytes.NewReader(responseBody))
+				if err != nil {
+					return resp, err
+				}
+			}
+			c.record(&interaction{
+				Request: recordedRequest{
+					Method:  r.Method,
+					URL:     c.sanitize(redactURL(r.URL.String())),
+					Headers: c.sanitizeHeaders(r.Header),
+					Body:    c.sanitizeBody(requestBody),
+				},
+				Response: recordedResponse{
+					Status:  resp.Status,
+					Code:    resp.StatusCode,
+					Headers: c.sanitizeHeaders(resp.Header),
+					Body:    c.sanitizeBody(responseBody),
+				},
+			})
+			return resp, nil
+		})
+	}
+}
+
+// record adds an interaction and rewrites the cassette so it is complete whenever the program exits
+func (c *cassetteRecorder) record(i *interaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cassette.Interactions = append(c.cassette.Interactions, i)
+	if err := c.save(); err != nil {
+		fmt.Printf("Writing cassette %s failed: %v\n", c.path, err)
+	}
+}
+
+func (c *cassetteRecorder) save() error {
+	data, err := json.MarshalIndent(c.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path, data, 0600)
+}
+
+// sanitize replaces subscription ids
+func (c *cassetteRecorder) sanitize(s string) string {
+	s = subscriptionPathPattern.ReplaceAllString(s, "/subscriptions/"+cassetteSubscriptionID)
+	if armSubscriptionID != "" {
+		s = strings.Replace(s, armSubscriptionID, cassetteSubscriptionID, -1)
+		s = strings.Replace(s, strings.ToLower(armSubscriptionID), cassetteSubscriptionID, -1)
+	}
+	return s
+}
+
+func (c *cassetteRecorder) sanitizeHeaders(header http.Header) http.Header {
+	result := http.Header{}
+	for key, values := range header {
+		if c.redactor.headers[http.CanonicalHeaderKey(key)] {
+			result[key] = []string{redacted}
+			continue
+		}
+		for _, v := range values {
+			result[key] = append(result[key], c.sanitize(redactURL(v)))
+		}
+	}
+	return result
+}
+
+func (c *cassetteRecorder) sanitizeBody(body []byte) string {
+	var doc interface{}
+	if len(body) > 0 && json.Unmarshal(body, &doc) == nil {
+		c.redactor.redactJSON(doc)
+		body, _ = json.Marshal(doc)
+	}
+	return c.sanitize(string(body))
+}
+
+// cassettePlayer is a Sender answering requests from a cassette
+type cassettePlayer struct {
+	mu     sync.Mutex
+	path   string
+	queues map[string][]*interaction
+}
+
+func loadCassette(path string) (*cassettePlayer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if c.Version != cassetteVersion {
+		return nil, fmt.Errorf("%s: cassette version %d, expected %d", path, c.Version, cassetteVersion)
+	}
+	p := &cassettePlayer{path: path, queues: map[string][]*interaction{}}
+	for _, i := range c.Interactions {
+		key := interactionKey(i.Request.Method, i.Request.URL)
+		p.queues[key] = append(p.queues[key], i)
+	}
+	return p, nil
+}
+
+func interactionKey(method string, url string) string {
+	return strings.ToUpper(method) + " " + strings.ToLower(url)
+}
+
+// Do answers a request with the next recorded response to the same method and URL
+func (p *cassettePlayer) Do(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		ioutil.ReadAll(r.Body)
+		r.Body.Close()
+	}
+	url := subscriptionPathPattern.ReplaceAllString(redactURL(r.URL.String()), "/subscriptions/"+cassetteSubscriptionID)
+	key := interactionKey(r.Method, url)
+	p.mu.Lock()
+	queue := p.queues[key]
+	if len(queue) == 0 {
+		p.mu.Unlock()
+		return nil, cassetteMissError(fmt.Sprintf("Cassette %s has no (more) recorded responses for %s %s", p.path, r.Method, url))
+	}
+	i := queue[0]
+	p.queues[key] = queue[1:]
+	p.mu.Unlock()
+
+	header := http.Header{}
+	for k, v := range i.Response.Headers {
+		header[k] = append([]string(nil), v...)
+	}
+	return &http.Response{
+		Status:        i.Response.Status,
+		StatusCode:    i.Response.Code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(i.Response.Body)),
+		ContentLength: int64(len(i.Response.Body)),
+		Request:       r,
+	}, nil
+}
+
+// unplayed returns the number of recorded interactions not asked for
+func (p *cassettePlayer) unplayed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, queue := range p.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// cassetteMissError is a request the cassette has no answer for, retrying does not help
+type cassetteMissError string
+
+func (e cassetteMissError) Error() string { return string(e) }
+
+func (e cassetteMissError) permanent() bool { return true }
+
+// replayToken is the bearer token of replayed requests, the cassette has none to check
+type replayToken struct{}
+
+func (replayToken) OAuthToken() string { return "replay" }
@@ -0,0 +1,146 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// staticToken is a bearer token that must not end up in a cassette
+type staticToken string
+
+func (t staticToken) OAuthToken() string { return string(t) }
+
+// sendToStub points serversClient at a stub of ARM, sending through useARMSender like the
+// clients of initClients
+func sendToStub(t *testing.T, baseURI string, subscriptionID string, token string) {
+	armSubscriptionID = subscriptionID
+	armAuthorizer = autorest.NewBearerAuthorizer(staticToken(token))
+	serversClient = newServersClient(subscriptionID)
+	serversClient.BaseURI = baseURI
+}
+
+// a server created while recording replays from the cassette without its password, the
+// bearer token or the subscription id
+func TestRecordAndReplayCassette(t *testing.T) {
+	const (
+		subscriptionID = "31f97be2-2566-44f2-bb14-14d6924c8caa"
+		token          = "eyJ0eXAiOiJKV1QiLCJhbGciOiJSUzI1NiJ9.live"
+		password       = "Wh0-Kn0ws-Th1s"
+	)
+	saved := struct {
+		serversClient  postgresql.ServersClient
+		subscriptionID string
+		authorizer     *autorest.BearerAuthorizer
+	}{serversClient, armSubscriptionID, armAuthorizer}
+	t.Cleanup(func() {
+		serversClient, armSubscriptionID, armAuthorizer = saved.serversClient, saved.subscriptionID, saved.authorizer
+		armRecorder = nil
+		armPlayer = nil
+	})
+
+	serverPath := "/subscriptions/" + subscriptionID + "/resourceGroups/rg/providers/Microsoft.DBforPostgreSQL/servers/recorded"
+	var bodies []string
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == serverPath:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"ResourceNotFound","message":"not found"}}`)
+		case r.Method == http.MethodPut && r.URL.Path == serverPath:
+			w.Header().Set("Azure-AsyncOperation", "https://"+r.Host+"/subscriptions/"+subscriptionID+"/providers/Microsoft.DBforPostgreSQL/locations/westus/azureAsyncOperation/op?api-version=2017-04-30-preview")
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, `{"operation":"UpsertElasticServer","startTime":"2017-09-26T18:00:00.57Z"}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	var err error
+	armRecorder, err = newCassetteRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendToStub(t, stub.URL, subscriptionID, token)
+	recordedURL, _, err := createServer("rg", "recorded", "westus", "azadmin", password, postgresql.NineFullStopSix, postgresql.Basic, 50, 51200, nil)
+	stub.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 || !strings.Contains(bodies[1], password) {
+		t.Fatalf("stub received %q", bodies)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{token, password, subscriptionID} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("cassette contains %s:\n%s", secret, data)
+		}
+	}
+	var recorded cassette
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded.Interactions) != 2 {
+		t.Fatalf("%d interactions recorded", len(recorded.Interactions))
+	}
+	put := recorded.Interactions[1].Request
+	var body struct {
+		Properties struct {
+			AdministratorLoginPassword string `json:"administratorLoginPassword"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal([]byte(put.Body), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Properties.AdministratorLoginPassword != redacted || put.Headers.Get("Authorization") != redacted {
+		t.Errorf("recorded request %+v", put)
+	}
+	if !strings.Contains(put.URL, "/subscriptions/"+cassetteSubscriptionID+"/") {
+		t.Errorf("recorded URL %s", put.URL)
+	}
+
+	// the stub is gone, every answer comes from the cassette
+	armRecorder = nil
+	armPlayer, err = loadCassette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendToStub(t, stub.URL, cassetteSubscriptionID, "replay")
+	replayedURL, _, err := createServer("rg", "recorded", "westus", "azadmin", password, postgresql.NineFullStopSix, postgresql.Basic, 50, 51200, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayedURL != strings.Replace(recordedURL, subscriptionID, cassetteSubscriptionID, 1) {
+		t.Errorf("replayed polling URL %s, recorded %s", replayedURL, recordedURL)
+	}
+	checkAllReplayed(t)
+}
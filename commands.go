@@ -0,0 +1,101 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// command is a sub-command of the sample, e.g. "logs report".
+// Commands that talk to Azure set needsClients so the clients are created
+// from the environment before run is called.
+type command struct {
+	name         string
+	summary      string
+	needsClients bool
+	run          func(args []string)
+}
+
+var commands = map[string]command{}
+
+// registerCommand adds a sub-command; called from init() of the file implementing it
+func registerCommand(c command) {
+	commands[c.name] = c
+}
+
+// runCommand finds the longest registered command name matching the leading
+// arguments and runs it with the remaining arguments.
+func runCommand(args []string) {
+	for n := len(args); n > 0; n-- {
+		c, ok := commands[strings.Join(args[:n], " ")]
+		if !ok {
+			continue
+		}
+		if c.needsClients {
+			initClients()
+		}
+		c.run(args[n:])
+		beforeExit()
+		return
+	}
+	switch args[0] {
+	case "help", "-h", "--help":
+		printUsage()
+		return
+	}
+	fmt.Printf("Unknown command: %s\n\n", strings.Join(args, " "))
+	printUsage()
+	os.Exit(2)
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("Usage: %s [command] [flags]\n\n", filepath.Base(os.Args[0]))
+	fmt.Println("Without a command the sample create/poll flow in main() is run; with")
+	fmt.Println("-keep-on-failure the resources it created are kept when it fails.")
+	fmt.Println("--debug logs every ARM request and response, with secrets redacted, to stderr.")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, name := range names {
+		fmt.Printf("  %-24s %s\n", name, commands[name].summary)
+	}
+}
+
+// newFlagSet returns a flag set for the named command that exits on error
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+// stringsFlag is a flag that may be repeated, e.g. -tag owner=me -tag env=test
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
@@ -0,0 +1,307 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - --debug (anywhere on the command line) writes every ARM request and response as one JSON
+//   object per line to stderr; autorest.WithLogging would print the bearer token and the
+//   administratorLoginPassword of ServerForCreate/ServerUpdateParameters
+// - the logger is the innermost sender so it sees each retry and the Authorization header
+//   set by autorest.Client.Do, which is why headers are redacted too
+// - redacted JSON paths are dot separated, "*" matching any key or array element, keys are
+//   compared case-insensitively; DEBUG_REDACT_PATHS and DEBUG_REDACT_HEADERS (comma separated)
+//   add to the defaults below
+// - bodies are logged up to DEBUG_MAX_BODY bytes (default 4096) after redaction; bodies that
+//   are neither JSON nor text are only logged with their size, so form posts with secrets
+//   do not show up
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const (
+	redacted                 = "REDACTED"
+	defaultDebugMaxBody      = 4096
+	debugMaxParsedBody       = 1 << 20
+	headerCorrelationRequest = "x-ms-correlation-request-id"
+)
+
+var (
+	defaultRedactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Ms-Authorization-Auxiliary"}
+	defaultRedactedPaths   = []string{
+		"properties.administratorLoginPassword",
+		"properties.url",
+		"value.*.properties.url",
+		"access_token",
+		"refresh_token",
+		"id_token",
+		"device_code",
+	}
+	// query parameters holding SAS signatures or keys
+	redactedQueryParameters = []string{"sig", "code", "client_secret"}
+)
+
+// debugLogger is the request logger of --debug, nil when debugging is off
+var debugLogger *requestLogger
+
+// requestLogger writes redacted requests and responses as JSON lines
+type requestLogger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	headers map[string]bool
+	paths   [][]string
+	maxBody int
+}
+
+// stripDebugFlag removes --debug or -debug from the arguments and reports whether it was there
+func stripDebugFlag(args []string) ([]string, bool) {
+	kept := make([]string, 0, len(args))
+	found := false
+	for _, arg := range args {
+		if arg == "--debug" || arg == "-debug" {
+			found = true
+			continue
+		}
+		kept = append(kept, arg)
+	}
+	return kept, found
+}
+
+// newRequestLogger creates a logger with the default and environment redactions
+func newRequestLogger(w io.Writer) (*requestLogger, error) {
+	l := &requestLogger{w: w, headers: map[string]bool{}, maxBody: defaultDebugMaxBody}
+	headers := append([]string{}, defaultRedactedHeaders...)
+	paths := append([]string{}, defaultRedactedPaths...)
+	if extra := os.Getenv("DEBUG_REDACT_HEADERS"); extra != "" {
+		headers = append(headers, strings.Split(extra, ",")...)
+	}
+	if extra := os.Getenv("DEBUG_REDACT_PATHS"); extra != "" {
+		paths = append(paths, strings.Split(extra, ",")...)
+	}
+	for _, h := range headers {
+		l.headers[http.CanonicalHeaderKey(strings.TrimSpace(h))] = true
+	}
+	for _, p := range paths {
+		if p = strings.TrimSpace(p); p != "" {
+			l.paths = append(l.paths, strings.Split(p, "."))
+		}
+	}
+	if max := os.Getenv("DEBUG_MAX_BODY"); max != "" {
+		n, err := strconv.Atoi(max)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid DEBUG_MAX_BODY %q", max)
+		}
+		l.maxBody = n
+	}
+	return l, nil
+}
+
+// sendDecorator returns the SendDecorator logging each request and its response
+func (l *requestLogger) sendDecorator() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			entry := map[string]interface{}{
+				"event":   "request",
+				"method":  r.Method,
+				"url":     redactURL(r.URL.String()),
+				"headers": l.redactHeaders(r.Header),
+			}
+			if id := r.Header.Get(azure.HeaderClientID); id != "" {
+				entry["clientRequestId"] = id
+			}
+			if r.Body != nil {
+				var body []byte
+				body, r.Body = peekBody(r.Body)
+				l.addBody(entry, body, r.Header.Get("Content-Type"))
+			}
+			l.write(entry)
+
+			start := time.Now()
+			resp, err := s.Do(r)
+			entry = map[string]interface{}{
+				"event":      "response",
+				"method":     r.Method,
+				"url":        redactURL(r.URL.String()),
+				"durationMs": time.Since(start).Nanoseconds() / int64(time.Millisecond),
+			}
+			if err != nil {
+				entry["error"] = err.Error()
+			}
+			if resp != nil {
+				entry["status"] = resp.StatusCode
+				entry["headers"] = l.redactHeaders(resp.Header)
+				entry["requestId"] = azure.ExtractRequestID(resp)
+				entry["correlationId"] = resp.Header.Get(headerCorrelationRequest)
+				if id := azure.ExtractClientID(resp); id != "" {
+					entry["clientRequestId"] = id
+				}
+				if resp.Body != nil {
+					var body []byte
+					body, resp.Body = peekBody(resp.Body)
+					l.addBody(entry, body, resp.Header.Get("Content-Type"))
+				}
+			}
+			l.write(entry)
+			return resp, err
+		})
+	}
+}
+
+func (l *requestLogger) write(entry map[string]interface{}) {
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(entry); err != nil {
+		line.Reset()
+		fmt.Fprintf(&line, "{\"event\":\"error\",\"error\":%q}\n", err.Error())
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line.Bytes())
+}
+
+// peekBody reads up to debugMaxParsedBody bytes of a body and returns them together with a
+// body still delivering everything
+func peekBody(body io.ReadCloser) ([]byte, io.ReadCloser) {
+	peeked, err := ioutil.ReadAll(io.LimitReader(body, debugMaxParsedBody+1))
+	rest := io.MultiReader(bytes.NewReader(peeked), body)
+	if err != nil {
+		rest = io.MultiReader(bytes.NewReader(peeked), errorReader{err})
+	}
+	return peeked, readCloser{Reader: rest, Closer: body}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type errorReader struct{ err error }
+
+func (e errorReader) Read([]byte) (int, error) { return 0, e.err }
+
+// addBody adds the redacted and capped body to a log entry
+func (l *requestLogger) addBody(entry map[string]interface{}, body []byte, contentType string) {
+	entry["bodyBytes"] = len(body)
+	if len(body) == 0 {
+		return
+	}
+	if len(body) > debugMaxParsedBody {
+		entry["bodyBytes"] = fmt.Sprintf(">%d", debugMaxParsedBody)
+		entry["bodyTruncated"] = true
+		return
+	}
+	var text string
+	var doc interface{}
+	switch {
+	case json.Unmarshal(body, &doc) == nil:
+		l.redactJSON(doc)
+		redactedBody, _ := json.Marshal(doc)
+		text = string(redactedBody)
+	case strings.HasPrefix(contentType, "text/"):
+		text = string(body)
+	default:
+		return
+	}
+	if len(text) > l.maxBody {
+		text = text[:l.maxBody]
+		entry["bodyTruncated"] = true
+	}
+	entry["body"] = text
+}
+
+func (l *requestLogger) redactHeaders(header http.Header) map[string]string {
+	result := map[string]string{}
+	for key, values := range header {
+		if l.headers[http.CanonicalHeaderKey(key)] {
+			result[key] = redacted
+			continue
+		}
+		result[key] = strings.Join(values, ", ")
+	}
+	return result
+}
+
+// redactJSON replaces the values at the configured paths of a decoded JSON document
+func (l *requestLogger) redactJSON(doc interface{}) {
+	for _, path := range l.paths {
+		redactPath(doc, path)
+	}
+}
+
+func redactPath(node interface{}, path []string) {
+	if len(path) == 0 {
+		return
+	}
+	last := len(path) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, value := range n {
+			if path[0] != "*" && !strings.EqualFold(key, path[0]) {
+				continue
+			}
+			if last {
+				n[key] = redacted
+			} else {
+				redactPath(value, path[1:])
+			}
+		}
+	case []interface{}:
+		if path[0] != "*" {
+			return
+		}
+		for i, value := range n {
+			if last {
+				n[i] = redacted
+			} else {
+				redactPath(value, path[1:])
+			}
+		}
+	}
+}
+
+// redactURL hides query parameters carrying signatures or secrets
+func redactURL(raw string) string {
+	i := strings.Index(raw, "?")
+	if i < 0 {
+		return raw
+	}
+	params := strings.Split(raw[i+1:], "&")
+	for j, param := range params {
+		name := strings.SplitN(param, "=", 2)[0]
+		for _, secret := range redactedQueryParameters {
+			if strings.EqualFold(name, secret) {
+				params[j] = name + "=" + redacted
+			}
+		}
+	}
+	return raw[:i+1] + strings.Join(params, "&")
+}
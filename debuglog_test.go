@@ -0,0 +1,51 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// the Azure AD answers of login go through the same logger
+func TestRedactLoginResponses(t *testing.T) {
+	l, err := newRequestLogger(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := []string{
+		`{"user_code":"FQK5HW3UF","device_code":"DAQABAAEAAAB2UyzwtQEKR7","verification_url":"https://aka.ms/devicelogin","expires_in":"900","interval":"5"}`,
+		`{"token_type":"Bearer","expires_in":"3599","access_token":"eyJ0eXAi.access","refresh_token":"AQABAAAA.refresh","id_token":"eyJ0eXAi.id"}`,
+	}
+	for _, body := range bodies {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(body), &doc); err != nil {
+			t.Fatal(err)
+		}
+		l.redactJSON(doc)
+		redactedBody, _ := json.Marshal(doc)
+		for _, secret := range []string{"DAQABAAEAAAB2UyzwtQEKR7", "eyJ0eXAi", "AQABAAAA"} {
+			if strings.Contains(string(redactedBody), secret) {
+				t.Errorf("%s is logged in %s", secret, redactedBody)
+			}
+		}
+		// the user code is shown to the user anyway
+		if strings.Contains(body, "user_code") && !strings.Contains(string(redactedBody), "FQK5HW3UF") {
+			t.Errorf("user_code redacted in %s", redactedBody)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - the desired diagnostic settings send the PostgreSQLLogs category and all metrics to a
+//   storage account and/or a Log Analytics workspace, given as resource ids
+// - the targets are checked to exist before anything is changed
+// - drift is every difference between the desired and the actual settings of a server,
+//   "diagnostics apply" only updates servers with drift
+// - the vendored ServiceDiagnosticSettingsClient path-escapes the resource uri, the
+//   slashes are restored on the prepared request (see diagnosticSettingsRequest)
+//
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Azure/azure-sdk-for-go/arm/monitor"
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	// log category of PostgreSQL servers
+	postgresqlLogCategory = "PostgreSQLLogs"
+	// time grain of the metrics sent
+	diagnosticsTimeGrain = "PT1M"
+)
+
+func init() {
+	registerCommand(command{
+		name:         "diagnostics apply",
+		summary:      "route server logs and metrics to a storage account and/or Log Analytics workspace",
+		needsClients: true,
+		run:          runDiagnosticsApply,
+	})
+	registerCommand(command{
+		name:         "diagnostics audit",
+		summary:      "list servers without diagnostic settings or with settings drifted from the desired ones",
+		needsClients: true,
+		run:          runDiagnosticsAudit,
+	})
+}
+
+// diagnosticsSpec is the desired diagnostic settings of a server
+type diagnosticsSpec struct {
+	storageAccountID string
+	workspaceID      string
+	retentionDays    int32
+}
+
+func (d *diagnosticsSpec) empty() bool {
+	return d.storageAccountID == "" && d.workspaceID == ""
+}
+
+// settings returns the settings resource to send
+func (d *diagnosticsSpec) settings() monitor.ServiceDiagnosticSettingsResource {
+	retention := &monitor.RetentionPolicy{Enabled: to.BoolPtr(d.retentionDays > 0), Days: to.Int32Ptr(d.retentionDays)}
+	settings := &monitor.ServiceDiagnosticSettings{
+		Logs: &[]monitor.LogSettings{
+			{Category: to.StringPtr(postgresqlLogCategory), Enabled: to.BoolPtr(true), RetentionPolicy: retention},
+		},
+		Metrics: &[]monitor.MetricSettings{
+			{TimeGrain: to.StringPtr(diagnosticsTimeGrain), Enabled: to.BoolPtr(true), RetentionPolicy: retention},
+		},
+	}
+	if d.storageAccountID != "" {
+		settings.StorageAccountID = to.StringPtr(d.storageAccountID)
+	}
+	if d.workspaceID != "" {
+		settings.WorkspaceID = to.StringPtr(d.workspaceID)
+	}
+	return monitor.ServiceDiagnosticSettingsResource{ServiceDiagnosticSettings: settings}
+}
+
+// drift lists the differences between the desired and the actual settings, nil settings
+// meaning the server has none
+func (d *diagnosticsSpec) drift(actual *monitor.ServiceDiagnosticSettings) []string {
+	if actual == nil {
+		return []string{"no diagnostic settings"}
+	}
+	var found []string
+	if !strings.EqualFold(to.String(actual.StorageAccountID), d.storageAccountID) {
+		found = append(found, fmt.Sprintf("storage account is %q, want %q", to.String(actual.StorageAccountID), d.storageAccountID))
+	}
+	if !strings.EqualFold(to.String(actual.WorkspaceID), d.workspaceID) {
+		found = append(found, fmt.Sprintf("workspace is %q, want %q", to.String(actual.WorkspaceID), d.workspaceID))
+	}
+	var log *monitor.LogSettings
+	if actual.Logs != nil {
+		for i := range *actual.Logs {
+			if strings.EqualFold(to.String((*actual.Logs)[i].Category), postgresqlLogCategory) {
+				log = &(*actual.Logs)[i]
+			}
+		}
+	}
+	if log == nil || !to.Bool(log.Enabled) {
+		found = append(found, fmt.Sprintf("log category %s is not enabled", postgresqlLogCategory))
+	} else if days := retentionDays(log.RetentionPolicy); days != d.retentionDays {
+		found = append(found, fmt.Sprintf("log retention is %d days, want %d", days, d.retentionDays))
+	}
+	metricsEnabled := false
+	if actual.Metrics != nil {
+		for _, m := range *actual.Metrics {
+			if to.Bool(m.Enabled) {
+				metricsEnabled = true
+			}
+		}
+	}
+	if !metricsEnabled {
+		found = append(found, "metrics are not enabled")
+	}
+	return found
+}
+
+// retentionDays returns the days of an enabled retention policy, 0 for keeping forever
+func retentionDays(policy *monitor.RetentionPolicy) int32 {
+	if policy == nil || !to.Bool(policy.Enabled) {
+		return 0
+	}
+	return to.Int32(policy.Days)
+}
+
+// lacksDiagnostics reports whether settings send nothing anywhere
+func lacksDiagnostics(actual *monitor.ServiceDiagnosticSettings) bool {
+	if actual == nil {
+		return true
+	}
+	if to.String(actual.StorageAccountID) == "" && to.String(actual.WorkspaceID) == "" &&
+		to.String(actual.EventHubAuthorizationRuleID) == "" && to.String(actual.ServiceBusRuleID) == "" {
+		return true
+	}
+	if actual.Logs != nil {
+		for _, l := range *actual.Logs {
+			if to.Bool(l.Enabled) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// diagnosticsResult is one line of the apply and audit reports
+type diagnosticsResult struct {
+	ResourceGroup string   `json:"resourceGroup"`
+	Server        string   `json:"server"`
+	Result        string   `json:"result"`
+	Drift         []string `json:"drift,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+func parseDiagnosticsFlags(name string, args []string) (*serverFilter, *diagnosticsSpec, bool, bool, string) {
+	flags := newFlagSet(name)
+	filter := addServerFilterFlags(flags)
+	spec := &diagnosticsSpec{}
+	all := flags.Bool("all", false, "every server in the subscription when no filter is given")
+	flags.StringVar(&spec.storageAccountID, "storage-account", "", "resource id of the storage account logs and metrics are archived to")
+	flags.StringVar(&spec.workspaceID, "workspace", "", "resource id of the Log Analytics workspace logs and metrics are sent to")
+	retention := flags.Int("retention-days", 0, "days logs and metrics are kept in the storage account (default forever)")
+	dryRun := flags.Bool("dry-run", false, "only report the drift")
+	format := flags.String("format", "table", "report format: table or json")
+	flags.Parse(args)
+	spec.retentionDays = int32(*retention)
+	return filter, spec, *all, *dryRun, *format
+}
+
+func runDiagnosticsApply(args []string) {
+	filter, spec, all, dryRun, format := parseDiagnosticsFlags("diagnostics apply", args)
+	if spec.empty() {
+		fmt.Println("Missing -storage-account and/or -workspace")
+		os.Exit(2)
+	}
+	if !all && filter.empty() {
+		fmt.Println("Select servers with -server, -tag, -name or -resource-group, or pass -all")
+		os.Exit(2)
+	}
+	onErrorFail(spec.checkTargets(), "Invalid diagnostics target")
+	servers, err := listServers(serversClient, filter)
+	onErrorFail(err, "Listing servers failed")
+	if !dryRun {
+		requirePermissions("diagnostics apply", serverResourceGroups(servers))
+	}
+
+	var results []diagnosticsResult
+	for _, server := range servers {
+		results = append(results, applyDiagnostics(server, spec, dryRun))
+	}
+	writeDiagnosticsReport(os.Stdout, format, results)
+	for _, r := range results {
+		if r.Result == "failed" {
+			os.Exit(1)
+		}
+	}
+}
+
+func runDiagnosticsAudit(args []string) {
+	filter, spec, _, _, format := parseDiagnosticsFlags("diagnostics audit", args)
+	servers, err := listServers(serversClient, filter)
+	onErrorFail(err, "Listing servers failed")
+
+	results := []diagnosticsResult{}
+	for _, server := range servers {
+		result := diagnosticsResult{ResourceGroup: resourceGroupFromID(to.String(server.ID)), Server: to.String(server.Name)}
+		actual, err := getDiagnosticSettings(to.String(server.ID))
+		switch {
+		case err != nil:
+			result.Result = "failed"
+			result.Error = err.Error()
+		case lacksDiagnostics(actual):
+			result.Result = "missing"
+		case !spec.empty():
+			if result.Drift = spec.drift(actual); len(result.Drift) > 0 {
+				result.Result = "drifted"
+			}
+		}
+		if result.Result != "" {
+			results = append(results, result)
+		}
+	}
+	writeDiagnosticsReport(os.Stdout, format, results)
+	if format != "json" {
+		fmt.Printf("%d of %d servers lack diagnostics or drifted\n", len(results), len(servers))
+	}
+	if len(results) > 0 {
+		os.Exit(1)
+	}
+}
+
+// applyDiagnostics brings the settings of one server to spec if they drifted
+func applyDiagnostics(server postgresql.Server, spec *diagnosticsSpec, dryRun bool) diagnosticsResult {
+	id := to.String(server.ID)
+	result := diagnosticsResult{ResourceGroup: resourceGroupFromID(id), Server: to.String(server.Name), Result: "failed"}
+	actual, err := getDiagnosticSettings(id)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Drift = spec.drift(actual)
+	if len(result.Drift) == 0 {
+		result.Result = "in sync"
+		return result
+	}
+	if dryRun {
+		result.Result = "would update"
+		return result
+	}
+	if err := putDiagnosticSettings(id, spec.settings()); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Result = "updated"
+	return result
+}
+
+// checkTargets fails if a storage account or workspace of the spec does not exist
+func (d *diagnosticsSpec) checkTargets() error {
+	for _, id := range []string{d.storageAccountID, d.workspaceID} {
+		if id == "" {
+			continue
+		}
+		exists, err := resourceExists(id)
+		if err != nil {
+			return withRemediation(err, "checking "+id)
+		}
+		if !exists {
+			return fmt.Errorf("Resource %s does not exist", id)
+		}
+	}
+	return nil
+}
+
+// resourceExists looks a resource id up in the resources of its type in its subscription.
+// The vendored GroupClient.CheckExistenceByID always uses api-version 2016-09-01 which not
+// every provider accepts, listing works for every type.
+func resourceExists(id string) (bool, error) {
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+	subscriptionID := resourceIDSegment(id, "subscriptions")
+	// subscriptions/{s}/resourceGroups/{g}/providers/{namespace}/{type}/{name}
+	if len(parts) < 8 || subscriptionID == "" || !strings.EqualFold(parts[4], "providers") {
+		return false, fmt.Errorf("Invalid resource id %s", id)
+	}
+	client := resources.NewGroupClient(subscriptionID)
+	client.Authorizer = armAuthorizer
+	useARMSender(&client.Client, subscriptionID)
+	result, err := client.List(fmt.Sprintf("resourceType eq '%s/%s'", parts[5], parts[6]), "", nil)
+	for {
+		if err != nil {
+			return false, err
+		}
+		if result.Value != nil {
+			for _, r := range *result.Value {
+				if strings.EqualFold(to.String(r.ID), id) {
+					return true, nil
+				}
+			}
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			return false, nil
+		}
+		result, err = client.ListNextResults(result)
+	}
+}
+
+// diagnosticSettingsRequest restores the slashes of the resource uri the vendored client escaped
+func diagnosticSettingsRequest(req *http.Request, err error) (*http.Request, error) {
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Path = "/" + strings.TrimLeft(req.URL.Path, "/")
+	req.URL.RawPath = ""
+	return req, nil
+}
+
+// getDiagnosticSettings returns the settings of a resource, nil if it has none
+func getDiagnosticSettings(resourceID string) (*monitor.ServiceDiagnosticSettings, error) {
+	client := monitor.ServiceDiagnosticSettingsClient{ManagementClient: monitorClient}
+	req, err := diagnosticSettingsRequest(client.GetPreparer(resourceID))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.GetSender(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		autorest.Respond(resp, autorest.ByClosing())
+		return nil, nil
+	}
+	result, err := client.GetResponder(resp)
+	if err != nil {
+		return nil, err
+	}
+	return result.ServiceDiagnosticSettings, nil
+}
+
+// putDiagnosticSettings replaces the settings of a resource
+func putDiagnosticSettings(resourceID string, settings monitor.ServiceDiagnosticSettingsResource) error {
+	client := monitor.ServiceDiagnosticSettingsClient{ManagementClient: monitorClient}
+	req, err := diagnosticSettingsRequest(client.CreateOrUpdatePreparer(resourceID, settings))
+	if err != nil {
+		return err
+	}
+	resp, err := client.CreateOrUpdateSender(req)
+	if err == nil {
+		_, err = client.CreateOrUpdateResponder(resp)
+	}
+	return err
+}
+
+func writeDiagnosticsReport(w io.Writer, format string, results []diagnosticsResult) {
+	if format == "json" {
+		fmt.Fprintln(w, toJSON(results))
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESOURCE GROUP\tSERVER\tRESULT\tDETAILS")
+	for _, r := range results {
+		details := strings.Join(r.Drift, "; ")
+		if r.Error != "" {
+			details = r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.ResourceGroup, r.Server, r.Result, details)
+	}
+	tw.Flush()
+}
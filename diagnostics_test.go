@@ -0,0 +1,106 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/monitor"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	testStorageAccountID = "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/pglogs"
+	testWorkspaceID      = "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg/providers/Microsoft.OperationalInsights/workspaces/pg"
+)
+
+func TestDiagnosticsDrift(t *testing.T) {
+	spec := &diagnosticsSpec{storageAccountID: testStorageAccountID, workspaceID: testWorkspaceID, retentionDays: 30}
+	cases := []struct {
+		name   string
+		change func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings
+		want   []string
+	}{
+		{"in sync", func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings { return s }, nil},
+		{"ids differ in case only", func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings {
+			s.StorageAccountID = to.StringPtr(strings.ToUpper(testStorageAccountID))
+			return s
+		}, nil},
+		{"missing settings", func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings { return nil }, []string{"no diagnostic settings"}},
+		{"wrong storage account", func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings {
+			s.StorageAccountID = to.StringPtr(strings.Replace(testStorageAccountID, "pglogs", "other", 1))
+			return s
+		}, []string{"storage account is"}},
+		{"wrong workspace", func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings {
+			s.WorkspaceID = nil
+			return s
+		}, []string{`workspace is ""`}},
+		{"log category disabled", func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings {
+			(*s.Logs)[0].Enabled = to.BoolPtr(false)
+			return s
+		}, []string{"log category PostgreSQLLogs is not enabled"}},
+		{"log category missing", func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings {
+			s.Logs = nil
+			return s
+		}, []string{"log category PostgreSQLLogs is not enabled"}},
+		{"retention mismatch", func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings {
+			(*s.Logs)[0].RetentionPolicy = &monitor.RetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(7)}
+			return s
+		}, []string{"log retention is 7 days, want 30"}},
+		{"retention disabled", func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings {
+			(*s.Logs)[0].RetentionPolicy.Enabled = to.BoolPtr(false)
+			return s
+		}, []string{"log retention is 0 days, want 30"}},
+		{"metrics disabled", func(s *monitor.ServiceDiagnosticSettings) *monitor.ServiceDiagnosticSettings {
+			(*s.Metrics)[0].Enabled = to.BoolPtr(false)
+			return s
+		}, []string{"metrics are not enabled"}},
+	}
+	for _, c := range cases {
+		found := spec.drift(c.change(spec.settings().ServiceDiagnosticSettings))
+		if len(found) != len(c.want) {
+			t.Errorf("%s: drift %q, want %q", c.name, found, c.want)
+			continue
+		}
+		for i := range c.want {
+			if !strings.HasPrefix(found[i], c.want[i]) {
+				t.Errorf("%s: drift %q, want %q", c.name, found[i], c.want[i])
+			}
+		}
+	}
+}
+
+func TestLacksDiagnostics(t *testing.T) {
+	enabledLogs := &[]monitor.LogSettings{{Category: to.StringPtr(postgresqlLogCategory), Enabled: to.BoolPtr(true)}}
+	disabledLogs := &[]monitor.LogSettings{{Category: to.StringPtr(postgresqlLogCategory), Enabled: to.BoolPtr(false)}}
+	cases := []struct {
+		name     string
+		settings *monitor.ServiceDiagnosticSettings
+		lacks    bool
+	}{
+		{"missing settings", nil, true},
+		{"no destination", &monitor.ServiceDiagnosticSettings{Logs: enabledLogs}, true},
+		{"storage account", &monitor.ServiceDiagnosticSettings{StorageAccountID: to.StringPtr(testStorageAccountID), Logs: enabledLogs}, false},
+		{"event hub", &monitor.ServiceDiagnosticSettings{EventHubAuthorizationRuleID: to.StringPtr("rule"), Logs: enabledLogs}, false},
+		{"logs disabled", &monitor.ServiceDiagnosticSettings{WorkspaceID: to.StringPtr(testWorkspaceID), Logs: disabledLogs}, true},
+		{"no logs", &monitor.ServiceDiagnosticSettings{WorkspaceID: to.StringPtr(testWorkspaceID)}, true},
+	}
+	for _, c := range cases {
+		if lacks := lacksDiagnostics(c.settings); lacks != c.lacks {
+			t.Errorf("%s: lacksDiagnostics = %v", c.name, lacks)
+		}
+	}
+}
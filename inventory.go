@@ -0,0 +1,386 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/subscriptions"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// number of servers whose firewall rules and databases are counted concurrently
+const inventoryConcurrency = 8
+
+func init() {
+	registerCommand(command{
+		name:         "server list",
+		summary:      "list servers with filtering, firewall rule/database counts; table, json, csv or template output",
+		needsClients: true,
+		run:          runServerList,
+	})
+}
+
+// serverFilter selects servers by resource group, tag, version, tier, state and name pattern
+type serverFilter struct {
+	resourceGroup string
+	tags          stringsFlag
+	version       string
+	tier          string
+	state         string
+	name          string
+	names         stringsFlag
+}
+
+// addServerFilterFlags registers the server selection flags shared by the fleet commands
+func addServerFilterFlags(flags *flag.FlagSet) *serverFilter {
+	f := &serverFilter{}
+	flags.StringVar(&f.resourceGroup, "resource-group", "", "only servers in this resource group (default all)")
+	flags.Var(&f.tags, "tag", "only servers with this tag, key or key=value (repeatable)")
+	flags.StringVar(&f.version, "version", "", "only servers with this version, e.g. 9.6")
+	flags.StringVar(&f.tier, "tier", "", "only servers with this SKU tier, e.g. Basic")
+	flags.StringVar(&f.state, "state", "", "only servers in this state, e.g. Ready")
+	flags.StringVar(&f.name, "name", "", "only servers whose name matches this pattern, e.g. async-test-*")
+	flags.Var(&f.names, "server", "only this server (repeatable)")
+	return f
+}
+
+// empty reports whether no filter was set, i.e. every server would be selected
+func (f *serverFilter) empty() bool {
+	return f.resourceGroup == "" && len(f.tags) == 0 && f.version == "" && f.tier == "" &&
+		f.state == "" && f.name == "" && len(f.names) == 0
+}
+
+// matches reports whether the server passes every filter that was set
+func (f *serverFilter) matches(server postgresql.Server) bool {
+	name := to.String(server.Name)
+	if len(f.names) > 0 {
+		found := false
+		for _, n := range f.names {
+			if strings.EqualFold(n, name) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.name != "" {
+		if ok, _ := path.Match(f.name, name); !ok {
+			return false
+		}
+	}
+	if f.resourceGroup != "" && !strings.EqualFold(f.resourceGroup, resourceGroupFromID(to.String(server.ID))) {
+		return false
+	}
+	tags := serverTags(server)
+	for _, tag := range f.tags {
+		key, value, hasValue := strings.Cut(tag, "=")
+		v, ok := tags[key]
+		if !ok || (hasValue && v != value) {
+			return false
+		}
+	}
+	if f.version != "" && (server.ServerProperties == nil || string(server.Version) != f.version) {
+		return false
+	}
+	if f.tier != "" && (server.Sku == nil || !strings.EqualFold(string(server.Sku.Tier), f.tier)) {
+		return false
+	}
+	if f.state != "" && (server.ServerProperties == nil || !strings.EqualFold(string(server.UserVisibleState), f.state)) {
+		return false
+	}
+	return true
+}
+
+// listServers returns the servers of the client's subscription that pass the filter
+func listServers(client postgresql.ServersClient, f *serverFilter) ([]postgresql.Server, error) {
+	var result postgresql.ServerListResult
+	var err error
+	if f.resourceGroup != "" {
+		result, err = client.ListByResourceGroup(f.resourceGroup)
+	} else {
+		result, err = client.List()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var servers []postgresql.Server
+	if result.Value != nil {
+		for _, server := range *result.Value {
+			if f.matches(server) {
+				servers = append(servers, server)
+			}
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return to.String(servers[i].ID) < to.String(servers[j].ID)
+	})
+	return servers, nil
+}
+
+// resourceGroupFromID returns the resource group from an ARM resource id like
+// /subscriptions/{id}/resourceGroups/{group}/providers/Microsoft.DBforPostgreSQL/servers/{name}
+func resourceGroupFromID(id string) string {
+	return resourceIDSegment(id, "resourceGroups")
+}
+
+// resourceIDSegment returns the value following the named segment of an ARM resource id
+func resourceIDSegment(id string, segment string) string {
+	parts := strings.Split(id, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if strings.EqualFold(parts[i], segment) {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// serverTags returns the server's tags as a plain map
+func serverTags(server postgresql.Server) map[string]string {
+	tags := map[string]string{}
+	if server.Tags != nil {
+		for k, v := range *server.Tags {
+			tags[k] = to.String(v)
+		}
+	}
+	return tags
+}
+
+// serverInventory is one row of the fleet inventory
+type serverInventory struct {
+	Subscription  string            `json:"subscription"`
+	ResourceGroup string            `json:"resourceGroup"`
+	Name          string            `json:"name"`
+	Location      string            `json:"location"`
+	Version       string            `json:"version"`
+	Tier          string            `json:"tier"`
+	SkuName       string            `json:"skuName"`
+	ComputeUnits  int32             `json:"computeUnits"`
+	StorageMB     int64             `json:"storageMB"`
+	State         string            `json:"state"`
+	FQDN          string            `json:"fullyQualifiedDomainName"`
+	Tags          map[string]string `json:"tags"`
+	FirewallRules int               `json:"firewallRules"`
+	Databases     int               `json:"databases"`
+	Error         string            `json:"error,omitempty"`
+}
+
+func newServerInventory(subscriptionID string, server postgresql.Server) serverInventory {
+	row := serverInventory{
+		Subscription:  subscriptionID,
+		ResourceGroup: resourceGroupFromID(to.String(server.ID)),
+		Name:          to.String(server.Name),
+		Location:      to.String(server.Location),
+		Tags:          serverTags(server),
+		FirewallRules: -1,
+		Databases:     -1,
+	}
+	if server.Sku != nil {
+		row.Tier = string(server.Sku.Tier)
+		row.SkuName = to.String(server.Sku.Name)
+		row.ComputeUnits = to.Int32(server.Sku.Capacity)
+	}
+	if p := server.ServerProperties; p != nil {
+		row.Version = string(p.Version)
+		row.StorageMB = to.Int64(p.StorageMB)
+		row.State = string(p.UserVisibleState)
+		row.FQDN = to.String(p.FullyQualifiedDomainName)
+	}
+	return row
+}
+
+// countServerResources fills in the firewall rule and database counts of the rows
+func countServerResources(client postgresql.ServersClient, rows []serverInventory) {
+	firewallRules := postgresql.FirewallRulesClient(client)
+	databases := postgresql.DatabasesClient(client)
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < inventoryConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				row := &rows[i]
+				rules, err := firewallRules.ListByServer(row.ResourceGroup, row.Name)
+				if err != nil {
+					row.Error = err.Error()
+					continue
+				}
+				row.FirewallRules = 0
+				if rules.Value != nil {
+					row.FirewallRules = len(*rules.Value)
+				}
+				dbs, err := databases.ListByServer(row.ResourceGroup, row.Name)
+				if err != nil {
+					row.Error = err.Error()
+					continue
+				}
+				row.Databases = 0
+				if dbs.Value != nil {
+					row.Databases = len(*dbs.Value)
+				}
+			}
+		}()
+	}
+	for i := range rows {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
+
+// listSubscriptionIDs enumerates the subscriptions the credentials can see
+func listSubscriptionIDs() ([]string, error) {
+	client := subscriptions.NewGroupClient()
+	client.Authorizer = armAuthorizer
+	useARMSender(&client.Client, armSubscriptionID)
+	result, err := client.List()
+	var ids []string
+	for err == nil {
+		if result.Value != nil {
+			for _, s := range *result.Value {
+				if s.State == subscriptions.Enabled {
+					ids = append(ids, to.String(s.SubscriptionID))
+				}
+			}
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			break
+		}
+		result, err = client.ListNextResults(result)
+	}
+	return ids, err
+}
+
+// fleetInventory lists and describes the servers in the subscriptions
+func fleetInventory(subscriptionIDs []string, f *serverFilter, counts bool) ([]serverInventory, error) {
+	var rows []serverInventory
+	for _, subscriptionID := range subscriptionIDs {
+		client := newServersClient(subscriptionID)
+		servers, err := listServers(client, f)
+		if err != nil {
+			return nil, fmt.Errorf("subscription %s: %v", subscriptionID, err)
+		}
+		subscriptionRows := make([]serverInventory, len(servers))
+		for i, server := range servers {
+			subscriptionRows[i] = newServerInventory(subscriptionID, server)
+		}
+		if counts {
+			countServerResources(client, subscriptionRows)
+		}
+		rows = append(rows, subscriptionRows...)
+	}
+	return rows, nil
+}
+
+func runServerList(args []string) {
+	flags := newFlagSet("server list")
+	filter := addServerFilterFlags(flags)
+	allSubscriptions := flags.Bool("all-subscriptions", false, "list servers in every enabled subscription")
+	counts := flags.Bool("counts", true, "count firewall rules and databases of each server")
+	format := flags.String("format", "table", "output format: table, json, csv or template")
+	tmpl := flags.String("template", "", "Go template applied to each server when -format=template, e.g. '{{.Name}} {{.Tags.owner}}'")
+	flags.Parse(args)
+
+	subscriptionIDs := []string{armSubscriptionID}
+	if *allSubscriptions {
+		var err error
+		subscriptionIDs, err = listSubscriptionIDs()
+		onErrorFail(err, "Listing subscriptions failed")
+	}
+	rows, err := fleetInventory(subscriptionIDs, filter, *counts)
+	onErrorFail(err, "Listing servers failed")
+	onErrorFail(writeInventory(os.Stdout, rows, *format, *tmpl), "Writing inventory failed")
+}
+
+// writeInventory renders the rows as table, json, csv or with a template
+func writeInventory(w io.Writer, rows []serverInventory, format string, tmpl string) error {
+	switch format {
+	case "json":
+		_, err := fmt.Fprintln(w, toJSON(rows))
+		return err
+	case "csv":
+		return writeInventoryCSV(w, rows)
+	case "template":
+		t, err := template.New("server").Parse(tmpl)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := t.Execute(w, row); err != nil {
+				return err
+			}
+			fmt.Fprintln(w)
+		}
+		return nil
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "RESOURCE GROUP\tNAME\tLOCATION\tVERSION\tTIER\tCU\tSTORAGE MB\tSTATE\tRULES\tDBS\tTAGS")
+		for _, r := range rows {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", r.ResourceGroup, r.Name, r.Location, r.Version, r.Tier,
+				r.ComputeUnits, r.StorageMB, r.State, inventoryCount(r.FirewallRules), inventoryCount(r.Databases), formatTags(r.Tags))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("Unknown format %q, expected table, json, csv or template", format)
+}
+
+func writeInventoryCSV(w io.Writer, rows []serverInventory) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"subscription", "resourceGroup", "name", "location", "version", "tier", "skuName", "computeUnits",
+		"storageMB", "state", "fullyQualifiedDomainName", "firewallRules", "databases", "tags", "error"})
+	for _, r := range rows {
+		cw.Write([]string{r.Subscription, r.ResourceGroup, r.Name, r.Location, r.Version, r.Tier, r.SkuName,
+			strconv.Itoa(int(r.ComputeUnits)), strconv.FormatInt(r.StorageMB, 10), r.State, r.FQDN,
+			inventoryCount(r.FirewallRules), inventoryCount(r.Databases), formatTags(r.Tags), r.Error})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// inventoryCount prints counts that were not collected as "-"
+func inventoryCount(n int) string {
+	if n < 0 {
+		return "-"
+	}
+	return strconv.Itoa(n)
+}
+
+// formatTags prints tags sorted by key as k=v,k=v
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + tags[k]
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,216 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - a server is expired when its expires-at tag (RFC 3339, set by createServer) is in
+//   the past, or, without the tag, when its name matches -name and the timestamp in the
+//   name (async-test-20060102150405) is older than -max-age
+// - protected and locked servers (see protect.go) are never deleted
+// - nothing is deleted if more than -max-deletions servers are expired
+//
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	// tag set by createServer, the time after which the janitor may delete the server
+	expiresAtTag = "expires-at"
+	// lifetime of servers created by the sample
+	testServerLifetime = 24 * time.Hour
+	// word typed, or passed with -confirm, to let the janitor delete
+	janitorConfirmation = "expired"
+)
+
+func init() {
+	registerCommand(command{
+		name:         "janitor",
+		summary:      "delete expired test servers (expires-at tag or timestamped name), with dry-run and a safety cap",
+		needsClients: true,
+		run:          runJanitor,
+	})
+}
+
+// expiredServer is a server the janitor selected and why
+type expiredServer struct {
+	ResourceGroup string `json:"resourceGroup"`
+	Server        string `json:"server"`
+	Reason        string `json:"reason"`
+	Result        string `json:"result,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+func runJanitor(args []string) {
+	flags := newFlagSet("janitor")
+	group := flags.String("resource-group", "", "only servers in this resource group (default all)")
+	pattern := flags.String("name", "async-test-*", "servers without an "+expiresAtTag+" tag are only considered if their name matches this pattern")
+	maxAge := flags.Duration("max-age", testServerLifetime, "age after which a matching server without an "+expiresAtTag+" tag is expired")
+	maxDeletions := flags.Int("max-deletions", 10, "delete nothing if more servers than this are expired")
+	parallel := flags.Int("parallel", 4, "number of servers deleted concurrently")
+	dryRun := flags.Bool("dry-run", false, "only list the expired servers")
+	confirm := flags.String("confirm", "", "pass '"+janitorConfirmation+"' to delete without a prompt")
+	flags.Parse(args)
+
+	servers, err := listServers(serversClient, &serverFilter{resourceGroup: *group})
+	onErrorFail(err, "Listing servers failed")
+	expired := findExpiredServers(servers, *pattern, *maxAge, time.Now().UTC())
+	if len(expired) == 0 {
+		fmt.Println("No expired servers")
+		return
+	}
+	if *dryRun {
+		for i := range expired {
+			expired[i].Result = "would delete"
+		}
+		writeJanitorReport(os.Stdout, expired)
+		return
+	}
+	if len(expired) > *maxDeletions {
+		writeJanitorReport(os.Stdout, expired)
+		fmt.Printf("%d servers are expired, more than -max-deletions %d, nothing was deleted\n", len(expired), *maxDeletions)
+		os.Exit(1)
+	}
+
+	writeJanitorReport(os.Stdout, expired)
+	var groups []string
+	for _, e := range expired {
+		groups = append(groups, e.ResourceGroup)
+	}
+	requirePermissions("janitor", groups)
+	onErrorFail(confirmDestructive(fmt.Sprintf("Delete these %d servers", len(expired)), janitorConfirmation, *confirm), "Not confirmed")
+	deleteExpiredServers(expired, *parallel)
+	writeJanitorReport(os.Stdout, expired)
+	for _, e := range expired {
+		if e.Result == "failed" {
+			os.Exit(1)
+		}
+	}
+}
+
+// findExpiredServers returns the servers that expired before now
+func findExpiredServers(servers []postgresql.Server, pattern string, maxAge time.Duration, now time.Time) []expiredServer {
+	var expired []expiredServer
+	for _, server := range servers {
+		name := to.String(server.Name)
+		reason := ""
+		if value, ok := serverTags(server)[expiresAtTag]; ok {
+			expiresAt, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				fmt.Printf("Skipping %s: invalid %s tag %q\n", name, expiresAtTag, value)
+				continue
+			}
+			if expiresAt.After(now) {
+				continue
+			}
+			reason = fmt.Sprintf("%s %s", expiresAtTag, value)
+		} else {
+			if ok, _ := path.Match(pattern, name); !ok {
+				continue
+			}
+			created, ok := timestampFromName(name)
+			if !ok {
+				fmt.Printf("Skipping %s: no %s tag and no timestamp in the name\n", name, expiresAtTag)
+				continue
+			}
+			if now.Sub(created) < maxAge {
+				continue
+			}
+			reason = fmt.Sprintf("created %s, older than %v", created.Format(time.RFC3339), maxAge)
+		}
+		if isProtected(server) {
+			fmt.Printf("Skipping %s: protected by tag %s=true\n", name, protectionTag)
+			continue
+		}
+		expired = append(expired, expiredServer{
+			ResourceGroup: resourceGroupFromID(to.String(server.ID)),
+			Server:        name,
+			Reason:        reason,
+		})
+	}
+	return expired
+}
+
+// timestampFromName parses the UTC timestamp suffix of names like async-test-20060102150405
+func timestampFromName(name string) (time.Time, bool) {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(dateFormat, name[i+1:])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// deleteExpiredServers deletes the servers with at most parallel deletions in flight,
+// each waiting for its asynchronous delete to finish
+func deleteExpiredServers(expired []expiredServer, parallel int) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := range expired {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(e *expiredServer) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := deleteExpiredServer(e); err != nil {
+				e.Result = "failed"
+				e.Error = err.Error()
+			} else {
+				e.Result = "deleted"
+			}
+			fmt.Printf("%s/%s: %s %s\n", e.ResourceGroup, e.Server, e.Result, e.Error)
+		}(&expired[i])
+	}
+	wg.Wait()
+}
+
+func deleteExpiredServer(e *expiredServer) error {
+	// the server is read again so a lock or tag added since listing is respected
+	server, err := serversClient.Get(e.ResourceGroup, e.Server)
+	if err != nil {
+		return err
+	}
+	if err := checkDeletionAllowed(e.ResourceGroup, server); err != nil {
+		return err
+	}
+	_, errChannel := serversClient.Delete(e.ResourceGroup, e.Server, nil)
+	return <-errChannel
+}
+
+func writeJanitorReport(w io.Writer, expired []expiredServer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESOURCE GROUP\tSERVER\tREASON\tRESULT\tERROR")
+	for _, e := range expired {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.ResourceGroup, e.Server, e.Reason, e.Result, e.Error)
+	}
+	tw.Flush()
+}
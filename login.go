@@ -0,0 +1,402 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - login signs a user in with the device code flow (adal.InitiateDeviceAuth and
+//   WaitForUserCompletion) for the public client of the Azure CLI, so no app registration is
+//   needed; -client-id uses another public client
+// - accounts are named; accounts.json in the token cache dir (tokencache.go) holds their tenant,
+//   client and subscription and which one is active, the tokens themselves, refresh token
+//   included, are in the encrypted account_<name>.token next to it
+// - credentials are taken, in this order, from the account named by AZURE_ACCOUNT, from the
+//   service principal variables when AZURE_CLIENT_SECRET is set, from the active account
+// - the refresh token is used through NewServicePrincipalTokenFromManualToken, each refresh
+//   is written back to the cache; AAD does not always return a new refresh token, the old one
+//   is kept then
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const (
+	// public client id of the Azure CLI
+	defaultLoginClientID = "04b07795-8ddb-461a-bbee-02f9e1bf7b46"
+	defaultAccountName   = "default"
+	accountsFileName     = "accounts.json"
+)
+
+// account is a user signed in with login
+type account struct {
+	TenantID       string    `json:"tenantId"`
+	ClientID       string    `json:"clientId"`
+	SubscriptionID string    `json:"subscriptionId,omitempty"`
+	LoggedInAt     time.Time `json:"loggedInAt"`
+}
+
+// accounts is the content of accounts.json
+type accounts struct {
+	Active   string              `json:"active,omitempty"`
+	Accounts map[string]*account `json:"accounts"`
+}
+
+func init() {
+	registerCommand(command{
+		name:    "login",
+		summary: "Sign in a user with a device code and make the account active",
+		run:     runLogin,
+	})
+	registerCommand(command{
+		name:    "logout",
+		summary: "Forget an account and its tokens",
+		run:     runLogout,
+	})
+	registerCommand(command{
+		name:    "whoami",
+		summary: "Show the credentials commands use and the accounts logged in",
+		run:     runWhoami,
+	})
+	registerCommand(command{
+		name:    "account use",
+		summary: "Make a logged in account the active one",
+		run:     runAccountUse,
+	})
+}
+
+func runLogin(args []string) {
+	flags := newFlagSet("login")
+	name := flags.String("name", defaultAccountName, "name of the account")
+	tenantID := flags.String("tenant", os.Getenv("AZURE_TENANT_ID"), "tenant to sign in to, default AZURE_TENANT_ID or common")
+	clientID := flags.String("client-id", defaultLoginClientID, "public client (application) id")
+	subscriptionID := flags.String("subscription", os.Getenv("AZURE_SUBSCRIPTION_ID"), "subscription used with the account")
+	flags.Parse(args)
+	if *tenantID == "" {
+		*tenantID = "common"
+	}
+
+	dir, err := accountsDir()
+	onErrorFail(err, "login failed")
+	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, *tenantID)
+	onErrorFail(err, "Error getting OAuth configuration")
+	sender := loginSender()
+	code, err := adal.InitiateDeviceAuth(sender, *oauthConfig, *clientID, azure.PublicCloud.ResourceManagerEndpoint)
+	onErrorFail(err, "Starting the device login failed")
+	fmt.Println(*code.Message)
+	token, err := adal.WaitForUserCompletion(sender, code)
+	onErrorFail(err, "Device login failed")
+
+	cache, err := newTokenCache(dir, "account_"+*name, "")
+	onErrorFail(err, "Opening the token cache failed")
+	onErrorFail(cache.update(azure.PublicCloud.ResourceManagerEndpoint, token), "Saving the token failed")
+	err = updateAccounts(dir, func(a *accounts) error {
+		a.Accounts[*name] = &account{
+			TenantID:       *tenantID,
+			ClientID:       *clientID,
+			SubscriptionID: *subscriptionID,
+			LoggedInAt:     time.Now().UTC(),
+		}
+		a.Active = *name
+		return nil
+	})
+	onErrorFail(err, "Saving the account failed")
+	fmt.Printf("Logged in as account %s (tenant %s), it is the active account now\n", *name, *tenantID)
+}
+
+func runLogout(args []string) {
+	flags := newFlagSet("logout")
+	name := flags.String("name", "", "account to log out, default the active one")
+	all := flags.Bool("all", false, "log out every account")
+	flags.Parse(args)
+
+	dir, err := accountsDir()
+	onErrorFail(err, "logout failed")
+	var removed []string
+	err = updateAccounts(dir, func(a *accounts) error {
+		switch {
+		case *all:
+			for n := range a.Accounts {
+				removed = append(removed, n)
+			}
+		case *name != "":
+			if a.Accounts[*name] == nil {
+				return fmt.Errorf("No account %s", *name)
+			}
+			removed = []string{*name}
+		case a.Active != "":
+			removed = []string{a.Active}
+		default:
+			return fmt.Errorf("No active account")
+		}
+		for _, n := range removed {
+			delete(a.Accounts, n)
+			if a.Active == n {
+				a.Active = ""
+			}
+		}
+		return nil
+	})
+	onErrorFail(err, "logout failed")
+	sort.Strings(removed)
+	for _, n := range removed {
+		cache, err := newTokenCache(dir, "account_"+n, "")
+		onErrorFail(err, "Opening the token cache failed")
+		if err := os.Remove(cache.path); err != nil && !os.IsNotExist(err) {
+			onErrorFail(err, "Removing the tokens failed")
+		}
+		fmt.Printf("Logged out account %s\n", n)
+	}
+}
+
+func runWhoami(args []string) {
+	flags := newFlagSet("whoami")
+	flags.Parse(args)
+
+	dir, err := tokenCacheDir()
+	onErrorFail(err, "whoami failed")
+	a := &accounts{Accounts: map[string]*account{}}
+	if dir != "" {
+		a, err = readAccounts(dir)
+		onErrorFail(err, "Reading the accounts failed")
+	}
+	switch name := credentialsAccount(a); {
+	case name != "" && a.Accounts[name] == nil:
+		fmt.Printf("No account %s, run login -name %s\n", name, name)
+	case name != "":
+		acc := a.Accounts[name]
+		fmt.Printf("Account:      %s\n", name)
+		fmt.Printf("Tenant:       %s\n", acc.TenantID)
+		fmt.Printf("Client:       %s\n", acc.ClientID)
+		fmt.Printf("Subscription: %s\n", accountSubscription(acc))
+		fmt.Printf("Logged in:    %s\n", acc.LoggedInAt.Format(time.RFC3339))
+		cache, err := newTokenCache(dir, "account_"+name, "")
+		onErrorFail(err, "Opening the token cache failed")
+		tokens, _ := cache.read()
+		if token, ok := tokens[azure.PublicCloud.ResourceManagerEndpoint]; ok {
+			fmt.Printf("Token:        expires %s\n", token.Expires().Format(time.RFC3339))
+		} else {
+			fmt.Printf("Token:        none, run login again\n")
+		}
+	case os.Getenv("AZURE_CLIENT_SECRET") != "":
+		fmt.Printf("Service principal: %s\n", os.Getenv("AZURE_CLIENT_ID"))
+		fmt.Printf("Tenant:            %s\n", os.Getenv("AZURE_TENANT_ID"))
+		fmt.Printf("Subscription:      %s\n", os.Getenv("AZURE_SUBSCRIPTION_ID"))
+	default:
+		fmt.Println("Not logged in: run login or set the AZURE_* service principal variables")
+	}
+
+	if len(a.Accounts) > 0 {
+		names := make([]string, 0, len(a.Accounts))
+		for n := range a.Accounts {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Println()
+		fmt.Println("Accounts:")
+		for _, n := range names {
+			marker := " "
+			if n == a.Active {
+				marker = "*"
+			}
+			fmt.Printf("%s %-16s %s\n", marker, n, a.Accounts[n].TenantID)
+		}
+	}
+}
+
+func runAccountUse(args []string) {
+	flags := newFlagSet("account use")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: account use <name>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := flags.Arg(0)
+	dir, err := accountsDir()
+	onErrorFail(err, "account use failed")
+	err = updateAccounts(dir, func(a *accounts) error {
+		if a.Accounts[name] == nil {
+			return fmt.Errorf("No account %s, run login -name %s", name, name)
+		}
+		a.Active = name
+		return nil
+	})
+	onErrorFail(err, "account use failed")
+	fmt.Printf("Account %s is active\n", name)
+}
+
+// accountsDir returns the token cache dir, which accounts need
+func accountsDir() (string, error) {
+	dir, err := tokenCacheDir()
+	if err == nil && dir == "" {
+		err = fmt.Errorf("Accounts are kept in the token cache, which TOKEN_CACHE=off turns off")
+	}
+	return dir, err
+}
+
+func readAccounts(dir string) (*accounts, error) {
+	a := &accounts{Accounts: map[string]*account{}}
+	data, err := ioutil.ReadFile(filepath.Join(dir, accountsFileName))
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("%s: %v", accountsFileName, err)
+	}
+	if a.Accounts == nil {
+		a.Accounts = map[string]*account{}
+	}
+	return a, nil
+}
+
+// updateAccounts changes accounts.json under its lock
+func updateAccounts(dir string, change func(*accounts) error) error {
+	path := filepath.Join(dir, accountsFileName)
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	a, err := readAccounts(dir)
+	if err != nil {
+		return err
+	}
+	if err := change(a); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// credentialsAccount returns the account commands authenticate with, "" for the service principal
+func credentialsAccount(a *accounts) string {
+	if name := os.Getenv("AZURE_ACCOUNT"); name != "" {
+		return name
+	}
+	if os.Getenv("AZURE_CLIENT_SECRET") != "" {
+		return ""
+	}
+	return a.Active
+}
+
+func accountSubscription(acc *account) string {
+	if acc.SubscriptionID != "" {
+		return acc.SubscriptionID
+	}
+	return os.Getenv("AZURE_SUBSCRIPTION_ID")
+}
+
+// accountCredential is the logged in account commands authenticate with
+type accountCredential struct {
+	name           string
+	account        *account
+	subscriptionID string
+	token          *adal.ServicePrincipalToken
+}
+
+// accountCredentials returns the account commands authenticate with, nil when they use the
+// service principal variables
+func accountCredentials() (*accountCredential, error) {
+	dir, err := tokenCacheDir()
+	if err != nil || dir == "" {
+		return nil, err
+	}
+	a, err := readAccounts(dir)
+	if err != nil {
+		return nil, err
+	}
+	name := credentialsAccount(a)
+	if name == "" {
+		return nil, nil
+	}
+	acc := a.Accounts[name]
+	if acc == nil {
+		return nil, fmt.Errorf("No account %s, run login -name %s", name, name)
+	}
+	subscriptionID := accountSubscription(acc)
+	if subscriptionID == "" {
+		return nil, fmt.Errorf("Account %s has no subscription, run login -subscription or set AZURE_SUBSCRIPTION_ID", name)
+	}
+	cache, err := newTokenCache(dir, "account_"+name, "")
+	if err != nil {
+		return nil, err
+	}
+	resource := azure.PublicCloud.ResourceManagerEndpoint
+	tokens, _ := cache.read()
+	token, ok := tokens[resource]
+	if !ok || token.RefreshToken == "" {
+		return nil, fmt.Errorf("No token for account %s, run login -name %s", name, name)
+	}
+	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, acc.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	spToken, err := newAccountToken(*oauthConfig, acc.ClientID, resource, token, cache)
+	if err != nil {
+		return nil, err
+	}
+	if err := spToken.EnsureFresh(); err != nil {
+		return nil, fmt.Errorf("Refreshing the token of account %s failed, run login -name %s: %v", name, name, err)
+	}
+	return &accountCredential{name: name, account: acc, subscriptionID: subscriptionID, token: spToken}, nil
+}
+
+// newAccountToken returns the token of a logged in account, cached again on each refresh.
+// Azure AD may leave the refresh token out of a refresh response; the token then keeps
+// the one it has, otherwise the next refresh would be sent without one.
+func newAccountToken(oauthConfig adal.OAuthConfig, clientID string, resource string, token adal.Token, cache *tokenCache) (*adal.ServicePrincipalToken, error) {
+	var spToken *adal.ServicePrincipalToken
+	refreshToken := token.RefreshToken
+	spToken, err := adal.NewServicePrincipalTokenFromManualToken(oauthConfig, clientID, resource, token,
+		func(t adal.Token) error {
+			if t.RefreshToken == "" {
+				t.RefreshToken = refreshToken
+				spToken.Token.RefreshToken = refreshToken
+			}
+			refreshToken = t.RefreshToken
+			return cache.refreshCallback(resource)(t)
+		})
+	return spToken, err
+}
+
+// loginSender sends the device login requests, logged with --debug
+func loginSender() adal.Sender {
+	var sender autorest.Sender = &http.Client{}
+	if debugLogger != nil {
+		sender = autorest.DecorateSender(sender, debugLogger.sendDecorator())
+	}
+	return sender
+}
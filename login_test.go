@@ -0,0 +1,86 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// tokenEndpoint answers refreshes with an access token but no refresh token, as Azure AD
+// may, and keeps the refresh tokens it was sent
+type tokenEndpoint struct {
+	refreshTokens []string
+}
+
+func (e *tokenEndpoint) Do(r *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(r.Body)
+	form, _ := url.ParseQuery(string(body))
+	e.refreshTokens = append(e.refreshTokens, form.Get("refresh_token"))
+	expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"token_type":"Bearer","expires_in":"3600","expires_on":"` + expiresOn + `","access_token":"new-access"}`)),
+		Request:    r,
+	}, nil
+}
+
+func TestAccountTokenKeepsRefreshToken(t *testing.T) {
+	t.Setenv("TOKEN_CACHE_PASSPHRASE", "")
+	dir := t.TempDir()
+	cache, err := newTokenCache(dir, "account_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, "tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resource := azure.PublicCloud.ResourceManagerEndpoint
+	expired := adal.Token{AccessToken: "old-access", RefreshToken: "old-refresh", ExpiresOn: "1", Type: "Bearer", Resource: resource}
+	spToken, err := newAccountToken(*oauthConfig, "client", resource, expired, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := &tokenEndpoint{}
+	spToken.SetSender(endpoint)
+
+	// the second refresh shows whether the first one lost the refresh token
+	for i := 0; i < 2; i++ {
+		if err := spToken.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(endpoint.refreshTokens) != 2 || endpoint.refreshTokens[0] != "old-refresh" || endpoint.refreshTokens[1] != "old-refresh" {
+		t.Errorf("refresh tokens sent %q", endpoint.refreshTokens)
+	}
+	if spToken.AccessToken != "new-access" || spToken.RefreshToken != "old-refresh" {
+		t.Errorf("token after refresh %+v", spToken.Token)
+	}
+	tokens, _ := cache.read()
+	if cached := tokens[resource]; cached.AccessToken != "new-access" || cached.RefreshToken != "old-refresh" {
+		t.Errorf("cached token %+v", cached)
+	}
+}
@@ -0,0 +1,728 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - parses server logs downloaded with "logs download" (LogFilesClient), no server access is needed
+// - lines are matched with a regexp compiled from the server's log_line_prefix,
+//   the Azure default is '%t-%c-'
+// - when the prefix has no %e the SQLSTATE is inferred from well known messages
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultLogLinePrefix = "%t-%c-"
+
+// logEntry is a single, possibly multi-line, server log message together with
+// the DETAIL/HINT/STATEMENT/CONTEXT lines that followed it.
+type logEntry struct {
+	Time      time.Time
+	PID       string
+	Session   string
+	User      string
+	Database  string
+	SQLState  string
+	Severity  string
+	Message   string
+	Detail    string
+	Statement string
+}
+
+// logParser splits log lines into entries using a regexp built from log_line_prefix
+type logParser struct {
+	line   *regexp.Regexp
+	fields []string
+}
+
+var logLinePrefixEscapes = map[byte]struct {
+	field   string
+	pattern string
+}{
+	't': {"time", `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?: ?[A-Za-z]{1,5}|[+-]\d{2}(?::?\d{2})?)?`},
+	'm': {"time", `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d{3}(?: ?[A-Za-z]{1,5}|[+-]\d{2}(?::?\d{2})?)?`},
+	'n': {"epoch", `\d+\.\d+`},
+	's': {"", `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?: ?[A-Za-z]{1,5}|[+-]\d{2}(?::?\d{2})?)?`},
+	'p': {"pid", `\d+`},
+	'c': {"session", `[0-9a-f]+\.[0-9a-f]+`},
+	'l': {"", `\d+`},
+	'e': {"sqlstate", `[0-9A-Z]{5}`},
+	'u': {"user", `.*?`},
+	'd': {"database", `.*?`},
+	'a': {"", `.*?`},
+	'h': {"", `.*?`},
+	'r': {"", `.*?`},
+	'i': {"", `.*?`},
+	'x': {"", `\S*`},
+	'v': {"", `\S*`},
+	'q': {"", ``},
+}
+
+const logSeverities = `DEBUG[1-5]?|INFO|NOTICE|WARNING|ERROR|LOG|FATAL|PANIC|DETAIL|HINT|QUERY|CONTEXT|STATEMENT|LOCATION`
+
+// newLogParser compiles a log_line_prefix such as '%t-%c-' or '%m [%p] ' into a parser
+func newLogParser(prefix string) (*logParser, error) {
+	var pattern strings.Builder
+	var fields []string
+	pattern.WriteString(`^`)
+	for i := 0; i < len(prefix); i++ {
+		if prefix[i] != '%' || i == len(prefix)-1 {
+			pattern.WriteString(regexp.QuoteMeta(prefix[i : i+1]))
+			continue
+		}
+		i++
+		if prefix[i] == '%' {
+			pattern.WriteString(`%`)
+			continue
+		}
+		escape, ok := logLinePrefixEscapes[prefix[i]]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported log_line_prefix escape %%%c", prefix[i])
+		}
+		if escape.field == "" {
+			pattern.WriteString(`(?:` + escape.pattern + `)`)
+			continue
+		}
+		pattern.WriteString(`(` + escape.pattern + `)`)
+		fields = append(fields, escape.field)
+	}
+	pattern.WriteString(`\s*(` + logSeverities + `):\s+(.*)$`)
+
+	line, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, err
+	}
+	return &logParser{line: line, fields: fields}, nil
+}
+
+// parse reads all entries from r
+func (p *logParser) parse(r io.Reader) ([]*logEntry, error) {
+	var entries []*logEntry
+	var last *logEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		m := p.line.FindStringSubmatch(line)
+		if m == nil {
+			// continuation of a multi-line message or statement
+			if last != nil {
+				appendLogText(last, "\n"+strings.TrimPrefix(line, "\t"))
+			}
+			continue
+		}
+		entry := &logEntry{Severity: m[len(m)-2], Message: m[len(m)-1]}
+		for i, field := range p.fields {
+			setLogField(entry, field, m[i+1])
+		}
+		if last != nil && isSecondarySeverity(entry.Severity) {
+			last.attach(entry)
+			continue
+		}
+		entries = append(entries, entry)
+		last = entry
+	}
+	return entries, scanner.Err()
+}
+
+func setLogField(entry *logEntry, field string, value string) {
+	switch field {
+	case "time":
+		entry.Time = parseLogTime(value)
+	case "epoch":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			entry.Time = time.Unix(0, int64(f*float64(time.Second))).UTC()
+		}
+	case "pid":
+		entry.PID = value
+	case "session":
+		entry.Session = value
+	case "sqlstate":
+		entry.SQLState = value
+	case "user":
+		entry.User = value
+	case "database":
+		entry.Database = value
+	}
+}
+
+var logTimeFormats = []string{
+	"2006-01-02 15:04:05.000 MST",
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05.000MST",
+	"2006-01-02 15:04:05MST",
+	"2006-01-02 15:04:05.000-07",
+	"2006-01-02 15:04:05-07",
+	"2006-01-02 15:04:05.000-07:00",
+	"2006-01-02 15:04:05-07:00",
+	"2006-01-02 15:04:05.000",
+	"2006-01-02 15:04:05",
+}
+
+func parseLogTime(value string) time.Time {
+	for _, format := range logTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func isSecondarySeverity(severity string) bool {
+	switch severity {
+	case "DETAIL", "HINT", "QUERY", "CONTEXT", "STATEMENT", "LOCATION":
+		return true
+	}
+	return false
+}
+
+// attach adds a secondary line (DETAIL, STATEMENT, ...) to its primary entry
+func (e *logEntry) attach(secondary *logEntry) {
+	switch secondary.Severity {
+	case "STATEMENT":
+		e.Statement = secondary.Message
+	default:
+		if e.Detail != "" {
+			e.Detail += "\n"
+		}
+		e.Detail += secondary.Severity + ": " + secondary.Message
+	}
+}
+
+func appendLogText(e *logEntry, text string) {
+	switch {
+	case e.Statement != "":
+		e.Statement += text
+	case e.Detail != "":
+		e.Detail += text
+	default:
+		e.Message += text
+	}
+}
+
+// well known messages used when the log_line_prefix has no %e
+var inferredSQLStates = []struct {
+	match    *regexp.Regexp
+	sqlState string
+}{
+	{regexp.MustCompile(`^password authentication failed`), "28P01"},
+	{regexp.MustCompile(`^no pg_hba\.conf entry`), "28000"},
+	{regexp.MustCompile(`^role ".*" does not exist`), "28000"},
+	{regexp.MustCompile(`^database ".*" does not exist`), "3D000"},
+	{regexp.MustCompile(`^(sorry, too many clients already|remaining connection slots are reserved)`), "53300"},
+	{regexp.MustCompile(`^relation ".*" does not exist`), "42P01"},
+	{regexp.MustCompile(`^column ".*" does not exist`), "42703"},
+	{regexp.MustCompile(`^function .* does not exist`), "42883"},
+	{regexp.MustCompile(`^syntax error`), "42601"},
+	{regexp.MustCompile(`^permission denied`), "42501"},
+	{regexp.MustCompile(`^duplicate key value violates unique constraint`), "23505"},
+	{regexp.MustCompile(`^null value in column .* violates not-null constraint`), "23502"},
+	{regexp.MustCompile(`violates foreign key constraint`), "23503"},
+	{regexp.MustCompile(`^deadlock detected`), "40P01"},
+	{regexp.MustCompile(`^could not serialize access`), "40001"},
+	{regexp.MustCompile(`^canceling statement due to statement timeout`), "57014"},
+	{regexp.MustCompile(`^canceling statement due to user request`), "57014"},
+	{regexp.MustCompile(`^terminating connection due to administrator command`), "57P01"},
+	{regexp.MustCompile(`^invalid input syntax`), "22P02"},
+	{regexp.MustCompile(`^division by zero`), "22012"},
+}
+
+// sqlState returns the entry's SQLSTATE, inferring it from the message if it was not logged
+func (e *logEntry) sqlState() string {
+	if e.SQLState != "" && e.SQLState != "00000" {
+		return e.SQLState
+	}
+	for _, inferred := range inferredSQLStates {
+		if inferred.match.MatchString(e.Message) {
+			return inferred.sqlState
+		}
+	}
+	return "unknown"
+}
+
+var (
+	durationRegexp           = regexp.MustCompile(`(?s)^duration: ([0-9.]+) ms(?:\s+(?:statement|execute [^:]*|parse [^:]*|bind [^:]*):\s*(.*))?$`)
+	checkpointStartingRegexp = regexp.MustCompile(`^checkpoint starting: (.*)$`)
+	checkpointCompleteRegexp = regexp.MustCompile(`^checkpoint complete: wrote (\d+) buffers.*total=([0-9.]+) s`)
+	autovacuumRegexp         = regexp.MustCompile(`^automatic (vacuum|aggressive vacuum|analyze) of table "([^"]+)"`)
+	forUserRegexp            = regexp.MustCompile(`(?:for )?user "([^"]*)"`)
+
+	sqlCommentRegexp = regexp.MustCompile(`(?s)/\*.*?\*/|--[^\n]*`)
+	sqlStringRegexp  = regexp.MustCompile(`(?:[eEbBxXnN])?'(?:[^']|'')*'`)
+	sqlDollarRegexp  = regexp.MustCompile(`(?s)\$([A-Za-z_]*)\$.*?\$([A-Za-z_]*)\$`)
+	sqlParamRegexp   = regexp.MustCompile(`\$\d+`)
+	sqlNumberRegexp  = regexp.MustCompile(`\b\d+(?:\.\d+)?(?:[eE][+-]?\d+)?\b`)
+	sqlListRegexp    = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	sqlRowsRegexp    = regexp.MustCompile(`\(\?\)(?:\s*,\s*\(\?\))+`)
+	whitespaceRegexp = regexp.MustCompile(`\s+`)
+	quotedNameRegexp = regexp.MustCompile(`"[^"]*"`)
+	unquotedRegexp   = regexp.MustCompile(`[^"]+`)
+)
+
+// normalizeQuery strips literals and comments so that statements differing only
+// in their constants are grouped together
+func normalizeQuery(query string) string {
+	q := sqlCommentRegexp.ReplaceAllString(query, " ")
+	q = sqlDollarRegexp.ReplaceAllString(q, "?")
+	q = sqlStringRegexp.ReplaceAllString(q, "?")
+	q = sqlParamRegexp.ReplaceAllString(q, "?")
+	q = sqlNumberRegexp.ReplaceAllString(q, "?")
+	q = sqlListRegexp.ReplaceAllString(q, "(?)")
+	q = sqlRowsRegexp.ReplaceAllString(q, "(?)")
+	q = whitespaceRegexp.ReplaceAllString(q, " ")
+	q = unquotedRegexp.ReplaceAllStringFunc(q, strings.ToLower)
+	return strings.TrimSuffix(strings.TrimSpace(q), ";")
+}
+
+// normalizeMessage strips quoted names and numbers from a log message
+func normalizeMessage(message string) string {
+	m := quotedNameRegexp.ReplaceAllString(message, `"?"`)
+	m = sqlNumberRegexp.ReplaceAllString(m, "?")
+	return whitespaceRegexp.ReplaceAllString(strings.TrimSpace(m), " ")
+}
+
+type slowQuery struct {
+	Query         string  `json:"query"`
+	Calls         int     `json:"calls"`
+	TotalMS       float64 `json:"totalMs"`
+	MeanMS        float64 `json:"meanMs"`
+	MaxMS         float64 `json:"maxMs"`
+	ExampleQuery  string  `json:"exampleQuery"`
+	ExampleUser   string  `json:"exampleUser,omitempty"`
+	ExampleDBName string  `json:"exampleDatabase,omitempty"`
+}
+
+type errorCount struct {
+	SQLState string `json:"sqlState"`
+	Severity string `json:"severity"`
+	Count    int    `json:"count"`
+	Example  string `json:"example"`
+}
+
+type messageCount struct {
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+type connectionStats struct {
+	Received            int            `json:"received"`
+	Authorized          int            `json:"authorized"`
+	Disconnections      int            `json:"disconnections"`
+	AuthFailures        int            `json:"authFailures"`
+	AuthFailuresByUser  map[string]int `json:"authFailuresByUser,omitempty"`
+	ConnectionFailures  int            `json:"connectionFailures"`
+	ConnectionFailureBy []messageCount `json:"connectionFailureMessages,omitempty"`
+}
+
+type checkpointStats struct {
+	Started         int            `json:"started"`
+	StartedByReason map[string]int `json:"startedByReason,omitempty"`
+	Completed       int            `json:"completed"`
+	BuffersWritten  int64          `json:"buffersWritten"`
+	TotalSeconds    float64        `json:"totalSeconds"`
+	MaxSeconds      float64        `json:"maxSeconds"`
+}
+
+type autovacuumCount struct {
+	Table   string `json:"table"`
+	Vacuums int    `json:"vacuums"`
+	Analyze int    `json:"analyzes"`
+}
+
+// logReport summarizes a set of server log files
+type logReport struct {
+	Files       []string          `json:"files"`
+	Entries     int               `json:"entries"`
+	From        time.Time         `json:"from"`
+	To          time.Time         `json:"to"`
+	Severities  map[string]int    `json:"severities"`
+	SlowQueries []slowQuery       `json:"slowQueries"`
+	Errors      []errorCount      `json:"errors"`
+	Connections connectionStats   `json:"connections"`
+	Checkpoints checkpointStats   `json:"checkpoints"`
+	Autovacuum  []autovacuumCount `json:"autovacuum"`
+}
+
+// buildLogReport aggregates entries; only the top slow queries taking at least minDurationMS are kept
+func buildLogReport(files []string, entries []*logEntry, top int, minDurationMS float64) *logReport {
+	report := &logReport{
+		Files:      files,
+		Entries:    len(entries),
+		Severities: map[string]int{},
+		Connections: connectionStats{
+			AuthFailuresByUser: map[string]int{},
+		},
+		Checkpoints: checkpointStats{
+			StartedByReason: map[string]int{},
+		},
+	}
+	queries := map[string]*slowQuery{}
+	errors := map[string]*errorCount{}
+	connectionFailures := map[string]int{}
+	tables := map[string]*autovacuumCount{}
+
+	for _, e := range entries {
+		report.Severities[e.Severity]++
+		if !e.Time.IsZero() {
+			if report.From.IsZero() || e.Time.Before(report.From) {
+				report.From = e.Time
+			}
+			if e.Time.After(report.To) {
+				report.To = e.Time
+			}
+		}
+
+		switch e.Severity {
+		case "ERROR", "FATAL", "PANIC":
+			state := e.sqlState()
+			key := state + "/" + e.Severity
+			ec, ok := errors[key]
+			if !ok {
+				ec = &errorCount{SQLState: state, Severity: e.Severity, Example: e.Message}
+				errors[key] = ec
+			}
+			ec.Count++
+
+			switch {
+			case strings.HasPrefix(state, "28"):
+				report.Connections.AuthFailures++
+				user := e.User
+				if m := forUserRegexp.FindStringSubmatch(e.Message); m != nil {
+					user = m[1]
+				}
+				report.Connections.AuthFailuresByUser[user]++
+			case strings.HasPrefix(state, "08") || state == "53300" || state == "3D000":
+				report.Connections.ConnectionFailures++
+				connectionFailures[normalizeMessage(e.Message)]++
+			}
+			continue
+		}
+
+		msg := e.Message
+		switch {
+		case strings.HasPrefix(msg, "duration: "):
+			m := durationRegexp.FindStringSubmatch(msg)
+			if m == nil || m[2] == "" {
+				continue
+			}
+			ms, err := strconv.ParseFloat(m[1], 64)
+			if err != nil || ms < minDurationMS {
+				continue
+			}
+			key := normalizeQuery(m[2])
+			q, ok := queries[key]
+			if !ok {
+				q = &slowQuery{Query: key}
+				queries[key] = q
+			}
+			q.Calls++
+			q.TotalMS += ms
+			if ms >= q.MaxMS {
+				q.MaxMS = ms
+				q.ExampleQuery = strings.TrimSpace(m[2])
+				q.ExampleUser = e.User
+				q.ExampleDBName = e.Database
+			}
+		case strings.HasPrefix(msg, "connection received:"):
+			report.Connections.Received++
+		case strings.HasPrefix(msg, "connection authorized:"):
+			report.Connections.Authorized++
+		case strings.HasPrefix(msg, "disconnection:"):
+			report.Connections.Disconnections++
+		case strings.HasPrefix(msg, "could not receive data from client"),
+			strings.HasPrefix(msg, "could not send data to client"),
+			strings.HasPrefix(msg, "unexpected EOF on client connection"),
+			strings.HasPrefix(msg, "incomplete startup packet"):
+			report.Connections.ConnectionFailures++
+			connectionFailures[normalizeMessage(msg)]++
+		case strings.HasPrefix(msg, "checkpoint starting:"):
+			report.Checkpoints.Started++
+			if m := checkpointStartingRegexp.FindStringSubmatch(msg); m != nil {
+				report.Checkpoints.StartedByReason[strings.TrimSpace(m[1])]++
+			}
+		case strings.HasPrefix(msg, "checkpoint complete:"):
+			report.Checkpoints.Completed++
+			if m := checkpointCompleteRegexp.FindStringSubmatch(msg); m != nil {
+				buffers, _ := strconv.ParseInt(m[1], 10, 64)
+				seconds, _ := strconv.ParseFloat(m[2], 64)
+				report.Checkpoints.BuffersWritten += buffers
+				report.Checkpoints.TotalSeconds += seconds
+				if seconds > report.Checkpoints.MaxSeconds {
+					report.Checkpoints.MaxSeconds = seconds
+				}
+			}
+		case strings.HasPrefix(msg, "automatic "):
+			m := autovacuumRegexp.FindStringSubmatch(msg)
+			if m == nil {
+				continue
+			}
+			t, ok := tables[m[2]]
+			if !ok {
+				t = &autovacuumCount{Table: m[2]}
+				tables[m[2]] = t
+			}
+			if m[1] == "analyze" {
+				t.Analyze++
+			} else {
+				t.Vacuums++
+			}
+		}
+	}
+
+	for _, q := range queries {
+		q.MeanMS = q.TotalMS / float64(q.Calls)
+		report.SlowQueries = append(report.SlowQueries, *q)
+	}
+	sort.Slice(report.SlowQueries, func(i, j int) bool {
+		return report.SlowQueries[i].TotalMS > report.SlowQueries[j].TotalMS
+	})
+	if top > 0 && len(report.SlowQueries) > top {
+		report.SlowQueries = report.SlowQueries[:top]
+	}
+
+	for _, ec := range errors {
+		report.Errors = append(report.Errors, *ec)
+	}
+	sort.Slice(report.Errors, func(i, j int) bool {
+		if report.Errors[i].Count != report.Errors[j].Count {
+			return report.Errors[i].Count > report.Errors[j].Count
+		}
+		return report.Errors[i].SQLState < report.Errors[j].SQLState
+	})
+
+	for msg, count := range connectionFailures {
+		report.Connections.ConnectionFailureBy = append(report.Connections.ConnectionFailureBy, messageCount{Message: msg, Count: count})
+	}
+	sort.Slice(report.Connections.ConnectionFailureBy, func(i, j int) bool {
+		return report.Connections.ConnectionFailureBy[i].Count > report.Connections.ConnectionFailureBy[j].Count
+	})
+
+	for _, t := range tables {
+		report.Autovacuum = append(report.Autovacuum, *t)
+	}
+	sort.Slice(report.Autovacuum, func(i, j int) bool {
+		return report.Autovacuum[i].Vacuums+report.Autovacuum[i].Analyze > report.Autovacuum[j].Vacuums+report.Autovacuum[j].Analyze
+	})
+	return report
+}
+
+// logFilesIn expands directories in paths to the *.log and *.txt files they contain
+func logFilesIn(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if ext := filepath.Ext(p); !fi.IsDir() && (ext == ".log" || ext == ".txt") {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// parseLogFiles parses every file with the given log_line_prefix
+func parseLogFiles(files []string, prefix string) ([]*logEntry, error) {
+	parser, err := newLogParser(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*logEntry
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		fileEntries, err := parser.parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return entries, nil
+}
+
+// writeLogReport renders the report as text, json or html
+func writeLogReport(w io.Writer, report *logReport, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "html":
+		return logReportHTML.Execute(w, report)
+	case "text":
+		return writeLogReportText(w, report)
+	}
+	return fmt.Errorf("Unknown report format %q, expected text, json or html", format)
+}
+
+func writeLogReportText(w io.Writer, report *logReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Files\t:%d\nEntries\t:%d\nFrom\t:%v\nTo\t:%v\n", len(report.Files), report.Entries, report.From, report.To)
+	for _, s := range sortedKeys(report.Severities) {
+		fmt.Fprintf(tw, "  %s\t%d\n", s, report.Severities[s])
+	}
+
+	fmt.Fprintln(tw, "\nTop slow queries")
+	fmt.Fprintln(tw, "  calls\ttotal ms\tmean ms\tmax ms\tquery")
+	for _, q := range report.SlowQueries {
+		fmt.Fprintf(tw, "  %d\t%.1f\t%.1f\t%.1f\t%s\n", q.Calls, q.TotalMS, q.MeanMS, q.MaxMS, truncate(q.Query, 120))
+	}
+
+	fmt.Fprintln(tw, "\nErrors by SQLSTATE")
+	fmt.Fprintln(tw, "  sqlstate\tseverity\tcount\texample")
+	for _, e := range report.Errors {
+		fmt.Fprintf(tw, "  %s\t%s\t%d\t%s\n", e.SQLState, e.Severity, e.Count, truncate(e.Example, 100))
+	}
+
+	c := report.Connections
+	fmt.Fprintln(tw, "\nConnections")
+	fmt.Fprintf(tw, "  received\t%d\n  authorized\t%d\n  disconnections\t%d\n  auth failures\t%d\n  connection failures\t%d\n",
+		c.Received, c.Authorized, c.Disconnections, c.AuthFailures, c.ConnectionFailures)
+	for _, user := range sortedKeys(c.AuthFailuresByUser) {
+		fmt.Fprintf(tw, "  auth failed for %q\t%d\n", user, c.AuthFailuresByUser[user])
+	}
+	for _, m := range c.ConnectionFailureBy {
+		fmt.Fprintf(tw, "  %s\t%d\n", truncate(m.Message, 100), m.Count)
+	}
+
+	cp := report.Checkpoints
+	fmt.Fprintln(tw, "\nCheckpoints")
+	fmt.Fprintf(tw, "  started\t%d\n  completed\t%d\n  buffers written\t%d\n  total s\t%.1f\n  max s\t%.1f\n",
+		cp.Started, cp.Completed, cp.BuffersWritten, cp.TotalSeconds, cp.MaxSeconds)
+	for _, reason := range sortedKeys(cp.StartedByReason) {
+		fmt.Fprintf(tw, "  started (%s)\t%d\n", reason, cp.StartedByReason[reason])
+	}
+
+	fmt.Fprintln(tw, "\nAutovacuum")
+	fmt.Fprintln(tw, "  vacuums\tanalyzes\ttable")
+	for _, t := range report.Autovacuum {
+		fmt.Fprintf(tw, "  %d\t%d\t%s\n", t.Vacuums, t.Analyze, t.Table)
+	}
+	return tw.Flush()
+}
+
+// sortedKeys returns the keys of a count map in order, so the text report is stable
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// truncate shortens s to n runes, never splitting a multi-byte character
+func truncate(s string, n int) string {
+	s = whitespaceRegexp.ReplaceAllString(s, " ")
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-3]) + "..."
+}
+
+var logReportHTML = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>PostgreSQL log report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+td.num { text-align: right; }
+code { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>PostgreSQL log report</h1>
+<p>{{len .Files}} files, {{.Entries}} entries from {{.From}} to {{.To}}</p>
+<table>
+<tr><th>Severity</th><th>Count</th></tr>
+{{range $severity, $count := .Severities}}<tr><td>{{$severity}}</td><td class="num">{{$count}}</td></tr>
+{{end}}</table>
+
+<h2>Top slow queries</h2>
+<table>
+<tr><th>Calls</th><th>Total ms</th><th>Mean ms</th><th>Max ms</th><th>Query</th></tr>
+{{range .SlowQueries}}<tr><td class="num">{{.Calls}}</td><td class="num">{{printf "%.1f" .TotalMS}}</td><td class="num">{{printf "%.1f" .MeanMS}}</td><td class="num">{{printf "%.1f" .MaxMS}}</td><td><code>{{.Query}}</code></td></tr>
+{{end}}</table>
+
+<h2>Errors by SQLSTATE</h2>
+<table>
+<tr><th>SQLSTATE</th><th>Severity</th><th>Count</th><th>Example</th></tr>
+{{range .Errors}}<tr><td>{{.SQLState}}</td><td>{{.Severity}}</td><td class="num">{{.Count}}</td><td>{{.Example}}</td></tr>
+{{end}}</table>
+
+<h2>Connections</h2>
+<table>
+<tr><td>Received</td><td class="num">{{.Connections.Received}}</td></tr>
+<tr><td>Authorized</td><td class="num">{{.Connections.Authorized}}</td></tr>
+<tr><td>Disconnections</td><td class="num">{{.Connections.Disconnections}}</td></tr>
+<tr><td>Authentication failures</td><td class="num">{{.Connections.AuthFailures}}</td></tr>
+{{range $user, $count := .Connections.AuthFailuresByUser}}<tr><td>&nbsp;&nbsp;user "{{$user}}"</td><td class="num">{{$count}}</td></tr>
+{{end}}<tr><td>Connection failures</td><td class="num">{{.Connections.ConnectionFailures}}</td></tr>
+{{range .Connections.ConnectionFailureBy}}<tr><td>&nbsp;&nbsp;{{.Message}}</td><td class="num">{{.Count}}</td></tr>
+{{end}}</table>
+
+<h2>Checkpoints</h2>
+<table>
+<tr><td>Started</td><td class="num">{{.Checkpoints.Started}}</td></tr>
+{{range $reason, $count := .Checkpoints.StartedByReason}}<tr><td>&nbsp;&nbsp;{{$reason}}</td><td class="num">{{$count}}</td></tr>
+{{end}}<tr><td>Completed</td><td class="num">{{.Checkpoints.Completed}}</td></tr>
+<tr><td>Buffers written</td><td class="num">{{.Checkpoints.BuffersWritten}}</td></tr>
+<tr><td>Total seconds</td><td class="num">{{printf "%.1f" .Checkpoints.TotalSeconds}}</td></tr>
+<tr><td>Max seconds</td><td class="num">{{printf "%.1f" .Checkpoints.MaxSeconds}}</td></tr>
+</table>
+
+<h2>Autovacuum</h2>
+<table>
+<tr><th>Table</th><th>Vacuums</th><th>Analyzes</th></tr>
+{{range .Autovacuum}}<tr><td>{{.Table}}</td><td class="num">{{.Vacuums}}</td><td class="num">{{.Analyze}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
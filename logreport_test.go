@@ -0,0 +1,199 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestLogLinePrefixEscapes(t *testing.T) {
+	tests := []struct {
+		prefix string
+		line   string
+		want   logEntry
+	}{
+		{
+			prefix: defaultLogLinePrefix,
+			line:   "2017-09-26 18:00:01 UTC-59ca9581.1f4c-LOG:  connection received: host=10.0.0.1 port=5432",
+			want: logEntry{
+				Time:     time.Date(2017, 9, 26, 18, 0, 1, 0, time.UTC),
+				Session:  "59ca9581.1f4c",
+				Severity: "LOG",
+				Message:  "connection received: host=10.0.0.1 port=5432",
+			},
+		},
+		{
+			prefix: "%m [%p] %q%u@%d ",
+			line:   "2017-09-26 18:00:01.250 UTC [8012] app@orders ERROR:  division by zero",
+			want: logEntry{
+				Time:     time.Date(2017, 9, 26, 18, 0, 1, 250000000, time.UTC),
+				PID:      "8012",
+				User:     "app",
+				Database: "orders",
+				Severity: "ERROR",
+				Message:  "division by zero",
+			},
+		},
+		{
+			prefix: "%n %e %%",
+			line:   "1506448801.500 23505 % ERROR:  duplicate key value violates unique constraint \"orders_pkey\"",
+			want: logEntry{
+				Time:     time.Unix(1506448801, 500000000).UTC(),
+				SQLState: "23505",
+				Severity: "ERROR",
+				Message:  "duplicate key value violates unique constraint \"orders_pkey\"",
+			},
+		},
+	}
+	for _, test := range tests {
+		parser, err := newLogParser(test.prefix)
+		if err != nil {
+			t.Fatalf("newLogParser(%q): %v", test.prefix, err)
+		}
+		entries, err := parser.parse(strings.NewReader(test.line + "\n"))
+		if err != nil {
+			t.Fatalf("%q: %v", test.prefix, err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("%q: got %d entries, want 1", test.prefix, len(entries))
+		}
+		got := *entries[0]
+		if !got.Time.Equal(test.want.Time) {
+			t.Errorf("%q: time %v, want %v", test.prefix, got.Time, test.want.Time)
+		}
+		got.Time = test.want.Time
+		if got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestLogLinePrefixUnsupportedEscape(t *testing.T) {
+	if _, err := newLogParser("%t %z "); err == nil {
+		t.Error("newLogParser accepted %z")
+	}
+}
+
+func TestParseContinuationLines(t *testing.T) {
+	log := strings.Join([]string{
+		"2017-09-26 18:00:01 UTC-59ca9581.1f4c-LOG:  duration: 1520.500 ms  statement: SELECT *",
+		"\tFROM orders",
+		"\tWHERE id = 42",
+		"2017-09-26 18:00:02 UTC-59ca9581.1f4c-ERROR:  relation \"missing\" does not exist at character 15",
+		"2017-09-26 18:00:02 UTC-59ca9581.1f4c-STATEMENT:  SELECT * FROM missing",
+		"\tWHERE true",
+		"2017-09-26 18:00:03 UTC-59ca9581.1f4c-ERROR:  deadlock detected",
+		"2017-09-26 18:00:03 UTC-59ca9581.1f4c-DETAIL:  Process 1 waits for ShareLock on transaction 2.",
+		"\tProcess 2 waits for ShareLock on transaction 1.",
+		"2017-09-26 18:00:03 UTC-59ca9581.1f4c-HINT:  See server log for query details.",
+	}, "\n")
+	parser, err := newLogParser(defaultLogLinePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parser.parse(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	if want := "duration: 1520.500 ms  statement: SELECT *\nFROM orders\nWHERE id = 42"; entries[0].Message != want {
+		t.Errorf("message %q, want %q", entries[0].Message, want)
+	}
+	if want := "SELECT * FROM missing\nWHERE true"; entries[1].Statement != want {
+		t.Errorf("statement %q, want %q", entries[1].Statement, want)
+	}
+	wantDetail := "DETAIL: Process 1 waits for ShareLock on transaction 2.\nProcess 2 waits for ShareLock on transaction 1.\nHINT: See server log for query details."
+	if entries[2].Detail != wantDetail {
+		t.Errorf("detail %q, want %q", entries[2].Detail, wantDetail)
+	}
+
+	report := buildLogReport(nil, entries, 10, 0)
+	if len(report.SlowQueries) != 1 || report.SlowQueries[0].Query != "select * from orders where id = ?" {
+		t.Errorf("slow queries %+v", report.SlowQueries)
+	}
+}
+
+func TestSQLStateInference(t *testing.T) {
+	tests := []struct {
+		entry logEntry
+		want  string
+	}{
+		{logEntry{Message: "password authentication failed for user \"app\""}, "28P01"},
+		{logEntry{Message: "no pg_hba.conf entry for host \"10.0.0.1\""}, "28000"},
+		{logEntry{Message: "database \"nope\" does not exist"}, "3D000"},
+		{logEntry{Message: "remaining connection slots are reserved for non-replication superuser connections"}, "53300"},
+		{logEntry{Message: "insert or update on table \"a\" violates foreign key constraint \"a_b_fkey\""}, "23503"},
+		{logEntry{Message: "canceling statement due to statement timeout"}, "57014"},
+		{logEntry{Message: "something nobody has seen before"}, "unknown"},
+		// a logged SQLSTATE wins, 00000 means none was set
+		{logEntry{SQLState: "42P01", Message: "division by zero"}, "42P01"},
+		{logEntry{SQLState: "00000", Message: "division by zero"}, "22012"},
+	}
+	for _, test := range tests {
+		if got := test.entry.sqlState(); got != test.want {
+			t.Errorf("sqlState(%q, %q) = %s, want %s", test.entry.SQLState, test.entry.Message, got, test.want)
+		}
+	}
+}
+
+func TestTruncateKeepsRunes(t *testing.T) {
+	s := strings.Repeat("ä", 10)
+	got := truncate(s, 6)
+	if !utf8.ValidString(got) {
+		t.Fatalf("truncate split a rune: %q", got)
+	}
+	if want := "äää..."; got != want {
+		t.Errorf("truncate = %q, want %q", got, want)
+	}
+	if got := truncate("short  text", 20); got != "short text" {
+		t.Errorf("truncate = %q", got)
+	}
+}
+
+func TestLogReportTextIsSorted(t *testing.T) {
+	report := buildLogReport(nil, nil, 10, 0)
+	for _, user := range []string{"zoe", "app", "mallory", "bob"} {
+		report.Connections.AuthFailuresByUser[user]++
+	}
+	for _, reason := range []string{"xlog", "time", "immediate force wait", "shutdown"} {
+		report.Checkpoints.StartedByReason[reason]++
+	}
+	want := []string{
+		`auth failed for "app"`, `auth failed for "bob"`, `auth failed for "mallory"`, `auth failed for "zoe"`,
+		"started (immediate force wait)", "started (shutdown)", "started (time)", "started (xlog)",
+	}
+	// map order differs between runs, a few of them show a random order
+	for run := 0; run < 5; run++ {
+		var out bytes.Buffer
+		if err := writeLogReportText(&out, report); err != nil {
+			t.Fatal(err)
+		}
+		text := out.String()
+		last := -1
+		for _, line := range want {
+			i := strings.Index(text, line)
+			if i < last {
+				t.Fatalf("%q is out of order in\n%s", line, text)
+			}
+			last = i
+		}
+	}
+}
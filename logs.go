@@ -0,0 +1,173 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+)
+
+func init() {
+	registerCommand(command{
+		name:         "logs download",
+		summary:      "download the server log files listed by LogFilesClient",
+		needsClients: true,
+		run:          runLogsDownload,
+	})
+	registerCommand(command{
+		name:    "logs report",
+		summary: "summarize downloaded log files: slow queries, errors, connections, checkpoints, autovacuum",
+		run:     runLogsReport,
+	})
+}
+
+func runLogsDownload(args []string) {
+	flags := newFlagSet("logs download")
+	group := flags.String("resource-group", resourceGroupName, "resource group of the server")
+	server := flags.String("server", "", "server name")
+	dir := flags.String("dir", ".", "directory to download the log files into")
+	flags.Parse(args)
+	if *server == "" {
+		fmt.Println("Missing -server")
+		os.Exit(2)
+	}
+
+	files, err := listLogFiles(*group, *server)
+	onErrorFail(err, "List log files failed")
+	target := filepath.Join(*dir, *server)
+	onErrorFail(os.MkdirAll(target, 0755), "Create download directory failed")
+	for _, logFile := range files {
+		name := filepath.Join(target, logFileName(logFile))
+		fmt.Printf("Downloading %s\n", name)
+		onErrorFail(downloadLogFile(logFile, name), "Download failed")
+	}
+	fmt.Printf("Downloaded %d log files to %s\n", len(files), target)
+}
+
+func runLogsReport(args []string) {
+	flags := newFlagSet("logs report")
+	prefix := flags.String("prefix", defaultLogLinePrefix, "log_line_prefix the server was configured with")
+	format := flags.String("format", "text", "report format: text, json or html")
+	top := flags.Int("top", 10, "number of slow queries to report")
+	minDuration := flags.Float64("min-duration", 0, "ignore statements faster than this many milliseconds")
+	output := flags.String("o", "", "write the report to this file instead of stdout")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Println("Usage: logs report [flags] <file or directory>...")
+		os.Exit(2)
+	}
+
+	files, err := logFilesIn(flags.Args())
+	onErrorFail(err, "Finding log files failed")
+	entries, err := parseLogFiles(files, *prefix)
+	onErrorFail(err, "Parsing log files failed")
+	report := buildLogReport(files, entries, *top, *minDuration)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		onErrorFail(err, "Create report file failed")
+		defer f.Close()
+		w = f
+	}
+	onErrorFail(writeLogReport(w, report, *format), "Writing report failed")
+}
+
+// listLogFiles returns the log files of a server
+func listLogFiles(resourceGroup string, serverName string) ([]postgresql.LogFile, error) {
+	result, err := logFilesClient.ListByServer(resourceGroup, serverName)
+	if err != nil {
+		return nil, err
+	}
+	if result.Value == nil {
+		return nil, nil
+	}
+	var files []postgresql.LogFile
+	for _, logFile := range *result.Value {
+		// a file without a name can not be downloaded or shipped
+		if logFileName(logFile) != "" {
+			files = append(files, logFile)
+		}
+	}
+	return files, nil
+}
+
+// logFileName returns the file name of a log file, e.g. postgresql-2017-09-26_180000.log,
+// "" if it has none
+func logFileName(logFile postgresql.LogFile) string {
+	if logFile.LogFileProperties != nil && logFile.LogFileProperties.Name != nil {
+		return filepath.Base(*logFile.LogFileProperties.Name)
+	}
+	if logFile.Name != nil {
+		return filepath.Base(*logFile.Name)
+	}
+	return ""
+}
+
+// openLogFile opens the log file from its (SAS) url, skipping the first offset bytes
+func openLogFile(logFile postgresql.LogFile, offset int64) (io.ReadCloser, error) {
+	if logFile.LogFileProperties == nil || logFile.URL == nil {
+		return nil, fmt.Errorf("Log file %s has no url", logFileName(logFile))
+	}
+	req, err := http.NewRequest(http.MethodGet, *logFile.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	expected := http.StatusOK
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		expected = http.StatusPartialContent
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// nothing was written past offset
+		resp.Body.Close()
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	if resp.StatusCode != expected {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Expected HTTP status code %v but got status code:%v status:%s", expected, resp.StatusCode, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// downloadLogFile fetches the log file into the named file
+func downloadLogFile(logFile postgresql.LogFile, name string) error {
+	body, err := openLogFile(logFile, 0)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
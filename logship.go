@@ -0,0 +1,318 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - ships the files from LogFilesClient.ListByServer into a blob container so they
+//   can be kept longer than the service keeps them
+// - blobs are named <server>/<yyyy>/<mm>/<dd>/<log file name>
+// - "block" mode uploads whole files as block blobs, "append" mode appends the
+//   growth of a file to an append blob
+// - what was uploaded is tracked in a state file so files are not shipped twice; a blob
+//   is never switched between block and append, the state or the blob type refuses it
+// - storage credentials are read from AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_ACCESS_KEY,
+//   -emulator uses the local storage emulator (or a stand-in) on 127.0.0.1:10000
+//
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+const (
+	logShipModeBlock  = "block"
+	logShipModeAppend = "append"
+
+	// maximum size of a block sent with PutBlock or AppendBlock
+	logShipChunkSize = 4 * 1024 * 1024
+)
+
+func init() {
+	registerCommand(command{
+		name:         "logs ship",
+		summary:      "upload server log files into Azure Blob storage",
+		needsClients: true,
+		run:          runLogsShip,
+	})
+}
+
+func runLogsShip(args []string) {
+	flags := newFlagSet("logs ship")
+	group := flags.String("resource-group", resourceGroupName, "resource group of the server")
+	server := flags.String("server", "", "server name")
+	account := flags.String("account", os.Getenv("AZURE_STORAGE_ACCOUNT"), "storage account name")
+	key := flags.String("key", os.Getenv("AZURE_STORAGE_ACCESS_KEY"), "storage account key")
+	emulator := flags.Bool("emulator", false, "use the local storage emulator instead of an account")
+	containerName := flags.String("container", "postgresql-logs", "blob container, created if missing")
+	mode := flags.String("mode", logShipModeBlock, "block: upload whole files, append: append new data to append blobs")
+	statePath := flags.String("state", "", "upload state file (default .logship-<server>.json)")
+	interval := flags.Duration("interval", 0, "keep shipping at this interval instead of running once")
+	flags.Parse(args)
+	if *server == "" {
+		fmt.Println("Missing -server")
+		os.Exit(2)
+	}
+	if *mode != logShipModeBlock && *mode != logShipModeAppend {
+		fmt.Printf("Unknown -mode %s, expected %s or %s\n", *mode, logShipModeBlock, logShipModeAppend)
+		os.Exit(2)
+	}
+	if *statePath == "" {
+		*statePath = ".logship-" + *server + ".json"
+	}
+
+	var client storage.Client
+	var err error
+	if *emulator {
+		client, err = storage.NewEmulatorClient()
+	} else {
+		client, err = storage.NewBasicClient(*account, *key)
+	}
+	onErrorFail(err, "Creating storage client failed")
+	blobService := client.GetBlobService()
+	container := blobService.GetContainerReference(*containerName)
+	_, err = container.CreateIfNotExists(nil)
+	onErrorFail(err, "Creating container failed")
+
+	state, err := loadLogShipState(*statePath)
+	onErrorFail(err, "Reading upload state failed")
+
+	shipper := logShipper{container: container, mode: *mode, state: state}
+	for {
+		files, err := listLogFiles(*group, *server)
+		onErrorFail(err, "List log files failed")
+		uploaded, err := shipper.ship(*server, files)
+		onErrorFail(err, "Shipping logs failed")
+		fmt.Printf("Shipped %d of %d log files to %s\n", uploaded, len(files), *containerName)
+		if *interval <= 0 {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// shippedLogFile records how much of a log file was uploaded to which blob
+type shippedLogFile struct {
+	Blob         string    `json:"blob"`
+	Mode         string    `json:"mode"`
+	Bytes        int64     `json:"bytes"`
+	LastModified time.Time `json:"lastModified"`
+	ShippedAt    time.Time `json:"shippedAt"`
+}
+
+// logShipState is the upload state persisted between runs, keyed by blob name
+type logShipState struct {
+	path  string
+	Files map[string]*shippedLogFile `json:"files"`
+}
+
+func loadLogShipState(name string) (*logShipState, error) {
+	state := &logShipState{path: name, Files: map[string]*shippedLogFile{}}
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if state.Files == nil {
+		state.Files = map[string]*shippedLogFile{}
+	}
+	return state, nil
+}
+
+// save writes the state through a temporary file so an interrupted run never leaves it truncated
+func (s *logShipState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// logShipper uploads log files into a container
+type logShipper struct {
+	container *storage.Container
+	mode      string
+	state     *logShipState
+}
+
+// logBlobName partitions blobs by server and the day the log file was created
+func logBlobName(serverName string, logFile postgresql.LogFile) string {
+	day := time.Now().UTC()
+	if p := logFile.LogFileProperties; p != nil {
+		if p.CreatedTime != nil {
+			day = p.CreatedTime.UTC()
+		} else if p.LastModifiedTime != nil {
+			day = p.LastModifiedTime.UTC()
+		}
+	}
+	return path.Join(serverName, day.Format("2006/01/02"), logFileName(logFile))
+}
+
+func logFileLastModified(logFile postgresql.LogFile) time.Time {
+	if logFile.LogFileProperties == nil || logFile.LastModifiedTime == nil {
+		return time.Time{}
+	}
+	return logFile.LastModifiedTime.UTC()
+}
+
+// ship uploads new and changed log files and returns how many were uploaded
+func (s *logShipper) ship(serverName string, files []postgresql.LogFile) (int, error) {
+	uploaded := 0
+	for _, logFile := range files {
+		name := logBlobName(serverName, logFile)
+		lastModified := logFileLastModified(logFile)
+		shipped, ok := s.state.Files[name]
+		if ok && shipped.Mode != s.mode {
+			// block and append blobs can not be written the other way
+			return uploaded, fmt.Errorf("%s was shipped as a %s blob, ship it with -mode %s or into another -container", name, shipped.Mode, shipped.Mode)
+		}
+		if ok && !lastModified.IsZero() && !lastModified.After(shipped.LastModified) {
+			continue
+		}
+		if !ok {
+			shipped = &shippedLogFile{Blob: name, Mode: s.mode}
+			s.state.Files[name] = shipped
+		}
+
+		var err error
+		var changed bool
+		switch s.mode {
+		case logShipModeAppend:
+			changed, err = s.appendLogFile(logFile, shipped)
+		default:
+			changed, err = s.uploadLogFile(logFile, shipped)
+		}
+		if err != nil {
+			return uploaded, fmt.Errorf("%s: %v", name, err)
+		}
+		shipped.LastModified = lastModified
+		if changed {
+			shipped.ShippedAt = time.Now().UTC()
+			uploaded++
+			fmt.Printf("Shipped %s (%d bytes)\n", name, shipped.Bytes)
+		}
+		if err := s.state.save(); err != nil {
+			return uploaded, err
+		}
+	}
+	return uploaded, nil
+}
+
+// uploadLogFile replaces the block blob with the whole log file
+func (s *logShipper) uploadLogFile(logFile postgresql.LogFile, shipped *shippedLogFile) (bool, error) {
+	body, err := openLogFile(logFile, 0)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	blob := s.container.GetBlobReference(shipped.Blob)
+	blob.Properties.ContentType = "text/plain"
+	var blocks []storage.Block
+	var size int64
+	chunk := make([]byte, logShipChunkSize)
+	for {
+		n, err := io.ReadFull(body, chunk)
+		if n > 0 {
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(blocks))))
+			if err := blob.PutBlock(id, chunk[:n], nil); err != nil {
+				return false, err
+			}
+			blocks = append(blocks, storage.Block{ID: id, Status: storage.BlockStatusUncommitted})
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if err := blob.PutBlockList(blocks, nil); err != nil {
+		return false, err
+	}
+	shipped.Bytes = size
+	return true, nil
+}
+
+// appendLogFile appends whatever was written to the log file since the last upload
+func (s *logShipper) appendLogFile(logFile postgresql.LogFile, shipped *shippedLogFile) (bool, error) {
+	blob := s.container.GetBlobReference(shipped.Blob)
+	exists, err := blob.Exists()
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		blob.Properties.ContentType = "text/plain"
+		if err := blob.PutAppendBlob(nil); err != nil {
+			return false, err
+		}
+		shipped.Bytes = 0
+	} else {
+		// the blob is the source of truth, it may be ahead of a lost or stale state file
+		if err := blob.GetProperties(nil); err != nil {
+			return false, err
+		}
+		if blob.Properties.BlobType != storage.BlobTypeAppend {
+			return false, fmt.Errorf("%s is a %s, not an append blob; ship it with -mode %s or into another -container", shipped.Blob, blob.Properties.BlobType, logShipModeBlock)
+		}
+		shipped.Bytes = blob.Properties.ContentLength
+	}
+
+	body, err := openLogFile(logFile, shipped.Bytes)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	changed := false
+	chunk := make([]byte, logShipChunkSize)
+	for {
+		n, err := io.ReadFull(body, chunk)
+		if n > 0 {
+			// the append position condition makes a concurrent or repeated upload fail instead of duplicating data
+			position := uint(shipped.Bytes)
+			if err := blob.AppendBlock(chunk[:n], &storage.AppendBlockOptions{AppendPosition: &position}); err != nil {
+				return changed, err
+			}
+			shipped.Bytes += int64(n)
+			changed = true
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return changed, nil
+		}
+		if err != nil {
+			return changed, err
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// blobStandIn is enough of the blob service for the shipper, plus the log file urls
+type blobStandIn struct {
+	mu     sync.Mutex
+	blobs  map[string]*standInBlob
+	blocks map[string][]byte
+	logs   map[string]string
+}
+
+type standInBlob struct {
+	blobType storage.BlobType
+	data     []byte
+}
+
+var blockListIDRegexp = regexp.MustCompile(`<(?:Uncommitted|Committed|Latest)>([^<]+)<`)
+
+func (s *blobStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/logs/") {
+		data := s.logs[strings.TrimPrefix(r.URL.Path, "/logs/")]
+		if rng := r.Header.Get("Range"); rng != "" {
+			offset, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.WriteHeader(http.StatusPartialContent)
+			fmt.Fprint(w, data[offset:])
+			return
+		}
+		fmt.Fprint(w, data)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	blob := s.blobs[r.URL.Path]
+	switch {
+	case r.Method == http.MethodHead:
+		if blob == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("x-ms-blob-type", string(blob.blobType))
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob.data)))
+		w.WriteHeader(http.StatusOK)
+	case r.URL.Query().Get("comp") == "block":
+		s.blocks[r.URL.Path+"/"+r.URL.Query().Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Query().Get("comp") == "blocklist":
+		if blob != nil && blob.blobType != storage.BlobTypeBlock {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		var data []byte
+		for _, m := range blockListIDRegexp.FindAllStringSubmatch(string(body), -1) {
+			data = append(data, s.blocks[r.URL.Path+"/"+m[1]]...)
+		}
+		s.blobs[r.URL.Path] = &standInBlob{blobType: storage.BlobTypeBlock, data: data}
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Query().Get("comp") == "appendblock":
+		if blob == nil || blob.blobType != storage.BlobTypeAppend {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if pos := r.Header.Get("x-ms-blob-condition-appendpos"); pos != "" && pos != strconv.Itoa(len(blob.data)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		blob.data = append(blob.data, body...)
+		w.WriteHeader(http.StatusCreated)
+	case r.Header.Get("x-ms-blob-type") == string(storage.BlobTypeAppend):
+		s.blobs[r.URL.Path] = &standInBlob{blobType: storage.BlobTypeAppend}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// content returns the data of a blob of the test container
+func (s *blobStandIn) content(name string) (storage.BlobType, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob := s.blobs["/"+storage.StorageEmulatorAccountName+"/logs/"+name]
+	if blob == nil {
+		return "", ""
+	}
+	return blob.blobType, string(blob.data)
+}
+
+// redirect sends the requests of the emulator client to the stand-in
+type redirect struct {
+	target *url.URL
+}
+
+func (r redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = r.target.Scheme
+	req.URL.Host = r.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestShipper returns a shipper into container "logs" of a stand-in
+func newTestShipper(t *testing.T, mode string) (*logShipper, *blobStandIn, *httptest.Server) {
+	standIn := &blobStandIn{blobs: map[string]*standInBlob{}, blocks: map[string][]byte{}, logs: map[string]string{}}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL)
+
+	client, err := storage.NewEmulatorClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.HTTPClient = &http.Client{Transport: redirect{target}}
+	blobService := client.GetBlobService()
+	state, err := loadLogShipState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &logShipper{container: blobService.GetContainerReference("logs"), mode: mode, state: state}, standIn, server
+}
+
+func testLogFile(server *httptest.Server, name string, created time.Time, modified time.Time) postgresql.LogFile {
+	return postgresql.LogFile{
+		Name: to.StringPtr(name),
+		LogFileProperties: &postgresql.LogFileProperties{
+			Name:             to.StringPtr(name),
+			CreatedTime:      &date.Time{Time: created},
+			LastModifiedTime: &date.Time{Time: modified},
+			URL:              to.StringPtr(server.URL + "/logs/" + name),
+		},
+	}
+}
+
+func TestShipBlockMode(t *testing.T) {
+	shipper, standIn, server := newTestShipper(t, logShipModeBlock)
+	created := time.Date(2017, 9, 26, 18, 0, 0, 0, time.UTC)
+	standIn.logs["postgresql-2017-09-26_180000.log"] = "first line\n"
+	files := []postgresql.LogFile{testLogFile(server, "postgresql-2017-09-26_180000.log", created, created.Add(time.Minute))}
+
+	uploaded, err := shipper.ship("srv", files)
+	if err != nil || uploaded != 1 {
+		t.Fatalf("ship = %d, %v", uploaded, err)
+	}
+	if blobType, data := standIn.content("srv/2017/09/26/postgresql-2017-09-26_180000.log"); blobType != storage.BlobTypeBlock || data != "first line\n" {
+		t.Errorf("blob is %s %q", blobType, data)
+	}
+
+	// unchanged files are skipped, changed ones replaced
+	if uploaded, err := shipper.ship("srv", files); err != nil || uploaded != 0 {
+		t.Fatalf("second ship = %d, %v", uploaded, err)
+	}
+	standIn.logs["postgresql-2017-09-26_180000.log"] = "first line\nsecond line\n"
+	files[0].LastModifiedTime = &date.Time{Time: created.Add(2 * time.Minute)}
+	if uploaded, err := shipper.ship("srv", files); err != nil || uploaded != 1 {
+		t.Fatalf("third ship = %d, %v", uploaded, err)
+	}
+	if _, data := standIn.content("srv/2017/09/26/postgresql-2017-09-26_180000.log"); data != "first line\nsecond line\n" {
+		t.Errorf("blob is %q", data)
+	}
+}
+
+func TestShipAppendMode(t *testing.T) {
+	shipper, standIn, server := newTestShipper(t, logShipModeAppend)
+	created := time.Date(2017, 9, 26, 18, 0, 0, 0, time.UTC)
+	standIn.logs["postgresql-2017-09-26_180000.log"] = "first line\n"
+	files := []postgresql.LogFile{testLogFile(server, "postgresql-2017-09-26_180000.log", created, created.Add(time.Minute))}
+
+	if uploaded, err := shipper.ship("srv", files); err != nil || uploaded != 1 {
+		t.Fatalf("ship = %d, %v", uploaded, err)
+	}
+	standIn.logs["postgresql-2017-09-26_180000.log"] = "first line\nsecond line\n"
+	files[0].LastModifiedTime = &date.Time{Time: created.Add(2 * time.Minute)}
+	if uploaded, err := shipper.ship("srv", files); err != nil || uploaded != 1 {
+		t.Fatalf("second ship = %d, %v", uploaded, err)
+	}
+	blobType, data := standIn.content("srv/2017/09/26/postgresql-2017-09-26_180000.log")
+	if blobType != storage.BlobTypeAppend || data != "first line\nsecond line\n" {
+		t.Errorf("blob is %s %q", blobType, data)
+	}
+	if shipped := shipper.state.Files["srv/2017/09/26/postgresql-2017-09-26_180000.log"]; shipped.Bytes != int64(len(data)) {
+		t.Errorf("state has %d bytes, blob %d", shipped.Bytes, len(data))
+	}
+}
+
+func TestShipRefusesModeSwitch(t *testing.T) {
+	shipper, standIn, server := newTestShipper(t, logShipModeBlock)
+	created := time.Date(2017, 9, 26, 18, 0, 0, 0, time.UTC)
+	standIn.logs["postgresql-2017-09-26_180000.log"] = "first line\n"
+	files := []postgresql.LogFile{testLogFile(server, "postgresql-2017-09-26_180000.log", created, created.Add(time.Minute))}
+	if _, err := shipper.ship("srv", files); err != nil {
+		t.Fatal(err)
+	}
+
+	// from the state file
+	shipper.mode = logShipModeAppend
+	files[0].LastModifiedTime = &date.Time{Time: created.Add(2 * time.Minute)}
+	if _, err := shipper.ship("srv", files); err == nil || !strings.Contains(err.Error(), "-mode block") {
+		t.Errorf("append over the state of a block blob: %v", err)
+	}
+
+	// from the blob type when the state was lost
+	shipper.state.Files = map[string]*shippedLogFile{}
+	if _, err := shipper.ship("srv", files); err == nil || !strings.Contains(err.Error(), "not an append blob") {
+		t.Errorf("append to a block blob: %v", err)
+	}
+	if _, data := standIn.content("srv/2017/09/26/postgresql-2017-09-26_180000.log"); data != "first line\n" {
+		t.Errorf("blob changed to %q", data)
+	}
+}
@@ -17,21 +17,39 @@ package main
 //
 // Notes:
 // - in preview most properties can not be changed and only Basic SKU can be used
-// - need to have provider registered:
-//   az provider register --namespace Microsoft.DBforPostgreSQL
+// - bootstrap (see bootstrap.go) checks the Microsoft.DBforPostgreSQL provider is registered,
+//   registering it only with -register-provider, and creates the resource group if missing
 // - service instance parameters are hard coded as vars
 // - credentials are read from environment
+// - administrator passwords set by createServer and updateAdministratorPassword are
+//   stored in the secret store named by SECRET_STORE, if set
+// - resources created by the sample flow are deleted again when it fails or is
+//   interrupted, unless it is run with -keep-on-failure
+// - createServer checks tier, compute units and storage against the SKU catalog in skus.go
+// - createServer sets the tags given with -tag, checked against the tag policy named by
+//   TAG_POLICY, if set (see tags.go)
+// - with -alerts the alert rules of an alert profile are created with the server (see alerts.go)
+// - createServer refuses to touch an existing server, so a rollback only deletes servers it created
+// - servers created by createServer carry an expires-at tag, the janitor command
+//   deletes them once it has passed
+// - deleteServer refuses protected servers and asks for confirmation (see protect.go)
 //
 
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/arm/monitor"
 	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/locks"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
@@ -46,9 +64,26 @@ var (
 	administratorLogin         = "azadmin"
 	administratorLoginPassword = "Welcome1234"
 
+	// subscription and credentials the clients were created with
+	armSubscriptionID string
+	armAuthorizer     *autorest.BearerAuthorizer
+	// tenant and client of the credentials, and the account name when logged in with login
+	armTenantID string
+	armClientID string
+	armAccount  string
+
 	// resource clients
 	serversClient       postgresql.ServersClient
 	firewallRulesClient postgresql.FirewallRulesClient
+	databasesClient     postgresql.DatabasesClient
+	logFilesClient      postgresql.LogFilesClient
+	providersClient     resources.ProvidersClient
+	groupsClient        resources.GroupsClient
+	locksClient         locks.ManagementLocksClient
+	monitorClient       monitor.ManagementClient
+
+	// where generated credentials are kept, from SECRET_STORE; nil if not set
+	secretStore SecretStore
 )
 
 const (
@@ -65,13 +100,58 @@ type pollingStatus struct {
 }
 
 func main() {
-
-	// storage sizes
+	var debug bool
+	if os.Args, debug = stripDebugFlag(os.Args); debug {
+		var err error
+		debugLogger, err = newRequestLogger(os.Stderr)
+		onErrorFail(err, "Enabling --debug failed")
+	}
+	onErrorFail(enableTelemetry(), "Enabling telemetry failed")
+	if len(os.Args) > 1 && (!strings.HasPrefix(os.Args[1], "-") || os.Args[1] == "-h" || os.Args[1] == "--help") {
+		runCommand(os.Args[1:])
+		return
+	}
+	keepOnFailure := flag.Bool("keep-on-failure", false, "keep the resources created so far when the sample fails")
+	registerProvider := flag.Bool("register-provider", false, "register "+postgresqlProviderNamespace+" if it is not registered")
+	var tags stringsFlag
+	flag.Var(&tags, "tag", "tag key=value set on the created server (repeatable)")
+	alerts := flag.String("alerts", "", "alert profile (file or default) applied to the created server, see alerts.go")
+	diagnostics := &diagnosticsSpec{}
+	flag.StringVar(&diagnostics.storageAccountID, "diagnostics-storage-account", "", "resource id of the storage account server logs and metrics are archived to, see diagnostics.go")
+	flag.StringVar(&diagnostics.workspaceID, "diagnostics-workspace", "", "resource id of the Log Analytics workspace server logs and metrics are sent to")
+	diagnosticsRetention := flag.Int("diagnostics-retention-days", 0, "days logs and metrics are kept in the storage account (default forever)")
+	sampleServerName := flag.String("server-name", "async-test-"+time.Now().UTC().Format(dateFormat), "name of the created server, fixed names let a recorded run be replayed")
+	flag.Parse()
+	diagnostics.retentionDays = int32(*diagnosticsRetention)
+	initClients()
+	if !diagnostics.empty() {
+		onErrorFail(diagnostics.checkTargets(), "Invalid diagnostics target")
+	}
+	var optionalActions []string
+	if *registerProvider {
+		optionalActions = append(optionalActions, actionProviderRegister)
+	}
+	if *alerts != "" {
+		optionalActions = append(optionalActions, actionAlertRulesWrite)
+	}
+	if !diagnostics.empty() {
+		optionalActions = append(optionalActions, actionDiagnosticsWrite)
+	}
+	requirePermissions(sampleCommand, []string{resourceGroupName}, optionalActions...)
+	txn := beginTransaction(*keepOnFailure)
+	err := bootstrap(bootstrapOptions{
+		resourceGroup:    resourceGroupName,
+		location:         location,
+		registerProvider: *registerProvider,
+	})
+	onErrorFail(err, "Bootstrap failed")
+
+	// storage sizes, see the catalog in skus.go
 	// default 0 -> 50 GB
 	// 179200 MB -> 175 GB
 	// 307200 MB ->300 GB
-	var serverName = "async-test-" + time.Now().UTC().Format(dateFormat)
-	pollingURL, createServerErr := createServer(resourceGroupName, serverName, location, administratorLogin, administratorLoginPassword, postgresql.NineFullStopFive, postgresql.Basic, 50, 179200)
+	var serverName = *sampleServerName
+	pollingURL, credentialVersion, createServerErr := createServer(resourceGroupName, serverName, location, administratorLogin, administratorLoginPassword, postgresql.NineFullStopFive, postgresql.Basic, 50, 179200, parseTags(tags))
 	if createServerErr != nil {
 		onErrorFail(createServerErr, "Error creating server")
 	}
@@ -98,11 +178,34 @@ func main() {
 	}
 	fmt.Println()
 	fmt.Printf("Polling complete with [status:%s][pollingCount:%v]\n", pollingResult, pollingCount)
+	if pollingResult != "Succeeded" {
+		onErrorFail(fmt.Errorf("create ended with status %s", pollingResult), "Error creating server")
+	}
+	err = setCredentialStatus(secretStore, resourceGroupName, serverName, credentialVersion, credentialActive)
+	onErrorFail(err, "Marking the administrator password active failed")
+	if *alerts != "" {
+		profile, err := loadAlertProfile(*alerts)
+		onErrorFail(err, "Reading alert profile failed")
+		server, err := serversClient.Get(resourceGroupName, serverName)
+		onErrorFail(err, "Get server details failed")
+		onErrorFail(applyAlerts(resourceGroupName, server, profile), "Applying alerts failed")
+	}
+	if !diagnostics.empty() {
+		server, err := serversClient.Get(resourceGroupName, serverName)
+		onErrorFail(err, "Get server details failed")
+		result := applyDiagnostics(server, diagnostics, false)
+		if result.Error != "" {
+			onErrorFail(errors.New(result.Error), "Applying diagnostic settings failed")
+		}
+		fmt.Printf("Diagnostic settings of %s: %s\n", serverName, result.Result)
+	}
+	txn.commit()
+	beforeExit()
 	os.Exit(0)
 
 	//createFirewallRule(resourceGroupName, "dar-95-50-175", "all", "0.0.0.0", "255.255.255.255")
 
-	//createServer(resourceGroupName, "dar-96-100-300", location, administratorLogin, administratorLoginPassword, postgresql.NineFullStopSix, postgresql.Basic, 100, 307200)
+	//createServer(resourceGroupName, "dar-96-100-300", location, administratorLogin, administratorLoginPassword, postgresql.NineFullStopSix, postgresql.Basic, 100, 307200, nil)
 	//createFirewallRule(resourceGroupName, "dar-96-100-300", "myip", "0.0.0.0", "255.255.255.255")
 
 	wait("check logins ... then press Enter")
@@ -119,14 +222,15 @@ func main() {
 	restoreServer(resourceGroupName, "dar-95-50-175", resourceGroupName, "dar-95-50-175-restored", restorePoint)
 	wait("check backup server ... then Enter to delete servers")
 
-	deleteServer(resourceGroupName, "dar-95-50-175")
-	deleteServer(resourceGroupName, "dar-95-50-175-restored")
-	deleteServer(resourceGroupName, "dar-96-100-300")
+	deleteServer(resourceGroupName, "dar-95-50-175", "")
+	deleteServer(resourceGroupName, "dar-95-50-175-restored", "")
+	deleteServer(resourceGroupName, "dar-96-100-300", "")
 
 	fmt.Println("Done")
 }
 
-// createServer creates a server
+// createServer starts creating a server and returns the url to poll and the version of the
+// stored administrator password, which is pending until the creation succeeded
 func createServer(
 	resourceGroup string,
 	serverName string,
@@ -137,9 +241,21 @@ func createServer(
 	serverTier postgresql.SkuTier,
 	computeUnits int32, //optional
 	storageMB int64, // optional
-) (string, error) {
-
-	fmt.Println("Creating server:" + resourceGroupName + "/" + serverName)
+	tags map[string]string,
+) (string, int, error) {
+
+	fmt.Println("Creating server:" + resourceGroup + "/" + serverName)
+	// an expires-at given with -tag wins over the default lifetime
+	serverTags := mergeTags(map[string]string{
+		expiresAtTag: time.Now().UTC().Add(testServerLifetime).Format(time.RFC3339),
+	}, tags, nil)
+	if err := serverTagPolicy.check(serverTags); err != nil {
+		return "", 0, err
+	}
+	sku, storageMB, err := resolveSku(serverVersion, serverTier, computeUnits, storageMB)
+	if err != nil {
+		return "", 0, err
+	}
 	spfdc := postgresql.ServerPropertiesForDefaultCreate{
 		AdministratorLogin:         to.StringPtr(administratorLogin),
 		AdministratorLoginPassword: to.StringPtr(administratorLoginPassword),
@@ -154,27 +270,35 @@ func createServer(
 
 		Location:   to.StringPtr(location),
 		Properties: properties,
-		Sku: &postgresql.Sku{
-			Name:     to.StringPtr("SkuName"),
-			Tier:     postgresql.Basic,
-			Capacity: to.Int32Ptr(computeUnits),
-		},
-		Tags: &map[string]*string{
-			"Tag1": to.StringPtr("1"),
-		},
+		Sku:        sku,
+		Tags:       toTagPtrs(serverTags),
 	}
 
-	responseChannel, errChannel := serversClient.CreateOrUpdate(resourceGroupName, serverName, serverForCreate, nil)
-	err := <-errChannel
+	// CreateOrUpdate would update an existing server, which a rollback would then delete
+	if _, err := serversClient.Get(resourceGroup, serverName); err == nil {
+		return "", 0, fmt.Errorf("Server %s/%s already exists.\nRemediation: choose another -server-name", resourceGroup, serverName)
+	} else if statusCode, _ := armError(err); statusCode != http.StatusNotFound {
+		return "", 0, withRemediation(err, "checking server "+serverName)
+	}
+	version, err := storeNewCredential(secretStore, resourceGroup, serverName, administratorLogin, administratorLoginPassword)
+	if err != nil {
+		return "", 0, err
+	}
+	activeTransaction.recordCredential(resourceGroup, serverName, version)
+	responseChannel, errChannel := serversClient.CreateOrUpdate(resourceGroup, serverName, serverForCreate, nil)
+	err = <-errChannel
 	if err != nil {
-		return "", err
+		setCredentialStatus(secretStore, resourceGroup, serverName, version, credentialFailed)
+		return "", 0, err
 	}
 	response := <-responseChannel
 	if response.StatusCode != http.StatusAccepted {
-		return "", fmt.Errorf("Expected HTTP status code %v but got status code:%v status:%s", http.StatusAccepted, response.StatusCode, response.Status)
+		setCredentialStatus(secretStore, resourceGroup, serverName, version, credentialFailed)
+		return "", 0, fmt.Errorf("Expected HTTP status code %v but got status code:%v status:%s", http.StatusAccepted, response.StatusCode, response.Status)
 	}
+	activeTransaction.recordServer(resourceGroup, serverName)
 	asyncPollingURL := getAsyncPollingURL(response.Response)
-	return asyncPollingURL, nil
+	return asyncPollingURL, version, nil
 }
 
 // restore creates server from point-in-time state of source server
@@ -262,14 +386,39 @@ func createFirewallRule(
 	if err != nil {
 		onErrorFail(err, "firewall create failed")
 	}
+	activeTransaction.recordFirewallRule(resourceGroup, serverName, firewallRuleName)
 	fmt.Println("Creating firewall rule done")
 }
 
-// deleteServer deletes a server
-func deleteServer(resourceGroupName string, serverName string) {
+// createDatabase creates a database on a server
+func createDatabase(resourceGroup string, serverName string, databaseName string) {
+	database := postgresql.Database{
+		DatabaseProperties: &postgresql.DatabaseProperties{
+			Charset:   to.StringPtr("UTF8"),
+			Collation: to.StringPtr("English_United States.1252"),
+		},
+	}
+	fmt.Printf("Creating database %s/%s %s\n", resourceGroup, serverName, databaseName)
+	_, errChannel := databasesClient.CreateOrUpdate(resourceGroup, serverName, databaseName, database, nil)
+	err := <-errChannel
+	if err != nil {
+		onErrorFail(err, "database create failed")
+	}
+	activeTransaction.recordDatabase(resourceGroup, serverName, databaseName)
+	fmt.Println("Creating database done")
+}
+
+// deleteServer deletes a server unless it is protected (see protect.go).
+// confirm is the server name given with -confirm, if empty the user is asked.
+func deleteServer(resourceGroupName string, serverName string, confirm string) {
+	server, err := serversClient.Get(resourceGroupName, serverName)
+	onErrorFail(err, "Get server details failed")
+	onErrorFail(checkDeletionAllowed(resourceGroupName, server), "Delete refused")
+	onErrorFail(confirmDestructive("Delete server "+resourceGroupName+"/"+serverName, serverName, confirm), "Delete not confirmed")
+
 	fmt.Println("Delete server:" + resourceGroupName + "/" + serverName)
 	responseChannel, errChannel := serversClient.Delete(resourceGroupName, serverName, nil)
-	err := <-errChannel
+	err = <-errChannel
 	if err != nil {
 		onErrorFail(err, "Delete failed")
 	}
@@ -281,6 +430,21 @@ func deleteServer(resourceGroupName string, serverName string) {
 func updateAdministratorPassword(resourceGroupName string, serverName string, newPassword string) {
 	fmt.Println("changing password:" + resourceGroupName + "/" + serverName)
 
+	version, err := storeNewCredential(secretStore, resourceGroupName, serverName, administratorLogin, newPassword)
+	onErrorFail(err, "Storing new password failed")
+	server, err := setAdministratorPassword(serversClient, resourceGroupName, serverName, newPassword)
+	if err != nil {
+		setCredentialStatus(secretStore, resourceGroupName, serverName, version, credentialUnverified)
+		onErrorFail(err, "Create failed")
+	}
+	err = setCredentialStatus(secretStore, resourceGroupName, serverName, version, credentialActive)
+	onErrorFail(err, "Marking new password active failed")
+	fmt.Printf("Parameter update done. Response: %s \n", toJSON(server))
+
+}
+
+// setAdministratorPassword changes the administrator password and waits for the update to complete
+func setAdministratorPassword(client postgresql.ServersClient, resourceGroupName string, serverName string, newPassword string) (postgresql.Server, error) {
 	serverUpdateParametersProperties := postgresql.ServerUpdateParametersProperties{
 		AdministratorLoginPassword: to.StringPtr(newPassword),
 	}
@@ -288,14 +452,10 @@ func updateAdministratorPassword(resourceGroupName string, serverName string, ne
 	serverUpdateParameters := postgresql.ServerUpdateParameters{}
 	serverUpdateParameters.ServerUpdateParametersProperties = &serverUpdateParametersProperties
 
-	serverChannel, errChannel := serversClient.Update(resourceGroupName, serverName, serverUpdateParameters, nil)
+	serverChannel, errChannel := client.Update(resourceGroupName, serverName, serverUpdateParameters, nil)
 	err := <-errChannel
-	if err != nil {
-		onErrorFail(err, "Create failed")
-	}
 	server := <-serverChannel
-	fmt.Printf("Parameter update done. Response: %s \n", toJSON(server))
-
+	return server, err
 }
 
 // getEnvVarOrExit returns the value of specified environment variable or terminates if it's not defined.
@@ -310,18 +470,87 @@ func getEnvVarOrExit(varName string) string {
 }
 
 // onErrorFail prints a failure message and exits the program if err is not nil.
-// it also deletes the resource group created in the sample
+// Resources recorded by the active transaction are deleted first (see rollback.go).
 func onErrorFail(err error, message string) {
 	if err != nil {
 		fmt.Printf("%s: %s\n", message, err)
+		activeTransaction.rollback(message)
+		beforeExit()
 		os.Exit(1)
 	}
 }
 
+// beforeExit exports telemetry and reports responses of a replayed cassette nobody asked for
+func beforeExit() {
+	flushTelemetry()
+	if armPlayer != nil {
+		if n := armPlayer.unplayed(); n > 0 {
+			fmt.Printf("Cassette %s has %d interactions that were not replayed\n", armPlayer.path, n)
+		}
+	}
+}
+
 func createClients(subscriptionID string, authorizer *autorest.BearerAuthorizer) {
-	serversClient = postgresql.NewServersClient(subscriptionID)
-	serversClient.Authorizer = authorizer
+	armSubscriptionID = subscriptionID
+	armAuthorizer = authorizer
+	serversClient = newServersClient(subscriptionID)
 	firewallRulesClient = postgresql.FirewallRulesClient(serversClient)
+	databasesClient = postgresql.DatabasesClient(serversClient)
+	logFilesClient = postgresql.LogFilesClient(serversClient)
+	providersClient = resources.NewProvidersClient(subscriptionID)
+	providersClient.Authorizer = authorizer
+	useARMSender(&providersClient.Client, subscriptionID)
+	groupsClient = resources.NewGroupsClient(subscriptionID)
+	groupsClient.Authorizer = authorizer
+	useARMSender(&groupsClient.Client, subscriptionID)
+	locksClient = locks.NewManagementLocksClient(subscriptionID)
+	locksClient.Authorizer = authorizer
+	useARMSender(&locksClient.Client, subscriptionID)
+	monitorClient = monitor.New(subscriptionID)
+	monitorClient.Authorizer = authorizer
+	useARMSender(&monitorClient.Client, subscriptionID)
+}
+
+// newServersClient creates a ServersClient for a subscription using the shared authorizer,
+// rate limiter and retry policy. The other postgresql clients are conversions of it so they
+// share its settings.
+func newServersClient(subscriptionID string) postgresql.ServersClient {
+	client := postgresql.NewServersClient(subscriptionID)
+	client.Authorizer = armAuthorizer
+	useARMSender(&client.Client, subscriptionID)
+	return client
+}
+
+// useARMSender makes a client send through the rate limiter of its subscription and the
+// retry policy, logging each attempt with --debug and measuring calls and attempts when
+// telemetry is on; the policy does the retries so autorest's own are turned off.
+// Recorded requests go through the cassette recorder, replayed ones skip the rate limiter.
+func useARMSender(client *autorest.Client, subscriptionID string) {
+	var sender autorest.Sender = &http.Client{}
+	if armPlayer != nil {
+		sender = armPlayer
+	}
+	decorators := []autorest.SendDecorator{}
+	if armRecorder != nil {
+		decorators = append(decorators, armRecorder.sendDecorator())
+	}
+	if debugLogger != nil {
+		decorators = append(decorators, debugLogger.sendDecorator())
+	}
+	if armTelemetry != nil {
+		decorators = append(decorators, armTelemetry.attemptDecorator())
+	}
+	if armPlayer == nil {
+		decorators = append(decorators, subscriptionRateLimiter(subscriptionID).sendDecorator())
+	}
+	decorators = append(decorators, armRetryPolicy.sendDecorator())
+	if armTelemetry != nil {
+		decorators = append(decorators, armTelemetry.callDecorator())
+	}
+	// autorest.Client.Do still waits RetryDuration after a last 408 or 5xx with no retries left
+	client.RetryAttempts = 0
+	client.RetryDuration = 0
+	client.Sender = autorest.DecorateSender(sender, decorators...)
 }
 
 func toJSON(v interface{}) string {
@@ -338,22 +567,64 @@ func wait(prompt string) {
 	reader.ReadString('\n')
 }
 
-// Create the clients
-func init() {
-	// credentials read from environment
-	subscriptionID := getEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
-	tenantID := getEnvVarOrExit("AZURE_TENANT_ID")
-
-	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, tenantID)
-	onErrorFail(err, "Error getting OAuth configuration")
-
-	clientID := getEnvVarOrExit("AZURE_CLIENT_ID")
-	clientSecret := getEnvVarOrExit("AZURE_CLIENT_SECRET")
-	spToken, err := adal.NewServicePrincipalToken(*oauthConfig, clientID, clientSecret, azure.PublicCloud.ResourceManagerEndpoint)
-	authorizer := autorest.NewBearerAuthorizer(spToken)
-	onErrorFail(err, "NewServicePrincipalToken failed")
+// initClients creates the clients using credentials read from the environment
+func initClients() {
+	var subscriptionID string
+	var authorizer *autorest.BearerAuthorizer
+	var err error
+	if name := os.Getenv("REPLAY_CASSETTE"); name != "" {
+		// answered from a recording, see cassette.go
+		armPlayer, err = loadCassette(name)
+		onErrorFail(err, "Reading cassette failed")
+		subscriptionID = cassetteSubscriptionID
+		authorizer = autorest.NewBearerAuthorizer(replayToken{})
+	} else if credential, err := accountCredentials(); err != nil || credential != nil {
+		// account signed in with login, see login.go
+		onErrorFail(err, "Using the logged in account failed")
+		subscriptionID = credential.subscriptionID
+		authorizer = autorest.NewBearerAuthorizer(credential.token)
+		armAccount = credential.name
+		armTenantID = credential.account.TenantID
+		armClientID = credential.account.ClientID
+	} else {
+		// credentials read from environment
+		subscriptionID = getEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
+		tenantID := getEnvVarOrExit("AZURE_TENANT_ID")
+
+		oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, tenantID)
+		onErrorFail(err, "Error getting OAuth configuration")
+
+		clientID := getEnvVarOrExit("AZURE_CLIENT_ID")
+		clientSecret := getEnvVarOrExit("AZURE_CLIENT_SECRET")
+		spToken, err := newCachedServicePrincipalToken(*oauthConfig, tenantID, clientID, clientSecret, azure.PublicCloud.ResourceManagerEndpoint)
+		onErrorFail(err, "NewServicePrincipalToken failed")
+		authorizer = autorest.NewBearerAuthorizer(spToken)
+		armTenantID = tenantID
+		armClientID = clientID
+	}
+	if name := os.Getenv("RECORD_CASSETTE"); name != "" {
+		armRecorder, err = newCassetteRecorder(name)
+		onErrorFail(err, "Creating cassette failed")
+	}
 
+	if name := os.Getenv("RETRY_POLICY"); name != "" {
+		armRetryPolicy, err = loadRetryPolicy(name)
+		onErrorFail(err, "Reading retry policy failed")
+	}
+	if spec := os.Getenv("ARM_RATE_LIMIT"); spec != "" {
+		readsPerHour, writesPerHour, err = parseRateLimit(spec)
+		onErrorFail(err, "Reading ARM_RATE_LIMIT failed")
+	}
 	createClients(subscriptionID, authorizer)
+
+	if spec := os.Getenv("SECRET_STORE"); spec != "" {
+		secretStore, err = newSecretStore(spec)
+		onErrorFail(err, "Creating secret store failed")
+	}
+	if name := os.Getenv("TAG_POLICY"); name != "" {
+		serverTagPolicy, err = loadTagPolicy(name)
+		onErrorFail(err, "Reading tag policy failed")
+	}
 }
 
 func getAsyncPollingURL(resp *http.Response) string {
@@ -0,0 +1,198 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - the cassettes in testdata follow the responses of the 2017-04-30-preview API; they were
+//   written by hand, record them again with RECORD_CASSETTE to refresh them
+// - onErrorFail exits, so a request a cassette has no answer for ends the test binary
+//
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// replayCassette creates the clients answered from testdata/name with a secret store in a
+// temporary directory
+func replayCassette(t *testing.T, name string) {
+	t.Setenv("REPLAY_CASSETTE", filepath.Join("testdata", name))
+	t.Setenv("RECORD_CASSETTE", "")
+	t.Setenv("SECRET_STORE", "files:"+t.TempDir())
+	t.Setenv("TAG_POLICY", "")
+	t.Setenv("RETRY_POLICY", "")
+	t.Setenv("ARM_RATE_LIMIT", "")
+	initClients()
+	// the recorded operations were polled with a delay, replaying them need not wait
+	serversClient.PollingDelay = 0
+	firewallRulesClient = postgresql.FirewallRulesClient(serversClient)
+	databasesClient = postgresql.DatabasesClient(serversClient)
+	logFilesClient = postgresql.LogFilesClient(serversClient)
+	t.Cleanup(func() {
+		armPlayer = nil
+		secretStore = nil
+		serverTagPolicy = nil
+		activeTransaction = nil
+	})
+}
+
+func checkAllReplayed(t *testing.T) {
+	if n := armPlayer.unplayed(); n != 0 {
+		t.Errorf("%d interactions of %s were not replayed", n, armPlayer.path)
+	}
+}
+
+func credentialStatus(t *testing.T, serverName string, version int) string {
+	versions, err := secretStore.Versions(credentialKey(resourceGroupName, serverName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range versions {
+		if c.Version == version {
+			return c.Status
+		}
+	}
+	t.Fatalf("no version %d stored for %s", version, serverName)
+	return ""
+}
+
+func TestReplaySampleFlow(t *testing.T) {
+	replayCassette(t, "sample-flow.json")
+	txn := &transaction{}
+	activeTransaction = txn
+	// the default expires-at satisfies a policy requiring it
+	serverTagPolicy = &tagPolicy{Tags: []tagRule{{Key: expiresAtTag, Required: true}}}
+
+	pollingURL, version, err := createServer(resourceGroupName, "replay-test", location, administratorLogin, administratorLoginPassword, postgresql.NineFullStopFive, postgresql.Basic, 50, 179200, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := credentialStatus(t, "replay-test", version); status != credentialPending {
+		t.Errorf("password of a server being created is %s", status)
+	}
+	var statuses []string
+	for _, want := range []string{inProgress, "Succeeded"} {
+		status, err := getPollingStatus(pollingURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, status.Status)
+		if status.Status != want {
+			t.Fatalf("polling statuses %v", statuses)
+		}
+	}
+
+	createFirewallRule(resourceGroupName, "replay-test", "all", "0.0.0.0", "255.255.255.255")
+	createDatabase(resourceGroupName, "replay-test", "orders")
+	var created []string
+	for _, r := range txn.created {
+		created = append(created, r.kind+" "+r.name)
+	}
+	want := []string{
+		"stored password postgresql_from_go/replay-test version 1",
+		"server postgresql_from_go/replay-test",
+		"firewall rule postgresql_from_go/replay-test/all",
+		"database postgresql_from_go/replay-test/orders",
+	}
+	if len(created) != len(want) {
+		t.Fatalf("recorded %q, want %q", created, want)
+	}
+	for i := range want {
+		if created[i] != want[i] {
+			t.Errorf("recorded %q, want %q", created[i], want[i])
+		}
+	}
+	txn.commit()
+	checkAllReplayed(t)
+}
+
+func TestReplayRollback(t *testing.T) {
+	replayCassette(t, "rollback.json")
+	txn := &transaction{}
+	activeTransaction = txn
+
+	_, version, err := createServer(resourceGroupName, "replay-rollback", location, administratorLogin, administratorLoginPassword, postgresql.NineFullStopFive, postgresql.Basic, 50, 179200, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createFirewallRule(resourceGroupName, "replay-rollback", "all", "0.0.0.0", "255.255.255.255")
+	createDatabase(resourceGroupName, "replay-rollback", "orders")
+
+	// database, firewall rule and server are deleted, newest first, through their clients
+	txn.rollback("test")
+	if status := credentialStatus(t, "replay-rollback", version); status != credentialFailed {
+		t.Errorf("password of a rolled back server is %s", status)
+	}
+	checkAllReplayed(t)
+}
+
+func TestReplayRestoreUpdateDelete(t *testing.T) {
+	replayCassette(t, "restore-update-delete.json")
+
+	restoreServer(resourceGroupName, "replay-test", resourceGroupName, "replay-test-restored", time.Date(2017, 9, 26, 18, 30, 0, 0, time.UTC))
+
+	updateAdministratorPassword(resourceGroupName, "replay-test", "Welcome0000")
+	active, err := activeCredential(secretStore, resourceGroupName, "replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active == nil || active.Password != "Welcome0000" {
+		t.Errorf("active password after the update: %+v", active)
+	}
+
+	deleteServer(resourceGroupName, "replay-test-restored", "replay-test-restored")
+	checkAllReplayed(t)
+}
+
+func TestReplayConfigurationsAndLogFiles(t *testing.T) {
+	replayCassette(t, "server-settings.json")
+	configurationsClient := postgresql.ConfigurationsClient(serversClient)
+
+	configuration := postgresql.Configuration{
+		ConfigurationProperties: &postgresql.ConfigurationProperties{
+			Value:  to.StringPtr("1000"),
+			Source: to.StringPtr("user-override"),
+		},
+	}
+	_, errChannel := configurationsClient.CreateOrUpdate(resourceGroupName, "replay-test", "log_min_duration_statement", configuration, nil)
+	if err := <-errChannel; err != nil {
+		t.Fatal(err)
+	}
+	configuration, err := configurationsClient.Get(resourceGroupName, "replay-test", "log_min_duration_statement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configuration.ConfigurationProperties == nil || to.String(configuration.Value) != "1000" {
+		t.Errorf("configuration %s", toJSON(configuration))
+	}
+
+	files, err := listLogFiles(resourceGroupName, "replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, logFileName(f))
+	}
+	if len(names) != 2 || names[0] != "postgresql-2017-09-26_180000.log" || names[1] != "postgresql-2017-09-26_190000.log" {
+		t.Errorf("log files %q", names)
+	}
+	checkAllReplayed(t)
+}
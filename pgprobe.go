@@ -0,0 +1,350 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - probeLogin speaks just enough of the PostgreSQL frontend/backend protocol to
+//   find out whether a login works: SSL request, startup and password authentication
+//   (cleartext, md5 or SCRAM-SHA-256), so no database driver is needed
+// - Azure servers expect the user as <login>@<server name> and enforce SSL
+//
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pgPort              = 5432
+	pgProtocolVersion   = 196608 // 3.0
+	pgSSLRequestCode    = 80877103
+	pgAuthOK            = 0
+	pgAuthCleartext     = 3
+	pgAuthMD5           = 5
+	pgAuthSASL          = 10
+	pgAuthSASLContinue  = 11
+	pgAuthSASLFinal     = 12
+	pgScramSHA256       = "SCRAM-SHA-256"
+	defaultProbeTimeout = 30 * time.Second
+)
+
+// pgError is an ErrorResponse sent by the server, e.g. 28P01 for a wrong password
+type pgError struct {
+	Severity string
+	Code     string
+	Message  string
+}
+
+func (e *pgError) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+}
+
+// azureLoginUser returns the user name Azure expects for a login, e.g. azadmin@myserver
+func azureLoginUser(login string, serverName string) string {
+	if strings.Contains(login, "@") {
+		return login
+	}
+	return login + "@" + serverName
+}
+
+// probeLogin connects to host over SSL and authenticates as user, returning nil if the login works
+func probeLogin(host string, user string, password string, database string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(pgPort)), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// SSLRequest
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint32(msg[0:4], 8)
+	binary.BigEndian.PutUint32(msg[4:8], pgSSLRequestCode)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return err
+	}
+	if answer[0] != 'S' {
+		return fmt.Errorf("Server %s refused SSL", host)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	p := &pgConn{conn: tlsConn, reader: bufio.NewReader(tlsConn)}
+	defer p.terminate()
+
+	// StartupMessage
+	var startup []byte
+	startup = appendUint32(startup, pgProtocolVersion)
+	for _, kv := range [][2]string{{"user", user}, {"database", database}, {"application_name", "azure-postgresql-go-sample"}} {
+		startup = append(startup, kv[0]...)
+		startup = append(startup, 0)
+		startup = append(startup, kv[1]...)
+		startup = append(startup, 0)
+	}
+	startup = append(startup, 0)
+	if err := p.send(0, startup); err != nil {
+		return err
+	}
+
+	var scram *scramClient
+	for {
+		typ, payload, err := p.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'E':
+			return parsePgError(payload)
+		case 'R':
+			if len(payload) < 4 {
+				return fmt.Errorf("Malformed authentication message")
+			}
+			code := binary.BigEndian.Uint32(payload[0:4])
+			data := payload[4:]
+			switch code {
+			case pgAuthOK:
+				return nil
+			case pgAuthCleartext:
+				err = p.send('p', append([]byte(password), 0))
+			case pgAuthMD5:
+				// the salt is computed with the role name, i.e. without the @server suffix
+				role := strings.SplitN(user, "@", 2)[0]
+				err = p.send('p', append([]byte(pgMD5Password(role, password, data)), 0))
+			case pgAuthSASL:
+				if !strings.Contains(string(data), pgScramSHA256) {
+					return fmt.Errorf("Unsupported SASL mechanisms %q", data)
+				}
+				scram, err = newScramClient(password)
+				if err != nil {
+					return err
+				}
+				first := scram.clientFirst()
+				var msg []byte
+				msg = append(msg, pgScramSHA256...)
+				msg = append(msg, 0)
+				msg = appendUint32(msg, uint32(len(first)))
+				msg = append(msg, first...)
+				err = p.send('p', msg)
+			case pgAuthSASLContinue:
+				if scram == nil {
+					return fmt.Errorf("Unexpected SASL continue message")
+				}
+				var final string
+				final, err = scram.clientFinal(string(data))
+				if err == nil {
+					err = p.send('p', []byte(final))
+				}
+			case pgAuthSASLFinal:
+				if scram == nil {
+					return fmt.Errorf("Unexpected SASL final message")
+				}
+				err = scram.verifyServerFinal(string(data))
+			default:
+				return fmt.Errorf("Unsupported authentication method %d", code)
+			}
+			if err != nil {
+				return err
+			}
+		case 'N':
+			// NoticeResponse, ignored
+		default:
+			return fmt.Errorf("Unexpected message %q during authentication", typ)
+		}
+	}
+}
+
+// pgMD5Password is the answer to an MD5 authentication request: "md5" followed by
+// md5(md5(password + role) + salt) in hex
+func pgMD5Password(role string, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + role))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+type pgConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// send writes a message; type 0 is used for the untyped startup message
+func (p *pgConn) send(typ byte, payload []byte) error {
+	var msg []byte
+	if typ != 0 {
+		msg = append(msg, typ)
+	}
+	msg = appendUint32(msg, uint32(len(payload)+4))
+	msg = append(msg, payload...)
+	_, err := p.conn.Write(msg)
+	return err
+}
+
+func (p *pgConn) receive() (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(p.reader, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length < 4 || length > 1024*1024 {
+		return 0, nil, fmt.Errorf("Invalid message length %d", length)
+	}
+	payload := make([]byte, length-4)
+	if _, err := io.ReadFull(p.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+func (p *pgConn) terminate() {
+	p.send('X', nil)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func parsePgError(payload []byte) error {
+	e := &pgError{}
+	for _, field := range strings.Split(string(payload), "\x00") {
+		if field == "" {
+			continue
+		}
+		switch field[0] {
+		case 'S':
+			e.Severity = field[1:]
+		case 'C':
+			e.Code = field[1:]
+		case 'M':
+			e.Message = field[1:]
+		}
+	}
+	return e
+}
+
+// scramClient implements the client side of SCRAM-SHA-256 (RFC 5802, RFC 7677)
+type scramClient struct {
+	password        string
+	clientNonce     string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func newScramClient(password string) (*scramClient, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &scramClient{password: password, clientNonce: base64.StdEncoding.EncodeToString(nonce)}, nil
+}
+
+func (s *scramClient) clientFirst() string {
+	// the user name is taken from the startup message
+	s.clientFirstBare = "n=,r=" + s.clientNonce
+	return "n,," + s.clientFirstBare
+}
+
+func (s *scramClient) clientFinal(serverFirst string) (string, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 {
+			continue
+		}
+		switch attr[:2] {
+		case "r=":
+			nonce = attr[2:]
+		case "s=":
+			salt = attr[2:]
+		case "i=":
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, s.clientNonce) || salt == "" || iterations <= 0 {
+		return "", fmt.Errorf("Invalid SCRAM server-first-message")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", err
+	}
+
+	s.saltedPassword = pbkdf2SHA256([]byte(s.password), saltBytes, iterations)
+	clientKey := scramHMAC(s.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.clientFirstBare + "," + serverFirst + "," + withoutProof
+	signature := scramHMAC(storedKey[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (s *scramClient) verifyServerFinal(serverFinal string) error {
+	if !strings.HasPrefix(serverFinal, "v=") {
+		return fmt.Errorf("Invalid SCRAM server-final-message %q", serverFinal)
+	}
+	serverKey := scramHMAC(s.saltedPassword, "Server Key")
+	expected := base64.StdEncoding.EncodeToString(scramHMAC(serverKey, s.authMessage))
+	if !hmac.Equal([]byte(expected), []byte(serverFinal[2:])) {
+		return fmt.Errorf("SCRAM server signature mismatch")
+	}
+	return nil
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 is PBKDF2 with HMAC-SHA-256 for a single 32 byte output block, Hi() in SCRAM
+func pbkdf2SHA256(password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
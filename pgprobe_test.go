@@ -0,0 +1,117 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+)
+
+// the SCRAM-SHA-256 exchange of RFC 7677 section 3
+func TestScramRFC7677(t *testing.T) {
+	s := &scramClient{password: "pencil", clientNonce: "rOprNGfwEbeRWgbNEkqO"}
+	if first := s.clientFirst(); first != "n,,n=,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Fatalf("client-first-message %q", first)
+	}
+	// PostgreSQL takes the user from the startup message and sends n=, the RFC example has n=user
+	s.clientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	final, err := s.clientFinal(serverFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; final != want {
+		t.Errorf("client-final-message\n got %s\nwant %s", final, want)
+	}
+	if err := s.verifyServerFinal("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Errorf("server-final-message: %v", err)
+	}
+	if err := s.verifyServerFinal("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err == nil {
+		t.Error("a wrong server signature was accepted")
+	}
+}
+
+func TestScramRejectsForeignNonce(t *testing.T) {
+	s := &scramClient{password: "pencil", clientNonce: "rOprNGfwEbeRWgbNEkqO"}
+	s.clientFirst()
+	if _, err := s.clientFinal("r=somebodyElse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"); err == nil {
+		t.Error("a server nonce not starting with the client nonce was accepted")
+	}
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		want       string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, test := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations))
+		if got != test.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, got, test.want)
+		}
+	}
+}
+
+func TestPgMD5Password(t *testing.T) {
+	salt := []byte{0x01, 0x02, 0x03, 0x04}
+	// pg_authid stores md5 + md5("postgres" + "postgres") for role postgres with password postgres
+	stored := "3175bce1d3201d16594cebf9d7eb3f9d"
+	outer := md5.Sum(append([]byte(stored), salt...))
+	if got, want := pgMD5Password("postgres", "postgres", salt), "md5"+hex.EncodeToString(outer[:]); got != want {
+		t.Errorf("pgMD5Password = %s, want %s", got, want)
+	}
+}
+
+func TestEncryptedFileRoundTrip(t *testing.T) {
+	plaintext := []byte(`{"secret":"Welcome1234"}`)
+	data, err := sealEncryptedFile("passphrase", nil, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, plaintext) {
+		t.Fatal("the sealed file contains the plaintext")
+	}
+	opened, salt, err := openEncryptedFile("passphrase", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) || len(salt) != 16 {
+		t.Errorf("opened %q with a %d byte salt", opened, len(salt))
+	}
+	if _, _, err := openEncryptedFile("wrong passphrase", data); err != errDecryptionFailed {
+		t.Errorf("wrong passphrase: %v", err)
+	}
+
+	// resealing with the salt keeps the key and changes the nonce
+	resealed, err := sealEncryptedFile("passphrase", salt, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(resealed, data) {
+		t.Error("resealing reused the nonce")
+	}
+	if opened, _, err := openEncryptedFile("passphrase", resealed); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("resealed file opened as %q, %v", opened, err)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - commands that change resources first ask PermissionsClient.ListForResourceGroup what the
+//   credentials may do in the resource groups of their servers and stop before the first
+//   change when an action in commandActions is not allowed, instead of failing halfway with
+//   AuthorizationFailed
+// - an action is allowed when a permission has an action matching it and no notAction
+//   matching it; patterns may contain "*" anywhere and are compared case-insensitively, as
+//   ARM does
+// - the Microsoft.DBforPostgreSQL actions of commandActions must be in the provider's
+//   operations catalog (OperationsClient.List), which also supplies their descriptions
+// - the sample flow is checked before bootstrap registers the provider or creates the
+//   resource group
+// - a resource group that does not exist yet (bootstrap creates it) is not checked, and a
+//   failure to read the permissions is reported but does not stop the command; RBAC_PREFLIGHT=off
+//   turns the preflight off
+//
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Azure/azure-sdk-for-go/arm/authorization"
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	actionServersRead         = "Microsoft.DBforPostgreSQL/servers/read"
+	actionServersWrite        = "Microsoft.DBforPostgreSQL/servers/write"
+	actionServersDelete       = "Microsoft.DBforPostgreSQL/servers/delete"
+	actionProviderRegister    = "Microsoft.DBforPostgreSQL/register/action"
+	actionResourceGroupsWrite = "Microsoft.Resources/subscriptions/resourceGroups/write"
+	actionLocksRead           = "Microsoft.Authorization/locks/read"
+	actionLocksWrite          = "Microsoft.Authorization/locks/write"
+	actionLocksDelete         = "Microsoft.Authorization/locks/delete"
+	actionAlertRulesWrite     = "Microsoft.Insights/alertRules/write"
+	actionDiagnosticsWrite    = "Microsoft.Insights/diagnosticSettings/write"
+	actionMetricsRead         = "Microsoft.Insights/metrics/read"
+	sampleCommand             = "sample"
+	rbacPreflightEnvVarName   = "RBAC_PREFLIGHT"
+)
+
+// commandActions are the actions each command needs in the resource groups of its servers;
+// "sample" is the flow in main(), which also needs actionProviderRegister with -register-provider
+var commandActions = map[string][]string{
+	sampleCommand: {
+		actionServersRead, actionServersWrite, actionServersDelete,
+		actionResourceGroupsWrite, actionLocksRead,
+	},
+	"server delete":     {actionServersRead, actionServersDelete, actionLocksRead},
+	"server scale":      {actionServersRead, actionServersWrite},
+	"autoscale":         {actionServersRead, actionServersWrite},
+	"password rotate":   {actionServersRead, actionServersWrite},
+	"tags set":          {actionServersRead, actionServersWrite},
+	"tags unset":        {actionServersRead, actionServersWrite},
+	"janitor":           {actionServersRead, actionServersDelete, actionLocksRead},
+	"lock add":          {actionLocksWrite},
+	"lock remove":       {actionLocksDelete},
+	"alerts apply":      {actionServersRead, actionAlertRulesWrite},
+	"diagnostics apply": {actionServersRead, actionDiagnosticsWrite},
+}
+
+// permissions of the credentials by lowercased resource group, nil for a missing group
+var groupPermissions = map[string][]authorization.Permission{}
+
+// postgresql operations catalog by lowercased name
+var operationsCatalog map[string]postgresql.Operation
+
+func init() {
+	registerCommand(command{
+		name:         "permissions check",
+		summary:      "Show which commands the credentials may run in a resource group",
+		needsClients: true,
+		run:          runPermissionsCheck,
+	})
+}
+
+func runPermissionsCheck(args []string) {
+	flags := newFlagSet("permissions check")
+	group := flags.String("resource-group", resourceGroupName, "resource group to check")
+	var names stringsFlag
+	flags.Var(&names, "command", "command to check, e.g. \"server delete\" (repeatable, default all)")
+	format := flags.String("format", "table", "report format: table or json")
+	flags.Parse(args)
+
+	if len(names) == 0 {
+		for name := range commandActions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	type commandResult struct {
+		Command string   `json:"command"`
+		Allowed bool     `json:"allowed"`
+		Missing []string `json:"missing,omitempty"`
+	}
+	var results []commandResult
+	failed := false
+	for _, name := range names {
+		actions, ok := commandActions[name]
+		if !ok {
+			fmt.Printf("Unknown command %q\n", name)
+			os.Exit(2)
+		}
+		missing, err := missingActions(*group, actions)
+		onErrorFail(err, "Reading permissions failed")
+		if missing == nil {
+			onErrorFail(fmt.Errorf("resource group %s not found", *group), "Reading permissions failed")
+		}
+		results = append(results, commandResult{Command: name, Allowed: len(missing) == 0, Missing: missing})
+		failed = failed || len(missing) > 0
+	}
+
+	if *format == "json" {
+		fmt.Println(toJSON(results))
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "COMMAND\tALLOWED\tMISSING ACTIONS")
+		for _, r := range results {
+			fmt.Fprintf(tw, "%s\t%v\t%s\n", r.Command, r.Allowed, strings.Join(r.Missing, ", "))
+		}
+		tw.Flush()
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// requirePermissions stops the program when the credentials lack an action the command needs
+// in one of the resource groups; extra are actions needed for optional steps
+func requirePermissions(command string, resourceGroups []string, extra ...string) {
+	if strings.EqualFold(os.Getenv(rbacPreflightEnvVarName), "off") {
+		return
+	}
+	actions := append(append([]string{}, commandActions[command]...), extra...)
+	seen := map[string]bool{}
+	for _, group := range resourceGroups {
+		if group == "" || seen[strings.ToLower(group)] {
+			continue
+		}
+		seen[strings.ToLower(group)] = true
+		missing, err := missingActions(group, actions)
+		if err != nil {
+			fmt.Printf("Could not check permissions in resource group %s, continuing: %v\n", group, err)
+			continue
+		}
+		if len(missing) > 0 {
+			onErrorFail(missingActionsError(group, missing), "Permission preflight failed")
+		}
+	}
+}
+
+// serverResourceGroups returns the resource groups of servers
+func serverResourceGroups(servers []postgresql.Server) []string {
+	groups := make([]string, 0, len(servers))
+	for _, server := range servers {
+		groups = append(groups, resourceGroupFromID(to.String(server.ID)))
+	}
+	return groups
+}
+
+func missingActionsError(group string, missing []string) error {
+	lines := make([]string, len(missing))
+	for i, action := range missing {
+		lines[i] = "  " + action
+		if op, ok := operationsCatalog[strings.ToLower(action)]; ok && op.Display != nil && op.Display.Description != nil {
+			lines[i] += " (" + *op.Display.Description + ")"
+		}
+	}
+	return fmt.Errorf("the credentials may not do these actions in resource group %s:\n%s\nRemediation: assign a role granting them, such as one made by 'role generate'; 'whoami token' shows the identity",
+		group, strings.Join(lines, "\n"))
+}
+
+// missingActions returns the actions not allowed in a resource group, nil when the group does
+// not exist
+func missingActions(group string, actions []string) ([]string, error) {
+	if err := checkActionNames(actions); err != nil {
+		return nil, err
+	}
+	permissions, err := resourceGroupPermissions(group)
+	if err != nil || permissions == nil {
+		return nil, err
+	}
+	missing := []string{}
+	for _, action := range actions {
+		if !actionAllowed(permissions, action) {
+			missing = append(missing, action)
+		}
+	}
+	return missing, nil
+}
+
+func resourceGroupPermissions(group string) ([]authorization.Permission, error) {
+	key := strings.ToLower(group)
+	if permissions, ok := groupPermissions[key]; ok {
+		return permissions, nil
+	}
+	client := authorization.NewPermissionsClient(armSubscriptionID)
+	client.Authorizer = armAuthorizer
+	useARMSender(&client.Client, armSubscriptionID)
+	var permissions []authorization.Permission
+	result, err := client.ListForResourceGroup(group)
+	for {
+		if err != nil {
+			if statusCode, _ := armError(err); statusCode == http.StatusNotFound {
+				groupPermissions[key] = nil
+				return nil, nil
+			}
+			return nil, err
+		}
+		if result.Value != nil {
+			permissions = append(permissions, *result.Value...)
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			break
+		}
+		result, err = client.ListForResourceGroupNextResults(result)
+	}
+	if permissions == nil {
+		permissions = []authorization.Permission{}
+	}
+	groupPermissions[key] = permissions
+	return permissions, nil
+}
+
+// checkActionNames verifies the PostgreSQL actions against the operations catalog
+func checkActionNames(actions []string) error {
+	if err := loadOperationsCatalog(); err != nil {
+		return err
+	}
+	for _, action := range actions {
+		if !strings.HasPrefix(strings.ToLower(action), strings.ToLower(postgresqlProviderNamespace)+"/") {
+			continue
+		}
+		if _, ok := operationsCatalog[strings.ToLower(action)]; !ok {
+			return fmt.Errorf("%s is not an operation of %s", action, postgresqlProviderNamespace)
+		}
+	}
+	return nil
+}
+
+// loadOperationsCatalog reads the operations of the PostgreSQL provider once
+func loadOperationsCatalog() error {
+	if operationsCatalog != nil {
+		return nil
+	}
+	client := postgresql.NewOperationsClient(armSubscriptionID)
+	client.Authorizer = armAuthorizer
+	useARMSender(&client.Client, armSubscriptionID)
+	result, err := client.List()
+	if err != nil {
+		return fmt.Errorf("listing %s operations: %v", postgresqlProviderNamespace, err)
+	}
+	operationsCatalog = map[string]postgresql.Operation{}
+	if result.Value != nil {
+		for _, op := range *result.Value {
+			if op.Name != nil {
+				operationsCatalog[strings.ToLower(*op.Name)] = op
+			}
+		}
+	}
+	return nil
+}
+
+// actionAllowed reports whether a permission grants the action without excluding it
+func actionAllowed(permissions []authorization.Permission, action string) bool {
+	for _, p := range permissions {
+		if p.Actions == nil || !anyActionMatches(*p.Actions, action) {
+			continue
+		}
+		if p.NotActions != nil && anyActionMatches(*p.NotActions, action) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func anyActionMatches(patterns []string, action string) bool {
+	for _, pattern := range patterns {
+		if actionMatches(pattern, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// actionMatches matches an action against a pattern where "*" stands for any text
+func actionMatches(pattern string, action string) bool {
+	parts := strings.Split(strings.ToLower(pattern), "*")
+	rest := strings.ToLower(action)
+	if !strings.HasPrefix(rest, parts[0]) {
+		return false
+	}
+	rest = rest[len(parts[0]):]
+	if len(parts) == 1 {
+		return rest == ""
+	}
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	return strings.HasSuffix(rest, parts[len(parts)-1])
+}
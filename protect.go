@@ -0,0 +1,195 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - a server is protected from deletion by the tag protected=true or by a CanNotDelete
+//   or ReadOnly management lock on it, its resource group or the subscription
+// - destructive commands ask for the server name to be typed, or take -confirm=<server>
+//   when not run interactively (the janitor asks for the word "expired" instead)
+//
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/locks"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	// servers with this tag set to "true" are never deleted by the tool
+	protectionTag = "protected"
+	// name of the lock created by "lock add"
+	defaultLockName = "do-not-delete"
+)
+
+func init() {
+	registerCommand(command{
+		name:         "server delete",
+		summary:      "delete a server unless it is protected by tag or lock; needs confirmation",
+		needsClients: true,
+		run:          runServerDelete,
+	})
+	registerCommand(command{
+		name:         "lock add",
+		summary:      "add a CanNotDelete (or ReadOnly) management lock to a server",
+		needsClients: true,
+		run:          runLockAdd,
+	})
+	registerCommand(command{
+		name:         "lock remove",
+		summary:      "remove a management lock from a server; needs confirmation",
+		needsClients: true,
+		run:          runLockRemove,
+	})
+}
+
+func runServerDelete(args []string) {
+	flags := newFlagSet("server delete")
+	group := flags.String("resource-group", resourceGroupName, "resource group of the server")
+	server := flags.String("server", "", "server to delete")
+	confirm := flags.String("confirm", "", "name of the server, confirms the deletion without a prompt")
+	flags.Parse(args)
+	if *server == "" {
+		fmt.Println("Missing -server")
+		os.Exit(2)
+	}
+	requirePermissions("server delete", []string{*group})
+	deleteServer(*group, *server, *confirm)
+}
+
+func runLockAdd(args []string) {
+	flags := newFlagSet("lock add")
+	group := flags.String("resource-group", resourceGroupName, "resource group of the server")
+	server := flags.String("server", "", "server to lock")
+	name := flags.String("name", defaultLockName, "name of the lock")
+	level := flags.String("level", string(locks.CanNotDelete), "lock level: CanNotDelete or ReadOnly")
+	notes := flags.String("notes", "", "notes stored with the lock")
+	flags.Parse(args)
+	if *server == "" {
+		fmt.Println("Missing -server")
+		os.Exit(2)
+	}
+	if *level != string(locks.CanNotDelete) && *level != string(locks.ReadOnly) {
+		fmt.Printf("Invalid -level %s, expected %s or %s\n", *level, locks.CanNotDelete, locks.ReadOnly)
+		os.Exit(2)
+	}
+
+	lock := locks.ManagementLockObject{
+		ManagementLockProperties: &locks.ManagementLockProperties{
+			Level: locks.LockLevel(*level),
+		},
+	}
+	if *notes != "" {
+		lock.Notes = to.StringPtr(*notes)
+	}
+	requirePermissions("lock add", []string{*group})
+	if _, err := locksClient.CreateOrUpdateAtResourceLevel(*group, postgresqlProviderNamespace, "", "servers", *server, *name, lock); err != nil {
+		onErrorFail(withRemediation(err, "creating lock "+*name), "Adding lock failed")
+	}
+	fmt.Printf("Added %s lock %s to %s/%s\n", *level, *name, *group, *server)
+}
+
+func runLockRemove(args []string) {
+	flags := newFlagSet("lock remove")
+	group := flags.String("resource-group", resourceGroupName, "resource group of the server")
+	server := flags.String("server", "", "server to unlock")
+	name := flags.String("name", defaultLockName, "name of the lock")
+	confirm := flags.String("confirm", "", "name of the server, confirms the removal without a prompt")
+	flags.Parse(args)
+	if *server == "" {
+		fmt.Println("Missing -server")
+		os.Exit(2)
+	}
+
+	requirePermissions("lock remove", []string{*group})
+	onErrorFail(confirmDestructive(fmt.Sprintf("Remove lock %s from %s/%s", *name, *group, *server), *server, *confirm), "Not confirmed")
+	if _, err := locksClient.DeleteAtResourceLevel(*group, postgresqlProviderNamespace, "", "servers", *server, *name); err != nil {
+		onErrorFail(withRemediation(err, "deleting lock "+*name), "Removing lock failed")
+	}
+	fmt.Printf("Removed lock %s from %s/%s\n", *name, *group, *server)
+}
+
+// serverLocks returns the locks that apply to a server, including those inherited
+// from its resource group and subscription
+func serverLocks(resourceGroup string, serverName string) ([]locks.ManagementLockObject, error) {
+	var all []locks.ManagementLockObject
+	result, err := locksClient.ListAtResourceLevel(resourceGroup, postgresqlProviderNamespace, "", "servers", serverName, "")
+	for {
+		if err != nil {
+			return nil, err
+		}
+		if result.Value != nil {
+			all = append(all, *result.Value...)
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			return all, nil
+		}
+		result, err = locksClient.ListAtResourceLevelNextResults(result)
+	}
+}
+
+// isProtected reports whether the server carries the protection tag
+func isProtected(server postgresql.Server) bool {
+	return strings.EqualFold(serverTags(server)[protectionTag], "true")
+}
+
+// checkDeletionAllowed returns an error saying why the server must not be deleted, nil if it may be
+func checkDeletionAllowed(resourceGroup string, server postgresql.Server) error {
+	name := to.String(server.Name)
+	if isProtected(server) {
+		return fmt.Errorf("Server %s/%s is protected by tag %s=true.\nRemediation: remove the tag first if the server should really be deleted",
+			resourceGroup, name, protectionTag)
+	}
+	applied, err := serverLocks(resourceGroup, name)
+	if err != nil {
+		return withRemediation(err, "reading locks of "+name)
+	}
+	for _, lock := range applied {
+		if lock.ManagementLockProperties == nil {
+			continue
+		}
+		if lock.Level == locks.CanNotDelete || lock.Level == locks.ReadOnly {
+			return fmt.Errorf("Server %s/%s is protected by %s lock %s (%s).\nRemediation: run 'lock remove -server %s -name %s' if the server should really be deleted",
+				resourceGroup, name, lock.Level, to.String(lock.Name), to.String(lock.ID), name, to.String(lock.Name))
+		}
+	}
+	return nil
+}
+
+// confirmDestructive asks for expected, usually the server name, to be typed before a
+// destructive action. confirm, the value of a -confirm flag, skips the prompt if it equals expected.
+func confirmDestructive(action string, expected string, confirm string) error {
+	if confirm != "" {
+		if confirm != expected {
+			return fmt.Errorf("-confirm=%s does not match %s", confirm, expected)
+		}
+		return nil
+	}
+	if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s needs confirmation, pass -confirm=%s", action, expected)
+	}
+	fmt.Printf("%s?\nType %s to confirm: ", action, expected)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(answer) != expected {
+		return fmt.Errorf("%s cancelled", action)
+	}
+	return nil
+}
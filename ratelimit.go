@@ -0,0 +1,191 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - ARM throttles each subscription separately for reads (GET, HEAD) and writes (all other
+//   methods), by default 12000 reads and 1200 writes per hour; every client of a subscription
+//   takes its tokens from the same rateLimiter so parallel commands share the budget
+// - the budgets can be changed with ARM_RATE_LIMIT, e.g. "reads=6000,writes=600" per hour
+// - each bucket holds 1% of its hourly budget as burst
+// - ARM reports the requests left in x-ms-ratelimit-remaining-subscription-reads/writes/deletes;
+//   when fewer than 10% of the budget remain the bucket slows down in proportion, down to a
+//   tenth of its rate, and goes back to its full rate once the headers show enough room again
+//
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const (
+	defaultReadsPerHour  = 12000
+	defaultWritesPerHour = 1200
+)
+
+// tokenBucket hands out tokens at rate per second, up to burst at once
+type tokenBucket struct {
+	mu       sync.Mutex
+	baseRate float64
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(perHour int) *tokenBucket {
+	rate := float64(perHour) / time.Hour.Seconds()
+	burst := float64(perHour) / 100
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{baseRate: rate, rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before it may be used
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// adapt sets the rate from the requests ARM says are left of the hourly budget
+func (b *tokenBucket) adapt(remaining int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	low := b.baseRate * time.Hour.Seconds() / 10
+	if float64(remaining) >= low {
+		b.rate = b.baseRate
+		return
+	}
+	b.rate = b.baseRate * float64(remaining) / low
+	if b.rate < b.baseRate/10 {
+		b.rate = b.baseRate / 10
+	}
+	if b.tokens > float64(remaining) {
+		b.tokens = float64(remaining)
+	}
+}
+
+// rateLimiter is the read and write budget of one subscription
+type rateLimiter struct {
+	reads  *tokenBucket
+	writes *tokenBucket
+}
+
+var (
+	rateLimitersMu sync.Mutex
+	rateLimiters   = map[string]*rateLimiter{}
+	// hourly budgets, from ARM_RATE_LIMIT
+	readsPerHour  = defaultReadsPerHour
+	writesPerHour = defaultWritesPerHour
+)
+
+// parseRateLimit reads "reads=N,writes=N" into the hourly budgets
+func parseRateLimit(spec string) (reads int, writes int, err error) {
+	reads, writes = defaultReadsPerHour, defaultWritesPerHour
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return 0, 0, fmt.Errorf("Invalid rate limit %q, expected reads=N,writes=N", spec)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("Invalid rate limit %q: %s must be a positive number", spec, kv[0])
+		}
+		switch kv[0] {
+		case "reads":
+			reads = n
+		case "writes":
+			writes = n
+		default:
+			return 0, 0, fmt.Errorf("Invalid rate limit %q: unknown budget %s", spec, kv[0])
+		}
+	}
+	return reads, writes, nil
+}
+
+// subscriptionRateLimiter returns the limiter shared by all clients of a subscription
+func subscriptionRateLimiter(subscriptionID string) *rateLimiter {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	key := strings.ToLower(subscriptionID)
+	limiter, ok := rateLimiters[key]
+	if !ok {
+		limiter = &rateLimiter{reads: newTokenBucket(readsPerHour), writes: newTokenBucket(writesPerHour)}
+		rateLimiters[key] = limiter
+	}
+	return limiter
+}
+
+func (l *rateLimiter) bucket(r *http.Request) *tokenBucket {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return l.reads
+	}
+	return l.writes
+}
+
+// sendDecorator returns the SendDecorator waiting for a token before each request
+func (l *rateLimiter) sendDecorator() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			if wait := l.bucket(r).reserve(time.Now()); wait > 0 {
+				if !sleepUnlessCanceled(wait, r) {
+					return nil, fmt.Errorf("%s %s canceled while waiting for the rate limiter", r.Method, r.URL.Path)
+				}
+			}
+			resp, err := s.Do(r)
+			l.adapt(resp)
+			return resp, err
+		})
+	}
+}
+
+// adapt feeds the remaining request counts of a response to the buckets
+func (l *rateLimiter) adapt(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	if n, err := strconv.Atoi(resp.Header.Get("X-Ms-Ratelimit-Remaining-Subscription-Reads")); err == nil {
+		l.reads.adapt(n)
+	}
+	writes := -1
+	for _, header := range []string{"X-Ms-Ratelimit-Remaining-Subscription-Writes", "X-Ms-Ratelimit-Remaining-Subscription-Deletes"} {
+		if n, err := strconv.Atoi(resp.Header.Get(header)); err == nil && (writes < 0 || n < writes) {
+			writes = n
+		}
+	}
+	if writes >= 0 {
+		l.writes.adapt(writes)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - autorest.Client.Do always wraps its Sender in DoRetryForStatusCodes(RetryAttempts, ...),
+//   which backs off exponentially without jitter and ignores Retry-After; the clients get
+//   RetryAttempts 0 (a single try), RetryDuration 0 (no pause after it) and a Sender
+//   decorated with the retry policy instead
+// - the policy is the default below or a JSON file named by RETRY_POLICY, e.g.
+//     {"rules": [{"statusCodes": [429], "attempts": 8},
+//                {"statusCodes": [500, 502, 503, 504], "attempts": 3}],
+//      "baseDelay": "1s", "maxDelay": "1m", "maxElapsed": "5m"}
+// - delays are "full jitter" (random between 0 and the exponential backoff) so parallel
+//   jobs do not retry in lockstep; a Retry-After header replaces the backoff
+// - POST is not idempotent and only retried with "retryPost" or when its path ends with
+//   one of "retriablePostPaths" (provider registration by default)
+// - every attempt goes through the rate limiter of the subscription (ratelimit.go), see
+//   useARMSender in main.go
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// retryRule is how often responses with one of the status codes are retried
+type retryRule struct {
+	StatusCodes []int `json:"statusCodes"`
+	Attempts    int   `json:"attempts"`
+}
+
+// duration is a time.Duration written as "1m30s" in JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// retryPolicy decides whether, and after which delay, a request sent to ARM is sent again
+type retryPolicy struct {
+	Rules              []retryRule `json:"rules"`
+	ErrorAttempts      int         `json:"errorAttempts"`
+	BaseDelay          duration    `json:"baseDelay"`
+	MaxDelay           duration    `json:"maxDelay"`
+	MaxElapsed         duration    `json:"maxElapsed"`
+	RetryPOST          bool        `json:"retryPost"`
+	RetriablePOSTPaths []string    `json:"retriablePostPaths"`
+
+	// nil for time.Timer and math/rand
+	sleep  func(d time.Duration, cancel <-chan struct{}) bool
+	random func() float64
+}
+
+// armRetryPolicy is the policy of every ARM client, see useARMSender
+var armRetryPolicy = defaultRetryPolicy()
+
+func defaultRetryPolicy() *retryPolicy {
+	return &retryPolicy{
+		Rules: []retryRule{
+			{StatusCodes: []int{http.StatusTooManyRequests}, Attempts: 6},
+			{StatusCodes: []int{http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}, Attempts: 3},
+		},
+		ErrorAttempts:      3,
+		BaseDelay:          duration(time.Second),
+		MaxDelay:           duration(time.Minute),
+		MaxElapsed:         duration(5 * time.Minute),
+		RetriablePOSTPaths: []string{"/register"},
+	}
+}
+
+// loadRetryPolicy reads a policy file, fields it leaves out keep their default
+func loadRetryPolicy(name string) (*retryPolicy, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	policy := defaultRetryPolicy()
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for i, rule := range policy.Rules {
+		if len(rule.StatusCodes) == 0 || rule.Attempts < 0 {
+			return nil, fmt.Errorf("%s: rule %d needs statusCodes and attempts >= 0", name, i+1)
+		}
+	}
+	if policy.BaseDelay <= 0 || policy.MaxDelay < policy.BaseDelay {
+		return nil, fmt.Errorf("%s: baseDelay must be positive and not above maxDelay", name)
+	}
+	return policy, nil
+}
+
+// sendDecorator returns the SendDecorator applying the policy
+func (p *retryPolicy) sendDecorator() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (resp *http.Response, err error) {
+			rr := autorest.NewRetriableRequest(r)
+			start := time.Now()
+			idempotent := p.idempotent(r)
+			for attempt := 0; ; attempt++ {
+				if err = rr.Prepare(); err != nil {
+					return resp, err
+				}
+				resp, err = s.Do(rr.Request())
+				if !idempotent || attempt >= p.attempts(resp, err) {
+					return resp, err
+				}
+				delay := p.delay(attempt, resp)
+				if p.MaxElapsed > 0 && time.Since(start)+delay > time.Duration(p.MaxElapsed) {
+					return resp, err
+				}
+				fmt.Fprintf(os.Stderr, "Retrying %s %s in %v (%s)\n", r.Method, r.URL.Path, delay.Round(time.Millisecond), retryReason(resp, err))
+				if !p.pause(delay, r) {
+					return resp, err
+				}
+				if resp != nil {
+					autorest.Respond(resp, autorest.ByDiscardingBody(), autorest.ByClosing())
+				}
+			}
+		})
+	}
+}
+
+// idempotent reports whether sending the request twice is safe
+func (p *retryPolicy) idempotent(r *http.Request) bool {
+	if r.Method != http.MethodPost || p.RetryPOST {
+		return true
+	}
+	for _, suffix := range p.RetriablePOSTPaths {
+		if strings.HasSuffix(strings.ToLower(r.URL.Path), strings.ToLower(suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// permanentError is implemented by errors retrying can not fix
+type permanentError interface {
+	permanent() bool
+}
+
+// attempts returns how often an outcome may be retried, 0 if it is final
+func (p *retryPolicy) attempts(resp *http.Response, err error) int {
+	if resp == nil {
+		if e, ok := err.(permanentError); ok && e.permanent() {
+			return 0
+		}
+		if err != nil {
+			return p.ErrorAttempts
+		}
+		return 0
+	}
+	for _, rule := range p.Rules {
+		for _, code := range rule.StatusCodes {
+			if resp.StatusCode == code {
+				return rule.Attempts
+			}
+		}
+	}
+	return 0
+}
+
+// delay is the server's Retry-After plus a little jitter, otherwise a random part of the
+// exponential backoff of the attempt
+func (p *retryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if after := retryAfter(resp, time.Now()); after > 0 {
+		return after + time.Duration(p.rand()*float64(p.BaseDelay))
+	}
+	backoff := math.Min(float64(p.MaxDelay), float64(p.BaseDelay)*math.Pow(2, float64(attempt)))
+	return time.Duration(p.rand() * backoff)
+}
+
+// retryAfter reads Retry-After (seconds or an HTTP date) or x-ms-retry-after-ms, 0 if absent
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	if ms, err := strconv.Atoi(resp.Header.Get("X-Ms-Retry-After-Ms")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+func retryReason(resp *http.Response, err error) string {
+	if resp == nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+// pause sleeps unless the request is canceled first
+func (p *retryPolicy) pause(d time.Duration, r *http.Request) bool {
+	if p.sleep != nil {
+		return p.sleep(d, r.Cancel)
+	}
+	return sleepUnlessCanceled(d, r)
+}
+
+// sleepUnlessCanceled sleeps for d, false if the request is canceled first
+func sleepUnlessCanceled(d time.Duration, r *http.Request) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Cancel:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (p *retryPolicy) rand() float64 {
+	if p.random != nil {
+		return p.random()
+	}
+	return rand.Float64()
+}
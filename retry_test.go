@@ -0,0 +1,235 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// scriptedSender answers with the same status, or error, to every request and counts them
+type scriptedSender struct {
+	status int
+	header http.Header
+	err    error
+	calls  int
+}
+
+func (s *scriptedSender) Do(r *http.Request) (*http.Response, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	header := http.Header{}
+	for k, v := range s.header {
+		header[k] = v
+	}
+	return &http.Response{
+		StatusCode: s.status,
+		Status:     strconv.Itoa(s.status) + " " + http.StatusText(s.status),
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, nil
+}
+
+// testRetryPolicy is the default policy with recorded sleeps and no jitter
+func testRetryPolicy(sleeps *[]time.Duration) *retryPolicy {
+	p := defaultRetryPolicy()
+	p.sleep = func(d time.Duration, cancel <-chan struct{}) bool {
+		*sleeps = append(*sleeps, d)
+		return true
+	}
+	p.random = func() float64 { return 1 }
+	return p
+}
+
+func sendWithPolicy(t *testing.T, p *retryPolicy, sender *scriptedSender, method string, path string) {
+	req, err := http.NewRequest(method, "https://management.azure.com"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := autorest.DecorateSender(sender, p.sendDecorator()).Do(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+}
+
+func TestRetryRules(t *testing.T) {
+	const serverPath = "/subscriptions/s/resourceGroups/rg/providers/Microsoft.DBforPostgreSQL/servers/srv"
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		sender scriptedSender
+		adjust func(p *retryPolicy)
+		calls  int
+	}{
+		{"throttled", http.MethodGet, serverPath, scriptedSender{status: 429}, nil, 7},
+		{"server error", http.MethodPut, serverPath, scriptedSender{status: 503}, nil, 4},
+		{"own rule", http.MethodGet, serverPath, scriptedSender{status: 409}, func(p *retryPolicy) {
+			p.Rules = append(p.Rules, retryRule{StatusCodes: []int{409}, Attempts: 1})
+		}, 2},
+		{"not found", http.MethodGet, serverPath, scriptedSender{status: 404}, nil, 1},
+		{"ok", http.MethodGet, serverPath, scriptedSender{status: 200}, nil, 1},
+		{"transport error", http.MethodGet, serverPath, scriptedSender{err: errors.New("connection reset")}, nil, 4},
+		{"cassette miss", http.MethodGet, serverPath, scriptedSender{err: cassetteMissError("no recorded response")}, nil, 1},
+		{"POST", http.MethodPost, serverPath + "/restart", scriptedSender{status: 503}, nil, 1},
+		{"POST to a retriable path", http.MethodPost, "/subscriptions/s/providers/Microsoft.DBforPostgreSQL/register", scriptedSender{status: 503}, nil, 4},
+		{"POST with retryPost", http.MethodPost, serverPath + "/restart", scriptedSender{status: 503}, func(p *retryPolicy) { p.RetryPOST = true }, 4},
+	}
+	for _, test := range tests {
+		var sleeps []time.Duration
+		p := testRetryPolicy(&sleeps)
+		if test.adjust != nil {
+			test.adjust(p)
+		}
+		sender := test.sender
+		sendWithPolicy(t, p, &sender, test.method, test.path)
+		if sender.calls != test.calls {
+			t.Errorf("%s: %d calls, want %d", test.name, sender.calls, test.calls)
+		}
+		if len(sleeps) != test.calls-1 {
+			t.Errorf("%s: %d pauses for %d calls", test.name, len(sleeps), sender.calls)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var sleeps []time.Duration
+	p := testRetryPolicy(&sleeps)
+	sendWithPolicy(t, p, &scriptedSender{status: 429}, http.MethodGet, "/subscriptions/s")
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second}
+	if len(sleeps) != len(want) {
+		t.Fatalf("sleeps %v, want %v", sleeps, want)
+	}
+	for i := range want {
+		if sleeps[i] != want[i] {
+			t.Errorf("sleep %d is %v, want %v", i, sleeps[i], want[i])
+		}
+	}
+
+	// full jitter and the maximum delay
+	p.random = func() float64 { return 0.5 }
+	if got := p.delay(10, nil); got != 30*time.Second {
+		t.Errorf("delay of attempt 10 is %v, want half of maxDelay", got)
+	}
+}
+
+func TestRetryAfterHeaders(t *testing.T) {
+	now := time.Date(2017, 9, 26, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"seconds", http.Header{"Retry-After": {"7"}}, 7 * time.Second},
+		{"http date", http.Header{"Retry-After": {now.Add(30 * time.Second).Format(http.TimeFormat)}}, 30 * time.Second},
+		{"past date", http.Header{"Retry-After": {now.Add(-time.Minute).Format(http.TimeFormat)}}, 0},
+		{"milliseconds", http.Header{"X-Ms-Retry-After-Ms": {"1500"}}, 1500 * time.Millisecond},
+		{"milliseconds first", http.Header{"X-Ms-Retry-After-Ms": {"250"}, "Retry-After": {"7"}}, 250 * time.Millisecond},
+		{"garbage", http.Header{"Retry-After": {"soon"}}, 0},
+		{"none", http.Header{}, 0},
+	}
+	for _, test := range tests {
+		if got := retryAfter(&http.Response{Header: test.header}, now); got != test.want {
+			t.Errorf("%s: retryAfter = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// Retry-After replaces the backoff, jitter is at most baseDelay
+	var sleeps []time.Duration
+	p := testRetryPolicy(&sleeps)
+	p.random = func() float64 { return 0 }
+	sendWithPolicy(t, p, &scriptedSender{status: 429, header: http.Header{"Retry-After": {"7"}}}, http.MethodGet, "/subscriptions/s")
+	for _, d := range sleeps {
+		if d != 7*time.Second {
+			t.Fatalf("sleeps %v, want 7s each", sleeps)
+		}
+	}
+}
+
+func TestRetryMaxElapsed(t *testing.T) {
+	var sleeps []time.Duration
+	p := testRetryPolicy(&sleeps)
+	sender := &scriptedSender{status: 429, header: http.Header{"Retry-After": {"600"}}}
+	sendWithPolicy(t, p, sender, http.MethodGet, "/subscriptions/s")
+	if sender.calls != 1 || len(sleeps) != 0 {
+		t.Errorf("a Retry-After beyond maxElapsed: %d calls, sleeps %v", sender.calls, sleeps)
+	}
+
+	p.MaxElapsed = 0
+	sender = &scriptedSender{status: 429, header: http.Header{"Retry-After": {"600"}}}
+	sendWithPolicy(t, p, sender, http.MethodGet, "/subscriptions/s")
+	if sender.calls != 7 {
+		t.Errorf("without maxElapsed: %d calls", sender.calls)
+	}
+}
+
+func TestRetryStopsWhenCanceled(t *testing.T) {
+	p := defaultRetryPolicy()
+	p.sleep = func(d time.Duration, cancel <-chan struct{}) bool { return false }
+	sender := &scriptedSender{status: 503}
+	sendWithPolicy(t, p, sender, http.MethodGet, "/subscriptions/s")
+	if sender.calls != 1 {
+		t.Errorf("%d calls after the pause was canceled", sender.calls)
+	}
+}
+
+// the clients send through autorest.Client.Do, whose own retry loop must not add a pause
+// after the policy gave up
+func TestARMClientAddsNoDelay(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	var sleeps []time.Duration
+	saved := armRetryPolicy
+	armRetryPolicy = testRetryPolicy(&sleeps)
+	defer func() { armRetryPolicy = saved }()
+
+	client := autorest.NewClientWithUserAgent("test")
+	useARMSender(&client, "00000000-0000-0000-0000-000000000000")
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	elapsed := time.Since(start)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("response %v, error %v", resp, err)
+	}
+	// the default policy retries a 503 three times
+	if calls != 4 || len(sleeps) != 3 {
+		t.Errorf("%d calls and %d pauses", calls, len(sleeps))
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("sending took %v with the pauses of the policy recorded", elapsed)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - role generate builds a custom role per persona from the actions its commands need
+//   (commandActions in preflight.go), so a generated role passes the permission preflight of
+//   those commands, plus the operations of the PostgreSQL catalog matching the persona's
+//   patterns and a few further actions
+// - the catalog is OperationsClient.List joined with ProviderOperationsMetadataClient.Get of
+//   Microsoft.DBforPostgreSQL; actions of other providers are checked against their provider
+//   operations metadata, so a role never carries a misspelled action ARM would ignore
+// - roles are printed in the JSON shape of 'az role definition create'; -apply creates or
+//   updates them with RoleDefinitionsClient, reusing the id of a role with the same name,
+//   otherwise a name based UUID so reruns update instead of duplicating
+// - -assign <principal object id> assigns the roles at the same scope with RoleAssignmentsClient;
+//   the assignment name is derived from role and principal so an existing one is kept; a
+//   RoleDefinitionDoesNotExist answer right after the role was created is retried until the
+//   definition has replicated
+//
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/authorization"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/satori/uuid"
+)
+
+const (
+	actionResourceGroupsRead   = "Microsoft.Resources/subscriptions/resourceGroups/read"
+	actionAlertRulesRead       = "Microsoft.Insights/alertRules/read"
+	actionDiagnosticsRead      = "Microsoft.Insights/diagnosticSettings/read"
+	defaultRoleNamePrefix      = "PostgreSQL "
+	roleAssignmentExistsCode   = "RoleAssignmentExists"
+	roleDefinitionMissingCode  = "RoleDefinitionDoesNotExist"
+	roleReplicationDelay       = 10 * time.Second
+	roleReplicationDuration    = 2 * time.Minute
+	providerOperationsExpand   = "resourceTypes"
+	customRoleType             = "CustomRole"
+	roleDefinitionsProviderFmt = "%s/providers/Microsoft.Authorization/roleDefinitions/%s"
+)
+
+// namespace of the ids of generated roles and assignments
+var roleNamespace = uuid.NewV5(uuid.NamespaceURL, "https://github.com/Azure/azure-postgresql-go-sample/roles")
+
+// persona is a kind of user of the sample with its own least-privilege role
+type persona struct {
+	description string
+	// commands whose commandActions the role grants
+	commands []string
+	// patterns selecting operations of the PostgreSQL catalog
+	operations []string
+	// further actions, mostly of other providers
+	actions []string
+}
+
+var personas = map[string]persona{
+	"broker": {
+		description: "Creates, configures and deletes PostgreSQL servers, firewall rules and databases, and registers the provider (which only works with the role at subscription scope)",
+		commands:    []string{sampleCommand, "server delete", "janitor"},
+		operations:  []string{postgresqlProviderNamespace + "/servers/*"},
+		// the sample flow with -register-provider
+		actions: []string{actionResourceGroupsRead, actionProviderRegister},
+	},
+	"operator": {
+		description: "Scales, tags, protects and monitors PostgreSQL servers and rotates their passwords, without deleting them (the servers/write action this needs also allows creating servers)",
+		commands: []string{"server scale", "autoscale", "password rotate", "tags set", "tags unset",
+			"lock add", "lock remove", "alerts apply", "diagnostics apply"},
+		operations: []string{postgresqlProviderNamespace + "/*/read"},
+		actions:    []string{actionResourceGroupsRead, actionLocksRead, actionMetricsRead, actionAlertRulesRead, actionDiagnosticsRead},
+	},
+	"auditor": {
+		description: "Reads PostgreSQL servers and their settings, locks, alerts and metrics",
+		operations:  []string{postgresqlProviderNamespace + "/*/read"},
+		actions:     []string{actionResourceGroupsRead, actionLocksRead, actionMetricsRead, actionAlertRulesRead, actionDiagnosticsRead},
+	},
+}
+
+// roleDefinition is a custom role in the shape of 'az role definition create'
+type roleDefinition struct {
+	Name             string
+	ID               string `json:"Id,omitempty"`
+	IsCustom         bool
+	Description      string
+	Actions          []string
+	NotActions       []string
+	AssignableScopes []string
+}
+
+func init() {
+	registerCommand(command{
+		name:         "role generate",
+		summary:      "Generate least-privilege custom roles for the broker, operator and auditor",
+		needsClients: true,
+		run:          runRoleGenerate,
+	})
+}
+
+func runRoleGenerate(args []string) {
+	flags := newFlagSet("role generate")
+	var names stringsFlag
+	flags.Var(&names, "persona", "persona to generate a role for: broker, operator or auditor (repeatable, default all)")
+	group := flags.String("resource-group", "", "resource group the roles are assignable in (default the subscription)")
+	prefix := flags.String("name-prefix", defaultRoleNamePrefix, "prefix of the role names")
+	apply := flags.Bool("apply", false, "create or update the roles")
+	principal := flags.String("assign", "", "object id of a user, group or service principal to assign the roles to (implies -apply)")
+	flags.Parse(args)
+
+	if len(names) == 0 {
+		for name := range personas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	scope := "/subscriptions/" + armSubscriptionID
+	if *group != "" {
+		scope += "/resourceGroups/" + *group
+	}
+	catalog, err := newActionCatalog()
+	onErrorFail(err, "Reading the operations catalog failed")
+
+	var roles []*roleDefinition
+	for _, name := range names {
+		p, ok := personas[name]
+		if !ok {
+			fmt.Printf("Unknown persona %q, expected broker, operator or auditor\n", name)
+			os.Exit(2)
+		}
+		role, err := catalog.role(*prefix+strings.ToUpper(name[:1])+name[1:], p, scope)
+		onErrorFail(err, "Generating the "+name+" role failed")
+		roles = append(roles, role)
+	}
+
+	if *apply || *principal != "" {
+		for _, role := range roles {
+			onErrorFail(applyRoleDefinition(role, scope), "Creating role "+role.Name+" failed")
+			fmt.Fprintf(os.Stderr, "Role %s is %s\n", role.Name, role.ID)
+			if *principal != "" {
+				created, err := assignRole(role, scope, *principal)
+				onErrorFail(err, "Assigning role "+role.Name+" failed")
+				if created {
+					fmt.Fprintf(os.Stderr, "Assigned %s to %s at %s\n", role.Name, *principal, scope)
+				} else {
+					fmt.Fprintf(os.Stderr, "%s already has %s at %s\n", *principal, role.Name, scope)
+				}
+			}
+		}
+	}
+	if len(roles) == 1 {
+		fmt.Println(toJSON(roles[0]))
+	} else {
+		fmt.Println(toJSON(roles))
+	}
+}
+
+// actionCatalog holds the operations of each provider by lowercased name
+type actionCatalog struct {
+	providers map[string]map[string]string
+}
+
+// newActionCatalog reads the PostgreSQL operations, further providers are read when needed
+func newActionCatalog() (*actionCatalog, error) {
+	c := &actionCatalog{providers: map[string]map[string]string{}}
+	if err := loadOperationsCatalog(); err != nil {
+		return nil, err
+	}
+	operations, err := c.provider(postgresqlProviderNamespace)
+	if err != nil {
+		return nil, err
+	}
+	for key, op := range operationsCatalog {
+		operations[key] = to.String(op.Name)
+	}
+	return c, nil
+}
+
+// provider returns the operations of a provider from its operations metadata
+func (c *actionCatalog) provider(namespace string) (map[string]string, error) {
+	key := strings.ToLower(namespace)
+	if operations, ok := c.providers[key]; ok {
+		return operations, nil
+	}
+	client := authorization.NewProviderOperationsMetadataClient(armSubscriptionID)
+	client.Authorizer = armAuthorizer
+	useARMSender(&client.Client, armSubscriptionID)
+	metadata, err := client.Get(namespace, providerOperationsExpand)
+	if err != nil {
+		return nil, fmt.Errorf("reading the operations of %s: %v", namespace, err)
+	}
+	operations := map[string]string{}
+	add := func(ops *[]authorization.ProviderOperation) {
+		if ops == nil {
+			return
+		}
+		for _, op := range *ops {
+			if op.Name != nil {
+				operations[strings.ToLower(*op.Name)] = *op.Name
+			}
+		}
+	}
+	add(metadata.Operations)
+	if metadata.ResourceTypes != nil {
+		for _, t := range *metadata.ResourceTypes {
+			add(t.Operations)
+		}
+	}
+	c.providers[key] = operations
+	return operations, nil
+}
+
+// role collects the actions of a persona, each checked against the catalog of its provider
+func (c *actionCatalog) role(name string, p persona, scope string) (*roleDefinition, error) {
+	actions := map[string]string{}
+	postgres, _ := c.provider(postgresqlProviderNamespace)
+	for key, action := range postgres {
+		if anyActionMatches(p.operations, action) {
+			actions[key] = action
+		}
+	}
+	required := append([]string{}, p.actions...)
+	for _, command := range p.commands {
+		required = append(required, commandActions[command]...)
+	}
+	for _, action := range required {
+		namespace := strings.SplitN(action, "/", 2)[0]
+		operations, err := c.provider(namespace)
+		if err != nil {
+			return nil, err
+		}
+		spelled, ok := operations[strings.ToLower(action)]
+		if !ok {
+			return nil, fmt.Errorf("%s is not an operation of %s", action, namespace)
+		}
+		actions[strings.ToLower(action)] = spelled
+	}
+
+	role := &roleDefinition{
+		Name:             name,
+		IsCustom:         true,
+		Description:      p.description,
+		NotActions:       []string{},
+		AssignableScopes: []string{scope},
+	}
+	for _, action := range actions {
+		role.Actions = append(role.Actions, action)
+	}
+	sort.Slice(role.Actions, func(i, j int) bool {
+		return strings.ToLower(role.Actions[i]) < strings.ToLower(role.Actions[j])
+	})
+	return role, nil
+}
+
+// pathScope returns a scope as the authorization clients put it after the "/" of their paths
+func pathScope(scope string) string {
+	return strings.TrimPrefix(scope, "/")
+}
+
+func newRoleDefinitionsClient() authorization.RoleDefinitionsClient {
+	client := authorization.NewRoleDefinitionsClient(armSubscriptionID)
+	client.Authorizer = armAuthorizer
+	useARMSender(&client.Client, armSubscriptionID)
+	return client
+}
+
+// applyRoleDefinition creates or updates a role and sets its id
+func applyRoleDefinition(role *roleDefinition, scope string) error {
+	client := newRoleDefinitionsClient()
+	roleID := uuid.NewV5(roleNamespace, strings.ToLower(scope+"|"+role.Name)).String()
+	existing, err := client.List(pathScope(scope), fmt.Sprintf("roleName eq '%s'", role.Name))
+	if err != nil {
+		return err
+	}
+	if existing.Value != nil {
+		for _, r := range *existing.Value {
+			if r.Properties != nil && strings.EqualFold(to.String(r.Properties.RoleName), role.Name) && r.Name != nil {
+				roleID = *r.Name
+			}
+		}
+	}
+	permissions := []authorization.Permission{{Actions: &role.Actions, NotActions: &role.NotActions}}
+	result, err := client.CreateOrUpdate(pathScope(scope), roleID, authorization.RoleDefinition{
+		Name: to.StringPtr(roleID),
+		Properties: &authorization.RoleDefinitionProperties{
+			RoleName:         to.StringPtr(role.Name),
+			Description:      to.StringPtr(role.Description),
+			Type:             to.StringPtr(customRoleType),
+			Permissions:      &permissions,
+			AssignableScopes: &role.AssignableScopes,
+		},
+	})
+	if err != nil {
+		return withRemediation(err, "writing role definition "+role.Name)
+	}
+	role.ID = to.String(result.ID)
+	if role.ID == "" {
+		role.ID = fmt.Sprintf(roleDefinitionsProviderFmt, scope, roleID)
+	}
+	return nil
+}
+
+// assignRole assigns a role to a principal at scope, false if it already was. A role
+// definition that was just created may not have replicated yet, its assignment is retried
+// for up to roleReplicationDuration.
+func assignRole(role *roleDefinition, scope string, principalID string) (bool, error) {
+	client := authorization.NewRoleAssignmentsClient(armSubscriptionID)
+	client.Authorizer = armAuthorizer
+	useARMSender(&client.Client, armSubscriptionID)
+	name := uuid.NewV5(roleNamespace, strings.ToLower(scope+"|"+role.ID+"|"+principalID)).String()
+	deadline := time.Now().Add(roleReplicationDuration)
+	for {
+		_, err := client.Create(pathScope(scope), name, authorization.RoleAssignmentCreateParameters{
+			Properties: &authorization.RoleAssignmentProperties{
+				RoleDefinitionID: to.StringPtr(role.ID),
+				PrincipalID:      to.StringPtr(principalID),
+			},
+		})
+		if err == nil {
+			return true, nil
+		}
+		statusCode, code := armError(err)
+		if statusCode == http.StatusConflict && code == roleAssignmentExistsCode {
+			return false, nil
+		}
+		if statusCode != http.StatusBadRequest || code != roleDefinitionMissingCode {
+			return false, withRemediation(err, "assigning role "+role.Name)
+		}
+		if !time.Now().Before(deadline) {
+			return false, fmt.Errorf("Role %s is still unknown to role assignments after %v.\nRemediation: rerun 'role generate -assign %s' in a few minutes",
+				role.Name, roleReplicationDuration, principalID)
+		}
+		fmt.Fprintf(os.Stderr, "Role %s has not replicated yet, retrying in %v\n", role.Name, roleReplicationDelay)
+		time.Sleep(roleReplicationDelay)
+	}
+}
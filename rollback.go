@@ -0,0 +1,198 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - a transaction records every resource a command creates; when the command fails
+//   (onErrorFail) or is interrupted the resources are deleted again in reverse order
+// - with -keep-on-failure the resources are only listed, not deleted
+// - servers are only deleted while checkDeletionAllowed allows it, a server protected meanwhile is kept
+// - passwords stored for a server being created are marked failed when it is rolled back
+//
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/Azure/azure-sdk-for-go/arm/monitor"
+)
+
+// createdResource is something a command created together with how to delete it
+type createdResource struct {
+	kind string
+	name string
+	undo func() error
+	// what undo does, as in "deleting server x" and "deleted server x"
+	undoing string
+	undone  string
+}
+
+// transaction records created resources so a failed command can remove them
+type transaction struct {
+	mu            sync.Mutex
+	created       []createdResource
+	keepOnFailure bool
+	finished      bool
+}
+
+// activeTransaction is rolled back by onErrorFail, nil if the command does not use one
+var activeTransaction *transaction
+
+// beginTransaction starts recording created resources and rolls them back on SIGINT/SIGTERM
+func beginTransaction(keepOnFailure bool) *transaction {
+	t := &transaction{keepOnFailure: keepOnFailure}
+	activeTransaction = t
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-interrupted
+		t.rollback(fmt.Sprintf("interrupted by %v", sig))
+		os.Exit(130)
+	}()
+	return t
+}
+
+func (t *transaction) record(kind string, name string, undo func() error) {
+	t.recordUndo(createdResource{kind: kind, name: name, undo: undo, undoing: "deleting", undone: "deleted"})
+}
+
+func (t *transaction) recordUndo(r createdResource) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.created = append(t.created, r)
+}
+
+// recordResourceGroup records a created resource group
+func (t *transaction) recordResourceGroup(name string) {
+	t.record("resource group", name, func() error {
+		_, errChannel := groupsClient.Delete(name, nil)
+		return <-errChannel
+	})
+}
+
+// recordServer records a created server; it is not deleted once it was protected (see protect.go)
+func (t *transaction) recordServer(resourceGroup string, serverName string) {
+	t.record("server", resourceGroup+"/"+serverName, func() error {
+		server, err := serversClient.Get(resourceGroup, serverName)
+		if statusCode, _ := armError(err); err != nil && statusCode != http.StatusNotFound {
+			return err
+		}
+		// a server still being created may not be readable yet, it can not be protected either
+		if err == nil {
+			if err := checkDeletionAllowed(resourceGroup, server); err != nil {
+				return err
+			}
+		}
+		_, errChannel := serversClient.Delete(resourceGroup, serverName, nil)
+		return <-errChannel
+	})
+}
+
+// recordCredential records a password version stored for a server being created, it is
+// marked failed when the creation is rolled back
+func (t *transaction) recordCredential(resourceGroup string, serverName string, version int) {
+	if secretStore == nil {
+		return
+	}
+	t.recordUndo(createdResource{
+		kind: "stored password",
+		name: fmt.Sprintf("%s/%s version %d", resourceGroup, serverName, version),
+		undo: func() error {
+			return setCredentialStatus(secretStore, resourceGroup, serverName, version, credentialFailed)
+		},
+		undoing: "marking failed",
+		undone:  "marked failed",
+	})
+}
+
+// recordFirewallRule records a created firewall rule
+func (t *transaction) recordFirewallRule(resourceGroup string, serverName string, ruleName string) {
+	t.record("firewall rule", resourceGroup+"/"+serverName+"/"+ruleName, func() error {
+		_, errChannel := firewallRulesClient.Delete(resourceGroup, serverName, ruleName, nil)
+		return <-errChannel
+	})
+}
+
+// recordDatabase records a created database
+func (t *transaction) recordDatabase(resourceGroup string, serverName string, databaseName string) {
+	t.record("database", resourceGroup+"/"+serverName+"/"+databaseName, func() error {
+		_, errChannel := databasesClient.Delete(resourceGroup, serverName, databaseName, nil)
+		return <-errChannel
+	})
+}
+
+// recordAlertRule records a created alert rule
+func (t *transaction) recordAlertRule(resourceGroup string, ruleName string) {
+	t.record("alert rule", resourceGroup+"/"+ruleName, func() error {
+		_, err := monitor.AlertRulesClient{ManagementClient: monitorClient}.Delete(resourceGroup, ruleName)
+		return err
+	})
+}
+
+// commit ends the transaction keeping everything that was created
+func (t *transaction) commit() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished = true
+	if activeTransaction == t {
+		activeTransaction = nil
+	}
+}
+
+// rollback deletes the created resources, newest first, and logs what was cleaned up
+func (t *transaction) rollback(reason string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.finished = true
+	if len(t.created) == 0 {
+		return
+	}
+
+	if t.keepOnFailure {
+		fmt.Printf("Command failed (%s), keeping created resources (-keep-on-failure):\n", reason)
+		for _, r := range t.created {
+			fmt.Printf("  kept %s %s\n", r.kind, r.name)
+		}
+		return
+	}
+	fmt.Printf("Command failed (%s), rolling back %d created resources\n", reason, len(t.created))
+	for i := len(t.created) - 1; i >= 0; i-- {
+		r := t.created[i]
+		fmt.Printf("  %s %s %s\n", r.undoing, r.kind, r.name)
+		if err := r.undo(); err != nil {
+			fmt.Printf("  FAILED %s %s %s, finish it by hand: %v\n", r.undoing, r.kind, r.name, err)
+			continue
+		}
+		fmt.Printf("  %s %s %s\n", r.undone, r.kind, r.name)
+	}
+}
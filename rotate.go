@@ -0,0 +1,247 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - every new password is written to the secret store as "pending" before it is set,
+//   so the only known credential is never lost, even if the process dies mid-update
+// - if a login with the new password can not be verified the previous active
+//   password from the store (if any) is put back
+//
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// rotation results
+const (
+	rotationRotated    = "rotated"
+	rotationVerified   = "verified"
+	rotationRolledBack = "rolled-back"
+	rotationFailed     = "failed"
+)
+
+// attempts to log in with a new password; it may take a moment to be effective
+const (
+	probeAttempts = 3
+	probeDelay    = 10 * time.Second
+)
+
+func init() {
+	registerCommand(command{
+		name:         "password rotate",
+		summary:      "generate and set new administrator passwords on servers selected by tag or name",
+		needsClients: true,
+		run:          runPasswordRotate,
+	})
+}
+
+// rotationResult is one line of the rotation report
+type rotationResult struct {
+	ResourceGroup string `json:"resourceGroup"`
+	Server        string `json:"server"`
+	Result        string `json:"result"`
+	Error         string `json:"error,omitempty"`
+}
+
+// passwordRotator rotates administrator passwords, recording every password in store
+type passwordRotator struct {
+	client         postgresql.ServersClient
+	store          SecretStore
+	passwordLength int
+	verify         bool
+	database       string
+}
+
+func runPasswordRotate(args []string) {
+	flags := newFlagSet("password rotate")
+	filter := addServerFilterFlags(flags)
+	all := flags.Bool("all", false, "rotate every server in the subscription when no filter is given")
+	parallel := flags.Int("parallel", 4, "number of servers rotated concurrently")
+	length := flags.Int("length", 24, "length of the generated passwords")
+	verify := flags.Bool("verify", true, "verify the new password with a probe login, roll back on failure")
+	database := flags.String("database", "postgres", "database used for the probe login")
+	storeSpec := flags.String("secret-store", os.Getenv("SECRET_STORE"), "where passwords are stored: encfile:<path>, files:<dir> or a vault url")
+	format := flags.String("format", "table", "report format: table or json")
+	dryRun := flags.Bool("dry-run", false, "only list the servers that would be rotated")
+	flags.Parse(args)
+
+	if !*all && filter.empty() {
+		fmt.Println("Select servers with -server, -tag, -name or -resource-group, or pass -all")
+		os.Exit(2)
+	}
+	if *storeSpec == "" {
+		fmt.Println("Missing -secret-store (or SECRET_STORE), generated passwords must be stored")
+		os.Exit(2)
+	}
+	store, err := newSecretStore(*storeSpec)
+	onErrorFail(err, "Creating secret store failed")
+	servers, err := listServers(serversClient, filter)
+	onErrorFail(err, "Listing servers failed")
+	if *dryRun {
+		for _, server := range servers {
+			fmt.Printf("would rotate %s/%s\n", resourceGroupFromID(to.String(server.ID)), to.String(server.Name))
+		}
+		return
+	}
+	requirePermissions("password rotate", serverResourceGroups(servers))
+
+	rotator := passwordRotator{client: serversClient, store: store, passwordLength: *length, verify: *verify, database: *database}
+	results := rotator.rotateAll(servers, *parallel)
+	if *format == "json" {
+		fmt.Println(toJSON(results))
+	} else {
+		writeRotationReport(os.Stdout, results)
+	}
+	for _, r := range results {
+		if r.Result == rotationFailed {
+			os.Exit(1)
+		}
+	}
+}
+
+// rotateAll rotates the servers with at most parallel updates in flight
+func (r *passwordRotator) rotateAll(servers []postgresql.Server, parallel int) []rotationResult {
+	if parallel < 1 {
+		parallel = 1
+	}
+	results := make([]rotationResult, len(servers))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, server postgresql.Server) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = r.rotate(server)
+			fmt.Printf("%s/%s: %s %s\n", results[i].ResourceGroup, results[i].Server, results[i].Result, results[i].Error)
+		}(i, server)
+	}
+	wg.Wait()
+	return results
+}
+
+// rotate sets a new password on one server
+func (r *passwordRotator) rotate(server postgresql.Server) rotationResult {
+	name := to.String(server.Name)
+	group := resourceGroupFromID(to.String(server.ID))
+	result := rotationResult{ResourceGroup: group, Server: name, Result: rotationFailed}
+	fail := func(err error, message string) rotationResult {
+		result.Result = rotationFailed
+		result.Error = fmt.Sprintf("%s: %v", message, err)
+		return result
+	}
+	if server.ServerProperties == nil || server.AdministratorLogin == nil {
+		return fail(fmt.Errorf("no administrator login"), "Server details incomplete")
+	}
+
+	previous, err := activeCredential(r.store, group, name)
+	if err != nil {
+		return fail(err, "Reading previous credential failed")
+	}
+	password, err := generatePassword(r.passwordLength)
+	if err != nil {
+		return fail(err, "Generating password failed")
+	}
+	cred := credential{
+		ResourceGroup: group,
+		Server:        name,
+		Login:         *server.AdministratorLogin,
+		Password:      password,
+	}
+	// nothing is changed unless the new password is safely stored first
+	version, err := storeNewCredential(r.store, group, name, cred.Login, password)
+	if err != nil {
+		return fail(err, "Storing new password failed")
+	}
+	setStatus := func(status string) error {
+		return setCredentialStatus(r.store, group, name, version, status)
+	}
+
+	if _, err := setAdministratorPassword(r.client, group, name, password); err != nil {
+		// the update may or may not have been applied, both passwords stay in the store
+		setStatus(credentialUnverified)
+		return fail(err, fmt.Sprintf("Password update failed, version %d in the secret store may be in effect", version))
+	}
+	result.Result = rotationRotated
+	if !r.verify {
+		if err := setStatus(credentialActive); err != nil {
+			return fail(err, "Password was changed but marking it active failed, it is stored as pending")
+		}
+		return result
+	}
+
+	probeErr := r.probe(server, cred)
+	if probeErr == nil {
+		if err := setStatus(credentialActive); err != nil {
+			return fail(err, "Password was changed but marking it active failed, it is stored as pending")
+		}
+		result.Result = rotationVerified
+		return result
+	}
+
+	if previous == nil {
+		// the new password is the only one known, keep it
+		setStatus(credentialUnverified)
+		return fail(probeErr, "Login with the new password failed and there is no previous password to roll back to")
+	}
+	if _, err := setAdministratorPassword(r.client, group, name, previous.Password); err != nil {
+		setStatus(credentialUnverified)
+		return fail(err, fmt.Sprintf("Login with the new password failed (%v) and rolling back failed", probeErr))
+	}
+	// the previous version was never superseded, it is still the active one
+	setStatus(credentialFailed)
+	result.Result = rotationRolledBack
+	result.Error = fmt.Sprintf("Login with the new password failed: %v", probeErr)
+	return result
+}
+
+// probe logs in with the credential, retrying while the new password propagates
+func (r *passwordRotator) probe(server postgresql.Server, cred credential) error {
+	host := to.String(server.FullyQualifiedDomainName)
+	if host == "" {
+		return fmt.Errorf("Server %s has no fully qualified domain name", cred.Server)
+	}
+	var err error
+	for attempt := 1; attempt <= probeAttempts; attempt++ {
+		err = probeLogin(host, azureLoginUser(cred.Login, cred.Server), cred.Password, r.database, defaultProbeTimeout)
+		if err == nil {
+			return nil
+		}
+		if attempt < probeAttempts {
+			time.Sleep(probeDelay)
+		}
+	}
+	return err
+}
+
+func writeRotationReport(w io.Writer, results []rotationResult) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESOURCE GROUP\tSERVER\tRESULT\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.ResourceGroup, r.Server, r.Result, r.Error)
+	}
+	tw.Flush()
+}
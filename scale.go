@@ -0,0 +1,197 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - scaling stays within the tier of the server and is checked against the SKU catalog
+// - storage can only grow, Azure can not shrink the storage of a server
+// - after the update the server is polled until it is Ready and the new values are read back
+//
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	readyPollingDelay    = 10 * time.Second
+	readyPollingDuration = 30 * time.Minute
+)
+
+func init() {
+	registerCommand(command{
+		name:         "server scale",
+		summary:      "change compute units and/or grow storage of a server, showing the cost change",
+		needsClients: true,
+		run:          runServerScale,
+	})
+}
+
+// scalePlan is the change of a server's size
+type scalePlan struct {
+	ResourceGroup    string             `json:"resourceGroup"`
+	Server           string             `json:"server"`
+	Tier             postgresql.SkuTier `json:"tier"`
+	FromComputeUnits int32              `json:"fromComputeUnits"`
+	ToComputeUnits   int32              `json:"toComputeUnits"`
+	FromStorageMB    int64              `json:"fromStorageMB"`
+	ToStorageMB      int64              `json:"toStorageMB"`
+	FromMonthlyCost  float64            `json:"fromMonthlyCostUSD"`
+	ToMonthlyCost    float64            `json:"toMonthlyCostUSD"`
+
+	sku *postgresql.Sku
+}
+
+// changed reports whether the plan changes anything
+func (p *scalePlan) changed() bool {
+	return p.FromComputeUnits != p.ToComputeUnits || p.FromStorageMB != p.ToStorageMB
+}
+
+func runServerScale(args []string) {
+	flags := newFlagSet("server scale")
+	group := flags.String("resource-group", resourceGroupName, "resource group of the server")
+	name := flags.String("server", "", "server to scale")
+	computeUnits := flags.Int("compute-units", 0, "new compute units (default unchanged)")
+	storageMB := flags.Int64("storage-mb", 0, "new storage size in MB, can only grow (default unchanged)")
+	storageGB := flags.Int64("storage-gb", 0, "new storage size in GB, alternative to -storage-mb")
+	dryRun := flags.Bool("dry-run", false, "only show the change and its cost")
+	flags.Parse(args)
+	if *name == "" {
+		fmt.Println("Missing -server")
+		os.Exit(2)
+	}
+	if *storageGB != 0 {
+		*storageMB = *storageGB * 1024
+	}
+
+	server, err := serversClient.Get(*group, *name)
+	onErrorFail(err, "Get server details failed")
+	plan, err := planScale(*group, server, int32(*computeUnits), *storageMB)
+	onErrorFail(err, "Invalid scale request")
+	writeScalePlan(os.Stdout, plan)
+	if !plan.changed() {
+		fmt.Println("Nothing to change")
+		return
+	}
+	if *dryRun {
+		return
+	}
+	requirePermissions("server scale", []string{*group})
+	onErrorFail(applyScale(plan), "Scaling failed")
+	fmt.Printf("Scaled %s/%s\n", plan.ResourceGroup, plan.Server)
+}
+
+// planScale checks the new size of a server; 0 keeps the current compute units or storage
+func planScale(resourceGroup string, server postgresql.Server, computeUnits int32, storageMB int64) (*scalePlan, error) {
+	if server.Sku == nil || server.ServerProperties == nil {
+		return nil, fmt.Errorf("Server %s has no SKU or properties", to.String(server.Name))
+	}
+	plan := &scalePlan{
+		ResourceGroup:    resourceGroup,
+		Server:           to.String(server.Name),
+		Tier:             server.Sku.Tier,
+		FromComputeUnits: to.Int32(server.Sku.Capacity),
+		FromStorageMB:    to.Int64(server.StorageMB),
+	}
+	plan.ToComputeUnits, plan.ToStorageMB = computeUnits, storageMB
+	if plan.ToComputeUnits == 0 {
+		plan.ToComputeUnits = plan.FromComputeUnits
+	}
+	if plan.ToStorageMB == 0 {
+		plan.ToStorageMB = plan.FromStorageMB
+	}
+	if plan.ToStorageMB < plan.FromStorageMB {
+		return nil, fmt.Errorf("Storage can only grow, server %s has %d MB and %d MB was requested", plan.Server, plan.FromStorageMB, plan.ToStorageMB)
+	}
+	sku, _, err := resolveSku(server.Version, plan.Tier, plan.ToComputeUnits, plan.ToStorageMB)
+	if err != nil {
+		return nil, err
+	}
+	plan.sku = sku
+	tier, _ := findSkuTier(plan.Tier)
+	plan.FromMonthlyCost = tier.monthlyCost(plan.FromComputeUnits, plan.FromStorageMB)
+	plan.ToMonthlyCost = tier.monthlyCost(plan.ToComputeUnits, plan.ToStorageMB)
+	return plan, nil
+}
+
+func writeScalePlan(w io.Writer, plan *scalePlan) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "SERVER\t%s/%s (%s)\n", plan.ResourceGroup, plan.Server, plan.Tier)
+	fmt.Fprintln(tw, "\tBEFORE\tAFTER")
+	fmt.Fprintf(tw, "compute units\t%d\t%d\n", plan.FromComputeUnits, plan.ToComputeUnits)
+	fmt.Fprintf(tw, "storage MB\t%d\t%d\n", plan.FromStorageMB, plan.ToStorageMB)
+	fmt.Fprintf(tw, "est. USD/month\t%.2f\t%.2f (%+.2f)\n", plan.FromMonthlyCost, plan.ToMonthlyCost, plan.ToMonthlyCost-plan.FromMonthlyCost)
+	tw.Flush()
+}
+
+// applyScale updates the server, waits until it is Ready and verifies the new size
+func applyScale(plan *scalePlan) error {
+	parameters := postgresql.ServerUpdateParameters{}
+	if plan.ToComputeUnits != plan.FromComputeUnits {
+		parameters.Sku = plan.sku
+	}
+	if plan.ToStorageMB != plan.FromStorageMB {
+		parameters.ServerUpdateParametersProperties = &postgresql.ServerUpdateParametersProperties{
+			StorageMB: to.Int64Ptr(plan.ToStorageMB),
+		}
+	}
+	fmt.Printf("Updating %s/%s\n", plan.ResourceGroup, plan.Server)
+	_, errChannel := serversClient.Update(plan.ResourceGroup, plan.Server, parameters, nil)
+	if err := <-errChannel; err != nil {
+		return err
+	}
+
+	server, err := waitForServerReady(plan.ResourceGroup, plan.Server)
+	if err != nil {
+		return err
+	}
+	if server.Sku == nil || to.Int32(server.Sku.Capacity) != plan.ToComputeUnits {
+		return fmt.Errorf("Server %s reports a different size after the update: %s", plan.Server, toJSON(server.Sku))
+	}
+	if server.ServerProperties == nil || to.Int64(server.StorageMB) != plan.ToStorageMB {
+		return fmt.Errorf("Server %s reports a different storage size after the update: %d MB", plan.Server, to.Int64(server.StorageMB))
+	}
+	return nil
+}
+
+// waitForServerReady polls the server until its state is Ready
+func waitForServerReady(resourceGroup string, serverName string) (postgresql.Server, error) {
+	deadline := time.Now().Add(readyPollingDuration)
+	for {
+		server, err := serversClient.Get(resourceGroup, serverName)
+		if err != nil {
+			return server, err
+		}
+		state := postgresql.ServerState("")
+		if server.ServerProperties != nil {
+			state = server.UserVisibleState
+		}
+		if state == postgresql.Ready {
+			return server, nil
+		}
+		if time.Now().After(deadline) {
+			return server, fmt.Errorf("Server %s is still %s after %v", serverName, state, readyPollingDuration)
+		}
+		fmt.Printf("Server %s is %s, waiting\n", serverName, state)
+		time.Sleep(readyPollingDelay)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PBKDF2 iterations deriving the encryption key of an encrypted file from its passphrase
+const secretFileIterations = 200000
+
+// encryptedFile is the on-disk format of encryptedFileSecretBackend
+type encryptedFile struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// encryptedFileSecretBackend keeps all records in one AES-256-GCM encrypted file
+type encryptedFileSecretBackend struct {
+	path       string
+	passphrase string
+}
+
+// read decrypts the file, returning the records and the salt the key was derived with
+func (b *encryptedFileSecretBackend) read() (map[string]*secretRecord, []byte, error) {
+	records := map[string]*secretRecord{}
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return records, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, salt, err := openEncryptedFile(b.passphrase, data)
+	if err == errDecryptionFailed {
+		return nil, nil, fmt.Errorf("%s: decryption failed, wrong SECRET_STORE_PASSPHRASE?", b.path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", b.path, err)
+	}
+	if err := json.Unmarshal(plaintext, &records); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", b.path, err)
+	}
+	return records, salt, nil
+}
+
+// errDecryptionFailed is returned by openEncryptedFile for a wrong passphrase or a damaged file
+var errDecryptionFailed = errors.New("decryption failed")
+
+// openEncryptedFile decrypts data written by sealEncryptedFile, returning the plaintext and
+// the salt the key was derived with
+func openEncryptedFile(passphrase string, data []byte) ([]byte, []byte, error) {
+	var file encryptedFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, err
+	}
+	gcm, err := encryptedFileCipher(passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := gcm.Open(nil, file.Nonce, file.Ciphertext, nil)
+	if err != nil {
+		return nil, nil, errDecryptionFailed
+	}
+	return plaintext, file.Salt, nil
+}
+
+// sealEncryptedFile encrypts plaintext with AES-256-GCM, a nil salt is replaced by a new one
+func sealEncryptedFile(passphrase string, salt []byte, plaintext []byte) ([]byte, error) {
+	file := encryptedFile{KDF: "pbkdf2-sha256", Iterations: secretFileIterations, Salt: salt}
+	if file.Salt == nil {
+		file.Salt = make([]byte, 16)
+		if _, err := rand.Read(file.Salt); err != nil {
+			return nil, err
+		}
+	}
+	gcm, err := encryptedFileCipher(passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return nil, err
+	}
+	file.Ciphertext = gcm.Seal(nil, file.Nonce, plaintext, nil)
+	return json.MarshalIndent(file, "", "  ")
+}
+
+func encryptedFileCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2SHA256([]byte(passphrase), salt, iterations))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (b *encryptedFileSecretBackend) load(key string) (*secretRecord, error) {
+	records, _, err := b.read()
+	if err != nil {
+		return nil, err
+	}
+	if record, ok := records[key]; ok {
+		return record, nil
+	}
+	return &secretRecord{}, nil
+}
+
+// lock locks the whole file, it holds every key
+func (b *encryptedFileSecretBackend) lock(key string) (func(), error) {
+	return lockFile(b.path + ".lock")
+}
+
+func (b *encryptedFileSecretBackend) save(key string, record *secretRecord) error {
+	records, salt, err := b.read()
+	if err != nil {
+		return err
+	}
+	records[key] = record
+	plaintext, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	data, err := sealEncryptedFile(b.passphrase, salt, plaintext)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.path, data, 0600)
+}
+
+// dirSecretBackend keeps each record in <dir>/<resource group>/<server>/versions.json and
+// the active password in a plain "password" file next to it, the layout of a mounted
+// secrets volume that applications can read
+type dirSecretBackend struct {
+	dir string
+}
+
+func (b *dirSecretBackend) keyDir(key string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(key))
+}
+
+func (b *dirSecretBackend) load(key string) (*secretRecord, error) {
+	record := &secretRecord{}
+	data, err := ioutil.ReadFile(filepath.Join(b.keyDir(key), "versions.json"))
+	if os.IsNotExist(err) {
+		return record, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	return record, nil
+}
+
+func (b *dirSecretBackend) lock(key string) (func(), error) {
+	dir := b.keyDir(key)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return lockFile(filepath.Join(dir, "versions.json.lock"))
+}
+
+func (b *dirSecretBackend) save(key string, record *secretRecord) error {
+	dir := b.keyDir(key)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "versions.json"), data, 0600); err != nil {
+		return err
+	}
+	for i := len(record.Versions) - 1; i >= 0; i-- {
+		if c := record.Versions[i]; c.Status == credentialActive {
+			if err := writeFileAtomic(filepath.Join(dir, "login"), []byte(c.Login), 0600); err != nil {
+				return err
+			}
+			return writeFileAtomic(filepath.Join(dir, "password"), []byte(c.Password), 0600)
+		}
+	}
+	return nil
+}
+
+// httpSecretBackend stores records in a vault style key/value API (KV version 2):
+// GET <base>/data/<key> returns {"data": {"data": <record>}}, POST <base>/data/<key> with
+// {"data": <record>} writes a new version of it
+type httpSecretBackend struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func newHTTPSecretBackend(base string, token string) *httpSecretBackend {
+	return &httpSecretBackend{base: strings.TrimSuffix(base, "/"), token: token, client: http.DefaultClient}
+}
+
+func (b *httpSecretBackend) do(method string, key string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.base+"/data/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.token != "" {
+		req.Header.Set("X-Vault-Token", b.token)
+	}
+	return b.client.Do(req)
+}
+
+func (b *httpSecretBackend) load(key string) (*secretRecord, error) {
+	resp, err := b.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &secretRecord{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Secret store returned status code:%v status:%s", resp.StatusCode, resp.Status)
+	}
+	var envelope struct {
+		Data struct {
+			Data secretRecord `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return nil, err
+	}
+	return &envelope.Data.Data, nil
+}
+
+// lock does nothing, the API has no locks; concurrent writers of one key can still lose a version
+func (b *httpSecretBackend) lock(key string) (func(), error) {
+	return func() {}, nil
+}
+
+func (b *httpSecretBackend) save(key string, record *secretRecord) error {
+	body, err := json.Marshal(map[string]interface{}{"data": record})
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(http.MethodPost, key, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Secret store returned status code:%v status:%s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+// writeFileAtomic writes through a temporary file in the same directory so readers
+// never see a partially written file
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,300 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - SecretStore keeps every credential the tool produces in versions, a new password
+//   is stored as pending before it is set and the previous one stays active until the
+//   new one is verified
+// - the store is selected with -secret-store or SECRET_STORE:
+//     encfile:<path>   AES-256-GCM encrypted file, key derived from SECRET_STORE_PASSPHRASE
+//     files:<dir>      one directory per server, e.g. a mounted secrets volume
+//     https://...      vault style HTTP API (KV version 2), token from VAULT_TOKEN
+// - Put and SetStatus read, change and save a whole record; the file backends hold a lock
+//   file meanwhile (lockFile in tokencache.go) so commands sharing a store do not drop each
+//   other's versions
+//
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credential states
+const (
+	// stored before the password is changed so it is never lost
+	credentialPending = "pending"
+	// the password in effect
+	credentialActive = "active"
+	// the password was set but a login with it could not be verified
+	credentialUnverified = "unverified"
+	// the change failed or was rolled back, the password is not in effect
+	credentialFailed = "failed"
+	// replaced by a newer active password
+	credentialSuperseded = "superseded"
+)
+
+// number of superseded and failed versions kept per server
+const maxSecretVersions = 5
+
+// credential is an administrator login and password of a server
+type credential struct {
+	ResourceGroup string    `json:"resourceGroup"`
+	Server        string    `json:"server"`
+	Login         string    `json:"login"`
+	Password      string    `json:"password"`
+	Version       int       `json:"version"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// key identifies the server a credential belongs to
+func (c credential) key() string {
+	return credentialKey(c.ResourceGroup, c.Server)
+}
+
+func credentialKey(resourceGroup string, server string) string {
+	return strings.ToLower(resourceGroup + "/" + server)
+}
+
+// SecretStore keeps versioned credentials
+type SecretStore interface {
+	// Put stores c as a new version and returns the version number
+	Put(c credential) (int, error)
+	// SetStatus changes the status of a version; making a version active supersedes older active ones
+	SetStatus(key string, version int, status string) error
+	// Versions returns the stored versions of key, oldest first
+	Versions(key string) ([]credential, error)
+}
+
+// newSecretStore creates a store from a spec like "encfile:credentials.enc"
+func newSecretStore(spec string) (SecretStore, error) {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return &versionedSecretStore{backend: newHTTPSecretBackend(spec, os.Getenv("VAULT_TOKEN"))}, nil
+	}
+	kind, arg, _ := strings.Cut(spec, ":")
+	if arg == "" {
+		return nil, fmt.Errorf("Invalid secret store %q, expected encfile:<path>, files:<dir> or an http(s) url", spec)
+	}
+	switch kind {
+	case "encfile":
+		passphrase := os.Getenv("SECRET_STORE_PASSPHRASE")
+		if passphrase == "" {
+			return nil, fmt.Errorf("Missing environment variable SECRET_STORE_PASSPHRASE for %s", spec)
+		}
+		return &versionedSecretStore{backend: &encryptedFileSecretBackend{path: arg, passphrase: passphrase}}, nil
+	case "files":
+		return &versionedSecretStore{backend: &dirSecretBackend{dir: arg}}, nil
+	}
+	return nil, fmt.Errorf("Unknown secret store %q, expected encfile:<path>, files:<dir> or an http(s) url", spec)
+}
+
+// activeCredential returns the newest active version of a server's credential, nil if none
+func activeCredential(store SecretStore, resourceGroup string, server string) (*credential, error) {
+	versions, err := store.Versions(credentialKey(resourceGroup, server))
+	if err != nil {
+		return nil, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Status == credentialActive {
+			return &versions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// secretRecord is the version history of one key as saved by a backend
+type secretRecord struct {
+	Versions []credential `json:"versions"`
+}
+
+// secretBackend loads and saves version histories, a missing key loads as an empty record
+type secretBackend interface {
+	load(key string) (*secretRecord, error)
+	save(key string, record *secretRecord) error
+	// lock keeps other processes from saving key until the returned function is called
+	lock(key string) (func(), error)
+}
+
+// versionedSecretStore implements the versioning of SecretStore on top of a backend
+type versionedSecretStore struct {
+	backend secretBackend
+	mu      sync.Mutex
+}
+
+func (s *versionedSecretStore) Put(c credential) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.backend.lock(c.key())
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	record, err := s.backend.load(c.key())
+	if err != nil {
+		return 0, err
+	}
+	c.Version = 1
+	if n := len(record.Versions); n > 0 {
+		c.Version = record.Versions[n-1].Version + 1
+	}
+	now := time.Now().UTC()
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = now
+	}
+	c.UpdatedAt = now
+	record.Versions = append(record.Versions, c)
+	if c.Status == credentialActive {
+		supersede(record, c.Version)
+	}
+	return c.Version, s.backend.save(c.key(), record)
+}
+
+func (s *versionedSecretStore) SetStatus(key string, version int, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.backend.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	record, err := s.backend.load(key)
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range record.Versions {
+		if record.Versions[i].Version == version {
+			record.Versions[i].Status = status
+			record.Versions[i].UpdatedAt = time.Now().UTC()
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("Secret %s has no version %d", key, version)
+	}
+	if status == credentialActive {
+		supersede(record, version)
+	}
+	return s.backend.save(key, record)
+}
+
+func (s *versionedSecretStore) Versions(key string) ([]credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, err := s.backend.load(key)
+	if err != nil {
+		return nil, err
+	}
+	return record.Versions, nil
+}
+
+// supersede is called when version became active: older versions are no longer in
+// effect and are marked superseded, and old history is pruned.
+func supersede(record *secretRecord, version int) {
+	for i := range record.Versions {
+		switch record.Versions[i].Status {
+		case credentialActive, credentialPending, credentialUnverified:
+			if record.Versions[i].Version < version {
+				record.Versions[i].Status = credentialSuperseded
+			}
+		}
+	}
+	inactive := 0
+	for i := len(record.Versions) - 1; i >= 0; i-- {
+		switch record.Versions[i].Status {
+		case credentialSuperseded, credentialFailed:
+			inactive++
+			if inactive > maxSecretVersions {
+				record.Versions = append(record.Versions[:i], record.Versions[i+1:]...)
+			}
+		}
+	}
+}
+
+// storeNewCredential stores a pending credential in store, a nil store stores nothing
+func storeNewCredential(store SecretStore, resourceGroup string, server string, login string, password string) (int, error) {
+	if store == nil {
+		return 0, nil
+	}
+	return store.Put(credential{
+		ResourceGroup: resourceGroup,
+		Server:        server,
+		Login:         login,
+		Password:      password,
+		Status:        credentialPending,
+	})
+}
+
+// setCredentialStatus changes the status of a version stored with storeNewCredential
+func setCredentialStatus(store SecretStore, resourceGroup string, server string, version int, status string) error {
+	if store == nil {
+		return nil
+	}
+	return store.SetStatus(credentialKey(resourceGroup, server), version, status)
+}
+
+const (
+	passwordLower   = "abcdefghijkmnopqrstuvwxyz"
+	passwordUpper   = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+	passwordDigits  = "23456789"
+	passwordSymbols = "!#%*+-=?_~"
+)
+
+// generatePassword returns a random password with characters from all four classes
+// Azure requires (three of upper case, lower case, digits and symbols)
+func generatePassword(length int) (string, error) {
+	classes := []string{passwordLower, passwordUpper, passwordDigits, passwordSymbols}
+	all := strings.Join(classes, "")
+	if length < len(classes) {
+		return "", fmt.Errorf("Password length %d is too short", length)
+	}
+	password := make([]byte, length)
+	for i := range password {
+		set := all
+		if i < len(classes) {
+			set = classes[i]
+		}
+		c, err := randomChar(set)
+		if err != nil {
+			return "", err
+		}
+		password[i] = c
+	}
+	// shuffle so the class of the first characters is not predictable
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		password[i], password[j.Int64()] = password[j.Int64()], password[i]
+	}
+	return string(password), nil
+}
+
+func randomChar(set string) (byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(set))))
+	if err != nil {
+		return 0, err
+	}
+	return set[n.Int64()], nil
+}
@@ -0,0 +1,78 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// two stores on one file stand in for two commands sharing SECRET_STORE; they do not
+// share versionedSecretStore.mu, only the lock file
+func TestConcurrentStoresKeepAllVersions(t *testing.T) {
+	dir := t.TempDir()
+	backends := map[string]func() secretBackend{
+		"encfile": func() secretBackend {
+			return &encryptedFileSecretBackend{path: filepath.Join(dir, "secrets.enc"), passphrase: "passphrase"}
+		},
+		"files": func() secretBackend { return &dirSecretBackend{dir: filepath.Join(dir, "files")} },
+	}
+	const puts = 4
+	for name, backend := range backends {
+		stores := []*versionedSecretStore{{backend: backend()}, {backend: backend()}}
+		var wg sync.WaitGroup
+		errs := make(chan error, len(stores)*puts)
+		for i, store := range stores {
+			wg.Add(1)
+			go func(i int, store *versionedSecretStore) {
+				defer wg.Done()
+				for n := 0; n < puts; n++ {
+					version, err := storeNewCredential(store, "rg", "srv", "azadmin", fmt.Sprintf("password-%d-%d", i, n))
+					if err == nil {
+						err = setCredentialStatus(store, "rg", "srv", version, credentialUnverified)
+					}
+					if err != nil {
+						errs <- err
+					}
+				}
+			}(i, store)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		versions, err := (&versionedSecretStore{backend: backend()}).Versions(credentialKey("rg", "srv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != len(stores)*puts {
+			t.Fatalf("%s: %d versions stored, want %d", name, len(versions), len(stores)*puts)
+		}
+		passwords := map[string]bool{}
+		for i, c := range versions {
+			if c.Version != i+1 || c.Status != credentialUnverified {
+				t.Errorf("%s: version %d is %d %s", name, i+1, c.Version, c.Status)
+			}
+			passwords[c.Password] = true
+		}
+		if len(passwords) != len(versions) {
+			t.Errorf("%s: %d distinct passwords in %d versions", name, len(passwords), len(versions))
+		}
+	}
+}
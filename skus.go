@@ -0,0 +1,199 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - the catalog lists the pricing tiers of the preview: Basic with 50 or 100 compute
+//   units and 50 GB to 1050 GB storage, Standard with 100 to 800 compute units and
+//   125 GB to 1000 GB storage; storage grows in 125 GB steps
+// - the SKU name is PGSQL, the first letter of the tier and the compute units, e.g. PGSQLB100
+// - sizes are checked locally so an invalid combination fails before CreateOrUpdate
+// - prices are estimates in USD from the preview price list (storage included in the
+//   minimum size is free), check the pricing page for current prices
+//
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	// MB in one storage step, 125 GB
+	storageIncrementMB = 128000
+	// hours billed per month
+	hoursPerMonth = 730
+)
+
+// skuTier describes the sizes a pricing tier offers
+type skuTier struct {
+	Tier         postgresql.SkuTier         `json:"tier"`
+	ComputeUnits []int32                    `json:"computeUnits"`
+	MinStorageMB int64                      `json:"minStorageMB"`
+	MaxStorageMB int64                      `json:"maxStorageMB"`
+	IncrementMB  int64                      `json:"storageIncrementMB"`
+	Versions     []postgresql.ServerVersion `json:"versions"`
+	// estimated price per hour by compute units
+	HourlyPrice map[int32]float64 `json:"hourlyPriceUSD"`
+	// estimated price per GB and month of storage above MinStorageMB
+	StoragePrice float64 `json:"storagePriceUSDPerGBMonth"`
+}
+
+// skuCatalog is the catalog of tiers, see the notes above
+var skuCatalog = []skuTier{
+	{
+		Tier:         postgresql.Basic,
+		ComputeUnits: []int32{50, 100},
+		MinStorageMB: 51200,
+		MaxStorageMB: 51200 + 8*storageIncrementMB,
+		IncrementMB:  storageIncrementMB,
+		Versions:     []postgresql.ServerVersion{postgresql.NineFullStopFive, postgresql.NineFullStopSix},
+		HourlyPrice:  map[int32]float64{50: 0.034, 100: 0.068},
+		StoragePrice: 0.125,
+	},
+	{
+		Tier:         postgresql.Standard,
+		ComputeUnits: []int32{100, 200, 400, 800},
+		MinStorageMB: storageIncrementMB,
+		MaxStorageMB: 8 * storageIncrementMB,
+		IncrementMB:  storageIncrementMB,
+		Versions:     []postgresql.ServerVersion{postgresql.NineFullStopFive, postgresql.NineFullStopSix},
+		HourlyPrice:  map[int32]float64{100: 0.25, 200: 0.50, 400: 1.00, 800: 2.00},
+		StoragePrice: 0.125,
+	},
+}
+
+func init() {
+	registerCommand(command{
+		name:    "skus",
+		summary: "print the catalog of tiers, compute units, storage sizes and versions",
+		run:     runSkus,
+	})
+}
+
+func runSkus(args []string) {
+	flags := newFlagSet("skus")
+	format := flags.String("format", "table", "output format: table or json")
+	flags.Parse(args)
+	if *format == "json" {
+		fmt.Println(toJSON(skuCatalog))
+		return
+	}
+	writeSkuCatalog(os.Stdout)
+}
+
+func writeSkuCatalog(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIER\tSKU\tCOMPUTE UNITS\tSTORAGE\tVERSIONS\tEST. USD/MONTH")
+	for _, t := range skuCatalog {
+		var versions []string
+		for _, v := range t.Versions {
+			versions = append(versions, string(v))
+		}
+		for _, cu := range t.ComputeUnits {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d-%d GB in %d GB steps (%d-%d MB)\t%s\t%.2f\n",
+				t.Tier, skuName(t.Tier, cu), cu,
+				t.MinStorageMB/1024, t.MaxStorageMB/1024, t.IncrementMB/1024, t.MinStorageMB, t.MaxStorageMB,
+				strings.Join(versions, ", "), t.monthlyCost(cu, t.MinStorageMB))
+		}
+	}
+	tw.Flush()
+}
+
+// skuName derives the SKU name from tier and compute units, e.g. PGSQLB100
+func skuName(tier postgresql.SkuTier, computeUnits int32) string {
+	return fmt.Sprintf("PGSQL%s%d", string(tier)[:1], computeUnits)
+}
+
+// findSkuTier returns the catalog entry of a tier
+func findSkuTier(tier postgresql.SkuTier) (*skuTier, error) {
+	var names []string
+	for i := range skuCatalog {
+		if strings.EqualFold(string(skuCatalog[i].Tier), string(tier)) {
+			return &skuCatalog[i], nil
+		}
+		names = append(names, string(skuCatalog[i].Tier))
+	}
+	return nil, fmt.Errorf("Unknown tier %s, expected one of %s", tier, strings.Join(names, ", "))
+}
+
+// resolveSku checks a version, tier, compute units and storage size against the catalog and
+// returns the Sku to send and the storage size, the tier minimum if storageMB is 0
+func resolveSku(version postgresql.ServerVersion, tier postgresql.SkuTier, computeUnits int32, storageMB int64) (*postgresql.Sku, int64, error) {
+	t, err := findSkuTier(tier)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !containsVersion(t.Versions, version) {
+		return nil, 0, fmt.Errorf("Tier %s does not offer version %s", t.Tier, version)
+	}
+	if !containsComputeUnits(t.ComputeUnits, computeUnits) {
+		return nil, 0, fmt.Errorf("Tier %s does not offer %d compute units, valid are %v", t.Tier, computeUnits, t.ComputeUnits)
+	}
+	if storageMB == 0 {
+		storageMB = t.MinStorageMB
+	}
+	if err := t.checkStorage(storageMB); err != nil {
+		return nil, 0, err
+	}
+	sku := &postgresql.Sku{
+		Name:     to.StringPtr(skuName(t.Tier, computeUnits)),
+		Tier:     t.Tier,
+		Capacity: to.Int32Ptr(computeUnits),
+	}
+	return sku, storageMB, nil
+}
+
+// checkStorage fails unless storageMB is the minimum plus a whole number of increments, within the limit
+func (t *skuTier) checkStorage(storageMB int64) error {
+	if storageMB < t.MinStorageMB || storageMB > t.MaxStorageMB || (storageMB-t.MinStorageMB)%t.IncrementMB != 0 {
+		return fmt.Errorf("Tier %s does not offer %d MB storage, valid are %d MB to %d MB in steps of %d MB (e.g. %d, %d)",
+			t.Tier, storageMB, t.MinStorageMB, t.MaxStorageMB, t.IncrementMB, t.MinStorageMB, t.MinStorageMB+t.IncrementMB)
+	}
+	return nil
+}
+
+// monthlyCost estimates the price per month of a server of this tier
+func (t *skuTier) monthlyCost(computeUnits int32, storageMB int64) float64 {
+	cost := t.HourlyPrice[computeUnits] * hoursPerMonth
+	if storageMB > t.MinStorageMB {
+		cost += float64(storageMB-t.MinStorageMB) / 1024 * t.StoragePrice
+	}
+	return cost
+}
+
+func containsVersion(versions []postgresql.ServerVersion, v postgresql.ServerVersion) bool {
+	for _, version := range versions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsComputeUnits(units []int32, cu int32) bool {
+	for _, u := range units {
+		if u == cu {
+			return true
+		}
+	}
+	return false
+}
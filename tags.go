@@ -0,0 +1,356 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - a tag policy is a JSON file named by -tag-policy or TAG_POLICY, e.g.
+//     {"tags": [
+//       {"key": "owner", "required": true, "pattern": "^[a-z][a-z0-9.-]*$"},
+//       {"key": "cost-center", "required": true, "allowed": ["1001", "1002"]}
+//     ]}
+//   tags not named in the policy are not checked
+// - createServer refuses tags violating the policy, "tags audit" reports existing
+//   servers violating it
+// - "tags set" and "tags unset" merge into the existing tags, an update replaces the
+//   whole tag map so it is read first
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/Azure/azure-sdk-for-go/arm/postgresql"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func init() {
+	registerCommand(command{
+		name:         "tags audit",
+		summary:      "report servers whose tags violate the tag policy",
+		needsClients: true,
+		run:          runTagsAudit,
+	})
+	registerCommand(command{
+		name:         "tags set",
+		summary:      "set key=value tags on servers selected by filter, keeping their other tags",
+		needsClients: true,
+		run:          func(args []string) { runTagsEdit("tags set", args) },
+	})
+	registerCommand(command{
+		name:         "tags unset",
+		summary:      "remove tag keys from servers selected by filter, keeping their other tags",
+		needsClients: true,
+		run:          func(args []string) { runTagsEdit("tags unset", args) },
+	})
+}
+
+// tagRule constrains one tag key
+type tagRule struct {
+	Key      string   `json:"key"`
+	Required bool     `json:"required"`
+	Allowed  []string `json:"allowed,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// tagPolicy is the set of rules the tags of a server must follow
+type tagPolicy struct {
+	Tags []tagRule `json:"tags"`
+}
+
+// serverTagPolicy is enforced by createServer, from TAG_POLICY; nil if not set
+var serverTagPolicy *tagPolicy
+
+// loadTagPolicy reads a policy file
+func loadTagPolicy(name string) (*tagPolicy, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	policy := &tagPolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for i := range policy.Tags {
+		rule := &policy.Tags[i]
+		if rule.Key == "" {
+			return nil, fmt.Errorf("%s: rule %d has no key", name, i+1)
+		}
+		if rule.Pattern != "" {
+			if rule.pattern, err = regexp.Compile(rule.Pattern); err != nil {
+				return nil, fmt.Errorf("%s: tag %s: %v", name, rule.Key, err)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// violations returns a description of every way tags break the policy, nil if they comply
+func (p *tagPolicy) violations(tags map[string]string) []string {
+	if p == nil {
+		return nil
+	}
+	var found []string
+	for _, rule := range p.Tags {
+		value, ok := lookupTag(tags, rule.Key)
+		if !ok {
+			if rule.Required {
+				found = append(found, fmt.Sprintf("missing required tag %s", rule.Key))
+			}
+			continue
+		}
+		if len(rule.Allowed) > 0 && !containsString(rule.Allowed, value) {
+			found = append(found, fmt.Sprintf("tag %s=%s is not one of %s", rule.Key, value, strings.Join(rule.Allowed, ", ")))
+		}
+		if rule.pattern != nil && !rule.pattern.MatchString(value) {
+			found = append(found, fmt.Sprintf("tag %s=%s does not match %s", rule.Key, value, rule.Pattern))
+		}
+	}
+	return found
+}
+
+// check returns an error listing the violations, nil if tags comply
+func (p *tagPolicy) check(tags map[string]string) error {
+	if v := p.violations(tags); len(v) > 0 {
+		return fmt.Errorf("Tags violate the tag policy: %s", strings.Join(v, "; "))
+	}
+	return nil
+}
+
+// lookupTag finds a tag by key ignoring case, as Azure treats tag names
+func lookupTag(tags map[string]string, key string) (string, bool) {
+	if v, ok := tags[key]; ok {
+		return v, true
+	}
+	for k, v := range tags {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTagPolicyIfSet loads the policy file name, no file name means no policy
+func loadTagPolicyIfSet(name string) (*tagPolicy, error) {
+	if name == "" {
+		return nil, nil
+	}
+	return loadTagPolicy(name)
+}
+
+// tagAuditResult is one server violating the policy
+type tagAuditResult struct {
+	ResourceGroup string   `json:"resourceGroup"`
+	Server        string   `json:"server"`
+	Violations    []string `json:"violations"`
+}
+
+func runTagsAudit(args []string) {
+	flags := newFlagSet("tags audit")
+	filter := addServerFilterFlags(flags)
+	policyFile := flags.String("tag-policy", os.Getenv("TAG_POLICY"), "tag policy file")
+	format := flags.String("format", "table", "report format: table or json")
+	flags.Parse(args)
+
+	if *policyFile == "" {
+		fmt.Println("Missing -tag-policy (or TAG_POLICY)")
+		os.Exit(2)
+	}
+	policy, err := loadTagPolicy(*policyFile)
+	onErrorFail(err, "Reading tag policy failed")
+	servers, err := listServers(serversClient, filter)
+	onErrorFail(err, "Listing servers failed")
+
+	results := []tagAuditResult{}
+	for _, server := range servers {
+		if v := policy.violations(serverTags(server)); len(v) > 0 {
+			results = append(results, tagAuditResult{
+				ResourceGroup: resourceGroupFromID(to.String(server.ID)),
+				Server:        to.String(server.Name),
+				Violations:    v,
+			})
+		}
+	}
+	if *format == "json" {
+		fmt.Println(toJSON(results))
+	} else {
+		writeTagAuditReport(os.Stdout, results)
+		fmt.Printf("%d of %d servers violate the tag policy\n", len(results), len(servers))
+	}
+	if len(results) > 0 {
+		os.Exit(1)
+	}
+}
+
+func writeTagAuditReport(w io.Writer, results []tagAuditResult) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESOURCE GROUP\tSERVER\tVIOLATION")
+	for _, r := range results {
+		for _, v := range r.Violations {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.ResourceGroup, r.Server, v)
+		}
+	}
+	tw.Flush()
+}
+
+// tagEditResult is one line of the tags set/unset report
+type tagEditResult struct {
+	ResourceGroup string `json:"resourceGroup"`
+	Server        string `json:"server"`
+	Result        string `json:"result"`
+	Error         string `json:"error,omitempty"`
+}
+
+// runTagsEdit implements "tags set key=value..." and "tags unset key..."
+func runTagsEdit(name string, args []string) {
+	flags := newFlagSet(name)
+	filter := addServerFilterFlags(flags)
+	all := flags.Bool("all", false, "change every server in the subscription when no filter is given")
+	parallel := flags.Int("parallel", 4, "number of servers updated concurrently")
+	policyFile := flags.String("tag-policy", os.Getenv("TAG_POLICY"), "tag policy the resulting tags must follow")
+	dryRun := flags.Bool("dry-run", false, "only show the tags the servers would get")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		if name == "tags set" {
+			fmt.Println("Usage: tags set [flags] key=value...")
+		} else {
+			fmt.Println("Usage: tags unset [flags] key...")
+		}
+		os.Exit(2)
+	}
+	if !*all && filter.empty() {
+		fmt.Println("Select servers with -server, -tag, -name or -resource-group, or pass -all")
+		os.Exit(2)
+	}
+	set := map[string]string{}
+	var unset []string
+	if name == "tags set" {
+		for _, kv := range flags.Args() {
+			key, value, ok := strings.Cut(kv, "=")
+			if !ok || key == "" {
+				fmt.Printf("Invalid tag %q, expected key=value\n", kv)
+				os.Exit(2)
+			}
+			set[key] = value
+		}
+	} else {
+		unset = flags.Args()
+	}
+	policy, err := loadTagPolicyIfSet(*policyFile)
+	onErrorFail(err, "Reading tag policy failed")
+	servers, err := listServers(serversClient, filter)
+	onErrorFail(err, "Listing servers failed")
+	if !*dryRun {
+		requirePermissions(name, serverResourceGroups(servers))
+	}
+
+	if *parallel < 1 {
+		*parallel = 1
+	}
+	results := make([]tagEditResult, len(servers))
+	sem := make(chan struct{}, *parallel)
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, server postgresql.Server) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = editServerTags(server, set, unset, policy, *dryRun)
+			fmt.Printf("%s/%s: %s %s\n", results[i].ResourceGroup, results[i].Server, results[i].Result, results[i].Error)
+		}(i, server)
+	}
+	wg.Wait()
+	for _, r := range results {
+		if r.Result == "failed" {
+			os.Exit(1)
+		}
+	}
+}
+
+// mergeTags returns existing with set applied and unset removed, keys matched ignoring case
+func mergeTags(existing map[string]string, set map[string]string, unset []string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for key, value := range set {
+		for k := range merged {
+			if strings.EqualFold(k, key) {
+				delete(merged, k)
+			}
+		}
+		merged[key] = value
+	}
+	for _, key := range unset {
+		for k := range merged {
+			if strings.EqualFold(k, key) {
+				delete(merged, k)
+			}
+		}
+	}
+	return merged
+}
+
+// editServerTags updates the tags of one server
+func editServerTags(server postgresql.Server, set map[string]string, unset []string, policy *tagPolicy, dryRun bool) tagEditResult {
+	result := tagEditResult{
+		ResourceGroup: resourceGroupFromID(to.String(server.ID)),
+		Server:        to.String(server.Name),
+		Result:        "failed",
+	}
+	// the tags of the listing may be stale, Update replaces all tags so start from the current ones
+	current, err := serversClient.Get(result.ResourceGroup, result.Server)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	merged := mergeTags(serverTags(current), set, unset)
+	if err := policy.check(merged); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if dryRun {
+		result.Result = "would set " + formatTags(merged)
+		return result
+	}
+	parameters := postgresql.ServerUpdateParameters{Tags: toTagPtrs(merged)}
+	_, errChannel := serversClient.Update(result.ResourceGroup, result.Server, parameters, nil)
+	if err := <-errChannel; err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Result = "updated " + formatTags(merged)
+	return result
+}
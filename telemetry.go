@@ -0,0 +1,662 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - telemetry is on when METRICS_ADDR (serve /metrics, e.g. ":9464"), METRICS_FILE (Prometheus
+//   text file written on flush, for node_exporter's textfile collector) or TRACE_ENDPOINT
+//   (OTLP/HTTP JSON, e.g. http://127.0.0.1:4318/v1/traces) is set
+// - every ARM call is measured twice: the call as the code sees it, including rate limiter
+//   waits and retry backoff (outermost sender), and each attempt sent to ARM (innermost
+//   sender); a slow call with fast attempts is our own waiting, slow attempts are ARM
+// - operations are named by method and resource type path with the names left out, e.g.
+//   "PUT Microsoft.DBforPostgreSQL/servers/{}/firewallRules/{}"
+// - a call answered with 201/202 and an Azure-AsyncOperation or Location header starts a
+//   long-running operation; it ends when a poll of that URL reports a final status, its
+//   polls are spans in the same trace
+// - spans are exported every 5s and by flushTelemetry when the program ends normally or
+//   through onErrorFail; "telemetry collector" is a local stand-in printing what it receives
+//
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const (
+	telemetryServiceName   = "azure-postgresql-go-sample"
+	telemetryFlushInterval = 5 * time.Second
+	// OTLP span kind and status codes
+	otlpSpanKindClient = 3
+	otlpStatusOk       = 1
+	otlpStatusError    = 2
+)
+
+// upper bounds in seconds of the latency histogram buckets
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 1800}
+
+func init() {
+	registerCommand(command{
+		name:    "telemetry collector",
+		summary: "local stand-in for an OpenTelemetry collector printing the spans it receives",
+		run:     runTelemetryCollector,
+	})
+}
+
+// armTelemetry collects metrics and spans of ARM calls, nil when telemetry is off
+var armTelemetry *telemetry
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// labelKey identifies a series by operation and, for some metrics, a second label
+type labelKey struct {
+	operation string
+	value     string
+}
+
+// span is one timed unit of work exported in OTLP format
+type span struct {
+	traceID      string
+	spanID       string
+	parentSpanID string
+	name         string
+	start        time.Time
+	end          time.Time
+	attributes   map[string]interface{}
+	failed       bool
+	attempts     int
+}
+
+// longRunningOperation is an accepted call whose polling URL has not reported a final status
+type longRunningOperation struct {
+	operation string
+	span      *span
+}
+
+type telemetry struct {
+	mu            sync.Mutex
+	callDurations map[labelKey]*histogram
+	tryDurations  map[labelKey]*histogram
+	lroDurations  map[labelKey]*histogram
+	statusCodes   map[labelKey]uint64
+	retries       map[string]uint64
+	running       map[string]*longRunningOperation
+	finished      []*span
+
+	traceEndpoint string
+	metricsFile   string
+}
+
+type spanContextKey struct{}
+
+// enableTelemetry turns telemetry on when one of its environment variables is set
+func enableTelemetry() error {
+	addr, file, endpoint := os.Getenv("METRICS_ADDR"), os.Getenv("METRICS_FILE"), os.Getenv("TRACE_ENDPOINT")
+	if addr == "" && file == "" && endpoint == "" {
+		return nil
+	}
+	t := &telemetry{
+		callDurations: map[labelKey]*histogram{},
+		tryDurations:  map[labelKey]*histogram{},
+		lroDurations:  map[labelKey]*histogram{},
+		statusCodes:   map[labelKey]uint64{},
+		retries:       map[string]uint64{},
+		running:       map[string]*longRunningOperation{},
+		traceEndpoint: endpoint,
+		metricsFile:   file,
+	}
+	if addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			t.writeMetrics(w)
+		})
+		server := &http.Server{Addr: addr, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				fmt.Fprintf(os.Stderr, "Metrics endpoint %s failed: %v\n", addr, err)
+			}
+		}()
+	}
+	go func() {
+		for range time.Tick(telemetryFlushInterval) {
+			t.flush()
+		}
+	}()
+	armTelemetry = t
+	return nil
+}
+
+// flushTelemetry exports the finished spans and writes METRICS_FILE
+func flushTelemetry() {
+	if armTelemetry != nil {
+		armTelemetry.flush()
+	}
+}
+
+// callDecorator returns the outermost SendDecorator measuring calls as the code sees them
+func (t *telemetry) callDecorator() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			operation := armOperation(r.Method, r.URL.Path)
+			url := r.URL.String()
+			t.mu.Lock()
+			lro := t.running[url]
+			t.mu.Unlock()
+			call := newSpan(operation, nil)
+			if lro != nil {
+				call = newSpan(operation, lro.span)
+			}
+			call.attributes["http.method"] = r.Method
+			call.attributes["http.url"] = redactURL(url)
+			r = r.WithContext(context.WithValue(r.Context(), spanContextKey{}, call))
+
+			resp, err := s.Do(r)
+			t.endCall(call, operation, resp, err)
+			if lro != nil {
+				resp = t.checkLongRunning(url, lro, resp, err)
+			} else {
+				t.startLongRunning(operation, call, resp)
+			}
+			return resp, err
+		})
+	}
+}
+
+// attemptDecorator returns the innermost SendDecorator measuring each attempt sent to ARM
+func (t *telemetry) attemptDecorator() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			operation := armOperation(r.Method, r.URL.Path)
+			call, _ := r.Context().Value(spanContextKey{}).(*span)
+			attempt := newSpan(operation+" attempt", call)
+			resp, err := s.Do(r)
+			attempt.end = time.Now()
+
+			code := "error"
+			if resp != nil {
+				code = strconv.Itoa(resp.StatusCode)
+				attempt.attributes["http.status_code"] = resp.StatusCode
+				attempt.attributes["az.service_request_id"] = azure.ExtractRequestID(resp)
+				attempt.attributes["az.correlation_request_id"] = resp.Header.Get(headerCorrelationRequest)
+			}
+			if err != nil {
+				attempt.attributes["error.message"] = err.Error()
+			}
+			attempt.failed = err != nil || resp == nil || resp.StatusCode >= 400
+
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if call != nil {
+				call.attempts++
+				attempt.attributes["arm.attempt"] = call.attempts
+			}
+			t.statusCodes[labelKey{operation, code}]++
+			observe(t.tryDurations, labelKey{operation: operation}, attempt.end.Sub(attempt.start))
+			t.finished = append(t.finished, attempt)
+			return resp, err
+		})
+	}
+}
+
+func (t *telemetry) endCall(call *span, operation string, resp *http.Response, err error) {
+	call.end = time.Now()
+	if resp != nil {
+		call.attributes["http.status_code"] = resp.StatusCode
+		call.attributes["az.service_request_id"] = azure.ExtractRequestID(resp)
+	}
+	if err != nil {
+		call.attributes["error.message"] = err.Error()
+	}
+	call.failed = err != nil || resp == nil || resp.StatusCode >= 400
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	retries := 0
+	if call.attempts > 1 {
+		retries = call.attempts - 1
+	}
+	call.attributes["arm.retries"] = retries
+	t.retries[operation] += uint64(retries)
+	observe(t.callDurations, labelKey{operation: operation}, call.end.Sub(call.start))
+	t.finished = append(t.finished, call)
+}
+
+// startLongRunning remembers an accepted call by the URL it is polled with
+func (t *telemetry) startLongRunning(operation string, call *span, resp *http.Response) {
+	if resp == nil || (resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted) {
+		return
+	}
+	url := resp.Header.Get(headerAsyncOperation)
+	if url == "" {
+		url = resp.Header.Get("Location")
+	}
+	if url == "" {
+		return
+	}
+	lro := &longRunningOperation{operation: operation, span: newSpan(operation+" long-running", call)}
+	lro.span.start = call.start
+	lro.span.attributes["arm.polling_url"] = redactURL(url)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running[url] = lro
+}
+
+// checkLongRunning ends a long-running operation when a poll reports a final status
+func (t *telemetry) checkLongRunning(url string, lro *longRunningOperation, resp *http.Response, err error) *http.Response {
+	if err != nil || resp == nil || resp.StatusCode == http.StatusAccepted {
+		return resp
+	}
+	result := "failed"
+	if resp.StatusCode < 300 {
+		var body []byte
+		body, resp.Body = peekBody(resp.Body)
+		var status struct {
+			Status string `json:"status"`
+		}
+		json.Unmarshal(body, &status)
+		switch strings.ToLower(status.Status) {
+		case "inprogress", "accepted", "running", "creating", "updating", "deleting":
+			return resp
+		case "", "succeeded":
+			result = "succeeded"
+		default:
+			result = strings.ToLower(status.Status)
+		}
+	} else if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		// the poll failed, not the operation
+		return resp
+	}
+
+	lro.span.end = time.Now()
+	lro.span.failed = result != "succeeded"
+	lro.span.attributes["arm.result"] = result
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running[url] != lro {
+		// a concurrent poll already ended it
+		return resp
+	}
+	delete(t.running, url)
+	observe(t.lroDurations, labelKey{lro.operation, result}, lro.span.end.Sub(lro.span.start))
+	t.finished = append(t.finished, lro.span)
+	return resp
+}
+
+// observe adds a duration to a series, creating it on first use
+func observe(series map[labelKey]*histogram, key labelKey, d time.Duration) {
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{}
+		series[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// armOperation names the operation of a request path, leaving out the resource names
+func armOperation(method string, path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var parts []string
+	seenProvider := false
+	for i := 0; i < len(segments); {
+		segment := segments[i]
+		if strings.EqualFold(segment, "providers") && i+1 < len(segments) {
+			if !seenProvider {
+				parts = nil
+				seenProvider = true
+			} else {
+				parts = append(parts, "providers")
+			}
+			parts = append(parts, segments[i+1])
+			i += 2
+			continue
+		}
+		parts = append(parts, segment)
+		if i+1 < len(segments) {
+			parts = append(parts, "{}")
+		}
+		i += 2
+	}
+	if !seenProvider && len(parts) >= 2 && parts[0] == "subscriptions" {
+		parts = parts[2:]
+	}
+	return method + " " + strings.Join(parts, "/")
+}
+
+func newSpan(name string, parent *span) *span {
+	s := &span{name: name, start: time.Now(), spanID: randomHex(8), attributes: map[string]interface{}{}}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentSpanID = parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return s
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeMetrics writes the metrics in the Prometheus text format
+func (t *telemetry) writeMetrics(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	writeHistograms(w, "arm_call_duration_seconds", "Duration of ARM calls including rate limiting and retries.", "", t.callDurations)
+	writeHistograms(w, "arm_attempt_duration_seconds", "Duration of single requests sent to ARM.", "", t.tryDurations)
+
+	fmt.Fprintln(w, "# HELP arm_requests_total Requests sent to ARM by status code, error for transport errors.")
+	fmt.Fprintln(w, "# TYPE arm_requests_total counter")
+	codes := make([]labelKey, 0, len(t.statusCodes))
+	for key := range t.statusCodes {
+		codes = append(codes, key)
+	}
+	sortLabelKeys(codes)
+	for _, key := range codes {
+		fmt.Fprintf(w, "arm_requests_total{operation=%s,code=%s} %d\n", promLabel(key.operation), promLabel(key.value), t.statusCodes[key])
+	}
+
+	fmt.Fprintln(w, "# HELP arm_retries_total Requests sent again by the retry policy.")
+	fmt.Fprintln(w, "# TYPE arm_retries_total counter")
+	operations := make([]string, 0, len(t.retries))
+	for operation := range t.retries {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		fmt.Fprintf(w, "arm_retries_total{operation=%s} %d\n", promLabel(operation), t.retries[operation])
+	}
+
+	writeHistograms(w, "arm_long_running_duration_seconds", "Time from accepting a long-running operation to its final status.", "result", t.lroDurations)
+	fmt.Fprintln(w, "# HELP arm_long_running_operations Long-running operations still being polled.")
+	fmt.Fprintln(w, "# TYPE arm_long_running_operations gauge")
+	fmt.Fprintf(w, "arm_long_running_operations %d\n", len(t.running))
+}
+
+// writeHistograms writes a histogram per series, valueLabel names the second label if it has one
+func writeHistograms(w io.Writer, name string, help string, valueLabel string, series map[labelKey]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	keys := make([]labelKey, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sortLabelKeys(keys)
+	for _, key := range keys {
+		labels := "operation=" + promLabel(key.operation)
+		if valueLabel != "" {
+			labels += "," + valueLabel + "=" + promLabel(key.value)
+		}
+		writeHistogram(w, name, labels, series[key])
+	}
+}
+
+func writeHistogram(w io.Writer, name string, labels string, h *histogram) {
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func sortLabelKeys(keys []labelKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].operation != keys[j].operation {
+			return keys[i].operation < keys[j].operation
+		}
+		return keys[i].value < keys[j].value
+	})
+}
+
+// promLabel quotes a label value
+func promLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return `"` + value + `"`
+}
+
+// flush exports the finished spans and writes the metrics file
+func (t *telemetry) flush() {
+	t.mu.Lock()
+	spans := t.finished
+	t.finished = nil
+	t.mu.Unlock()
+
+	if t.traceEndpoint != "" && len(spans) > 0 {
+		if err := exportSpans(t.traceEndpoint, spans); err != nil {
+			fmt.Fprintf(os.Stderr, "Exporting %d spans to %s failed: %v\n", len(spans), t.traceEndpoint, err)
+		}
+	}
+	if t.metricsFile != "" {
+		var metrics bytes.Buffer
+		t.writeMetrics(&metrics)
+		// renamed into place so a collector never reads half a file
+		temp := t.metricsFile + ".tmp"
+		err := ioutil.WriteFile(temp, metrics.Bytes(), 0644)
+		if err == nil {
+			err = os.Rename(temp, t.metricsFile)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Writing %s failed: %v\n", t.metricsFile, err)
+		}
+	}
+}
+
+// exportSpans posts spans as an OTLP/HTTP JSON ExportTraceServiceRequest
+func exportSpans(endpoint string, spans []*span) error {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		status := otlpStatusOk
+		if s.failed {
+			status = otlpStatusError
+		}
+		otlpSpan := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              otlpSpanKindClient,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+			"status":            map[string]interface{}{"code": status},
+		}
+		if s.parentSpanID != "" {
+			otlpSpan["parentSpanId"] = s.parentSpanID
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": telemetryServiceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": telemetryServiceName + "/arm"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpAttributes converts attributes to OTLP key/value pairs
+func otlpAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		var value map[string]interface{}
+		switch v := attributes[key].(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]interface{}{"key": key, "value": value})
+	}
+	return result
+}
+
+func runTelemetryCollector(args []string) {
+	flags := newFlagSet("telemetry collector")
+	addr := flags.String("addr", "127.0.0.1:4318", "address to listen on, spans are posted to /v1/traces")
+	out := flags.String("out", "", "also append every received request as a JSON line to this file")
+	flags.Parse(args)
+
+	var mu sync.Mutex
+	http.HandleFunc("/v1/traces", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var request otlpTraceRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if *out != "" {
+			if err := appendLine(*out, bytes.TrimSpace(body)); err != nil {
+				fmt.Printf("Writing %s failed: %v\n", *out, err)
+			}
+		}
+		for _, rs := range request.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					printSpan(s)
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	})
+	fmt.Printf("Collecting spans on http://%s/v1/traces\n", *addr)
+	onErrorFail(http.ListenAndServe(*addr, nil), "Collector failed")
+}
+
+// otlpTraceRequest is the part of an OTLP ExportTraceServiceRequest the collector prints
+type otlpTraceRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Start        string `json:"startTimeUnixNano"`
+	End          string `json:"endTimeUnixNano"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func printSpan(s otlpSpan) {
+	start, _ := strconv.ParseInt(s.Start, 10, 64)
+	end, _ := strconv.ParseInt(s.End, 10, 64)
+	status := "ok"
+	if s.Status.Code == otlpStatusError {
+		status = "error"
+	}
+	var attributes []string
+	for _, a := range s.Attributes {
+		for _, v := range a.Value {
+			attributes = append(attributes, fmt.Sprintf("%s=%v", a.Key, v))
+		}
+	}
+	fmt.Printf("%s %s parent=%s %-60s %8v %-5s %s\n", s.TraceID, s.SpanID, s.ParentSpanID, s.Name,
+		time.Duration(end-start).Round(time.Millisecond), status, strings.Join(attributes, " "))
+}
+
+func appendLine(name string, line []byte) error {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
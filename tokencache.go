@@ -0,0 +1,236 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - tokens are cached per tenant and client in <TOKEN_CACHE dir>/<tenant>_<client>.token,
+//   keyed by resource inside the file; the default dir is the user's cache dir and
+//   TOKEN_CACHE=off turns caching off
+// - files use the AES-256-GCM format of the encfile secret store (secretbackends.go); the
+//   passphrase is TOKEN_CACHE_PASSPHRASE or else the client secret, so a cached token is only
+//   readable by whoever could request one anyway; device logins (login.go) have no secret and
+//   fall back to a random key kept in the cache dir
+// - a file that can not be decrypted (e.g. after the secret was rotated) is treated as empty
+//   and overwritten
+// - tokens are written by a TokenRefreshCallback, so every refresh, also the ones autorest
+//   does during a long command, is persisted; a failed write is reported but does not fail
+//   the request
+// - writers take <file>.lock, created exclusively, so concurrent processes do not lose each
+//   other's tokens; a lock older than tokenCacheStaleLock is left over from a crashed process
+//
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+const (
+	tokenCacheLockWait  = 30 * time.Second
+	tokenCacheStaleLock = 2 * time.Minute
+	// cached tokens expiring sooner are not used
+	tokenCacheMinValidity = 5 * time.Minute
+)
+
+// tokenCache is the encrypted token file of one tenant and client
+type tokenCache struct {
+	path       string
+	passphrase string
+}
+
+// openTokenCache returns the cache of a tenant and client, nil if caching is off
+func openTokenCache(tenantID string, clientID string, clientSecret string) (*tokenCache, error) {
+	dir, err := tokenCacheDir()
+	if err != nil || dir == "" {
+		return nil, err
+	}
+	return newTokenCache(dir, tenantID+"_"+clientID, clientSecret)
+}
+
+// tokenCacheDir returns the directory of TOKEN_CACHE, "" if caching is off
+func tokenCacheDir() (string, error) {
+	dir := os.Getenv("TOKEN_CACHE")
+	if dir == "off" {
+		return "", nil
+	}
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("No cache directory for tokens, set TOKEN_CACHE: %v", err)
+		}
+		dir = filepath.Join(base, "azure-postgresql-go-sample")
+	}
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// newTokenCache returns the cache file named name in dir, encrypted with TOKEN_CACHE_PASSPHRASE,
+// else secret, else the local key of the directory
+func newTokenCache(dir string, name string, secret string) (*tokenCache, error) {
+	passphrase := os.Getenv("TOKEN_CACHE_PASSPHRASE")
+	if passphrase == "" {
+		passphrase = secret
+	}
+	if passphrase == "" {
+		var err error
+		if passphrase, err = tokenCacheKey(dir); err != nil {
+			return nil, err
+		}
+	}
+	path := filepath.Join(dir, strings.ToLower(name)+".token")
+	return &tokenCache{path: path, passphrase: passphrase}, nil
+}
+
+// tokenCacheKey returns the random key in dir, creating it first; it protects the tokens of
+// device logins, which have no secret, no better than the permissions of the directory
+func tokenCacheKey(dir string) (string, error) {
+	path := filepath.Join(dir, "key")
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	key, err := ioutil.ReadFile(path)
+	if err == nil && len(key) > 0 {
+		return string(key), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	key = []byte(hex.EncodeToString(random))
+	return string(key), writeFileAtomic(path, key, 0600)
+}
+
+// read decrypts the cached tokens by resource, empty if there are none or they are unreadable
+func (c *tokenCache) read() (map[string]adal.Token, []byte) {
+	tokens := map[string]adal.Token{}
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Token cache %s: %v\n", c.path, err)
+		}
+		return tokens, nil
+	}
+	plaintext, salt, err := openEncryptedFile(c.passphrase, data)
+	if err == nil {
+		err = json.Unmarshal(plaintext, &tokens)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Token cache %s is unreadable (%v), starting a new one\n", c.path, err)
+		return map[string]adal.Token{}, nil
+	}
+	return tokens, salt
+}
+
+// load returns the cached token of a resource, nil if there is none valid for a while
+func (c *tokenCache) load(resource string) *adal.Token {
+	tokens, _ := c.read()
+	token, ok := tokens[resource]
+	if !ok || token.WillExpireIn(tokenCacheMinValidity) {
+		return nil
+	}
+	return &token
+}
+
+// update changes the cached tokens under the lock, a nil token removes the resource
+func (c *tokenCache) update(resource string, token *adal.Token) error {
+	unlock, err := lockFile(c.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	tokens, salt := c.read()
+	if token == nil {
+		delete(tokens, resource)
+	} else {
+		tokens[resource] = *token
+	}
+	plaintext, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	data, err := sealEncryptedFile(c.passphrase, salt, plaintext)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, data, 0600)
+}
+
+// refreshCallback persists every token the ServicePrincipalToken obtains
+func (c *tokenCache) refreshCallback(resource string) adal.TokenRefreshCallback {
+	return func(token adal.Token) error {
+		if err := c.update(resource, &token); err != nil {
+			fmt.Fprintf(os.Stderr, "Caching token in %s failed: %v\n", c.path, err)
+		}
+		return nil
+	}
+}
+
+// lockFile creates path exclusively, waiting for other holders, and returns the function
+// releasing it
+func lockFile(path string) (func(), error) {
+	deadline := time.Now().Add(tokenCacheLockWait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > tokenCacheStaleLock {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is still locked after %v", path, tokenCacheLockWait)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// newCachedServicePrincipalToken creates a service principal token starting from the cached
+// token of the resource, if any, and caching every refreshed one
+func newCachedServicePrincipalToken(oauthConfig adal.OAuthConfig, tenantID string, clientID string, clientSecret string, resource string) (*adal.ServicePrincipalToken, error) {
+	cache, err := openTokenCache(tenantID, clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if cache == nil {
+		return adal.NewServicePrincipalToken(oauthConfig, clientID, clientSecret, resource)
+	}
+	spToken, err := adal.NewServicePrincipalToken(oauthConfig, clientID, clientSecret, resource, cache.refreshCallback(resource))
+	if err != nil {
+		return nil, err
+	}
+	if token := cache.load(resource); token != nil {
+		spToken.Token = *token
+	}
+	return spToken, nil
+}
@@ -0,0 +1,339 @@
+package main
+
+// Copyright (c) Microsoft.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//--------------------------------------------------------------------------
+
+//
+// Notes:
+// - whoami token gets the ARM token the way every other command does (service principal,
+//   logged in account, token cache) and decodes its claims with the vendored jwt-go; the
+//   signature is not verified, AAD's keys are not needed to read who the token is for
+// - the vendored jwt-go has no ParseUnverified, Parse without a Keyfunc returns the decoded
+//   token with a ValidationErrorUnverifiable which is expected here
+// - the subscription is checked by reading it with the token: on 401 ARM names the tenant
+//   owning the subscription in the authorization_uri of WWW-Authenticate, which is the usual
+//   cause of "InvalidAuthenticationTokenTenant"
+// - checks are OK, WARN or FAIL; the command exits 1 on any FAIL
+//
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const (
+	checkOK   = "OK"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+	// tokens expiring sooner are flagged
+	tokenExpiryWarning = 5 * time.Minute
+)
+
+var (
+	// audiences ARM accepts for the public cloud
+	armAudiences = []string{azure.PublicCloud.ResourceManagerEndpoint, azure.PublicCloud.ServiceManagementEndpoint}
+	// hosts of the issuers of the public cloud, v1 and v2 tokens
+	publicCloudIssuerHosts    = []string{"sts.windows.net", "login.microsoftonline.com"}
+	authorizationURIPattern   = regexp.MustCompile(`authorization_uri="[^"]*/([^/"]+)"`)
+	guidPattern               = regexp.MustCompile(`(?i)^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	tokenCheckSubscriptionAPI = "2016-06-01"
+)
+
+// tokenCheck is the result of one check of the token
+type tokenCheck struct {
+	Check   string `json:"check"`
+	Result  string `json:"result"`
+	Details string `json:"details"`
+}
+
+// tokenReport is the output of whoami token
+type tokenReport struct {
+	Account        string       `json:"account,omitempty"`
+	TenantID       string       `json:"tenantId"`
+	ClientID       string       `json:"clientId"`
+	SubscriptionID string       `json:"subscriptionId"`
+	Claims         tokenClaims  `json:"claims"`
+	Checks         []tokenCheck `json:"checks"`
+}
+
+// tokenClaims are the claims of an AAD token that say who it is for
+type tokenClaims struct {
+	TenantID  string     `json:"tid,omitempty"`
+	AppID     string     `json:"appid,omitempty"`
+	ObjectID  string     `json:"oid,omitempty"`
+	User      string     `json:"upn,omitempty"`
+	Audience  string     `json:"aud,omitempty"`
+	Issuer    string     `json:"iss,omitempty"`
+	Roles     []string   `json:"roles,omitempty"`
+	Scopes    string     `json:"scp,omitempty"`
+	NotBefore *time.Time `json:"nbf,omitempty"`
+	Expires   *time.Time `json:"exp,omitempty"`
+}
+
+func init() {
+	registerCommand(command{
+		name:         "whoami token",
+		summary:      "Decode the ARM token and check it against the configured tenant and subscription",
+		needsClients: true,
+		run:          runWhoamiToken,
+	})
+}
+
+func runWhoamiToken(args []string) {
+	flags := newFlagSet("whoami token")
+	format := flags.String("format", "table", "report format: table or json")
+	flags.Parse(args)
+
+	report := tokenReport{
+		Account:        armAccount,
+		TenantID:       armTenantID,
+		ClientID:       armClientID,
+		SubscriptionID: armSubscriptionID,
+	}
+	raw, err := armToken()
+	if err != nil {
+		report.Checks = append(report.Checks, tokenCheck{"token", checkFail, err.Error()})
+	} else if report.Claims, err = decodeToken(raw); err != nil {
+		report.Checks = append(report.Checks, tokenCheck{"token", checkFail, "not a JWT: " + err.Error()})
+	} else {
+		report.Checks = append(report.Checks, checkTokenClaims(report.Claims, armTenantID, armClientID, time.Now())...)
+		report.Checks = append(report.Checks, checkSubscription(armSubscriptionID, report.Claims))
+	}
+
+	writeTokenReport(os.Stdout, *format, report)
+	for _, c := range report.Checks {
+		if c.Result == checkFail {
+			os.Exit(1)
+		}
+	}
+}
+
+// armToken returns the bearer token the clients send, refreshed if needed
+func armToken() (string, error) {
+	req, err := autorest.Prepare(&http.Request{},
+		autorest.WithBaseURL(azure.PublicCloud.ResourceManagerEndpoint),
+		armAuthorizer.WithAuthorization())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "), nil
+}
+
+// decodeToken reads the claims of a JWT without verifying its signature
+func decodeToken(raw string) (tokenClaims, error) {
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(raw, nil)
+	if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors == jwt.ValidationErrorUnverifiable {
+		err = nil
+	}
+	if err != nil {
+		return tokenClaims{}, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	c := tokenClaims{
+		TenantID:  claimString(claims, "tid"),
+		AppID:     claimString(claims, "appid"),
+		ObjectID:  claimString(claims, "oid"),
+		User:      claimString(claims, "upn"),
+		Audience:  claimString(claims, "aud"),
+		Issuer:    claimString(claims, "iss"),
+		Scopes:    claimString(claims, "scp"),
+		NotBefore: claimTime(claims, "nbf"),
+		Expires:   claimTime(claims, "exp"),
+	}
+	if c.AppID == "" {
+		// v2 tokens
+		c.AppID = claimString(claims, "azp")
+	}
+	if c.User == "" {
+		c.User = claimString(claims, "unique_name")
+	}
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, r := range roles {
+			c.Roles = append(c.Roles, fmt.Sprint(r))
+		}
+	}
+	return c, nil
+}
+
+func claimString(claims jwt.MapClaims, name string) string {
+	if s, ok := claims[name].(string); ok {
+		return s
+	}
+	return ""
+}
+
+func claimTime(claims jwt.MapClaims, name string) *time.Time {
+	if n, ok := claims[name].(float64); ok {
+		t := time.Unix(int64(n), 0).UTC()
+		return &t
+	}
+	return nil
+}
+
+// checkTokenClaims compares the claims with the configured credentials
+func checkTokenClaims(c tokenClaims, tenantID string, clientID string, now time.Time) []tokenCheck {
+	var checks []tokenCheck
+	switch {
+	case c.Expires == nil:
+		checks = append(checks, tokenCheck{"expiry", checkWarn, "token has no exp claim"})
+	case !now.Before(*c.Expires):
+		checks = append(checks, tokenCheck{"expiry", checkFail, fmt.Sprintf("expired at %s", c.Expires.Format(time.RFC3339))})
+	case c.Expires.Sub(now) < tokenExpiryWarning:
+		checks = append(checks, tokenCheck{"expiry", checkWarn, fmt.Sprintf("expires in %v", c.Expires.Sub(now).Round(time.Second))})
+	default:
+		checks = append(checks, tokenCheck{"expiry", checkOK, fmt.Sprintf("expires %s", c.Expires.Format(time.RFC3339))})
+	}
+	if c.NotBefore != nil && now.Before(*c.NotBefore) {
+		checks = append(checks, tokenCheck{"not before", checkFail, fmt.Sprintf("valid from %s, check the clock of this machine", c.NotBefore.Format(time.RFC3339))})
+	}
+
+	audienceOK := false
+	for _, a := range armAudiences {
+		if strings.TrimSuffix(strings.ToLower(c.Audience), "/") == strings.TrimSuffix(a, "/") {
+			audienceOK = true
+		}
+	}
+	if audienceOK {
+		checks = append(checks, tokenCheck{"audience", checkOK, c.Audience})
+	} else {
+		checks = append(checks, tokenCheck{"audience", checkFail, fmt.Sprintf("%s is not Azure Resource Manager (%s)", c.Audience, azure.PublicCloud.ResourceManagerEndpoint)})
+	}
+
+	issuerOK := false
+	for _, host := range publicCloudIssuerHosts {
+		if strings.HasPrefix(strings.ToLower(c.Issuer), "https://"+host+"/") {
+			issuerOK = true
+		}
+	}
+	if issuerOK {
+		checks = append(checks, tokenCheck{"environment", checkOK, "issued by " + c.Issuer})
+	} else {
+		checks = append(checks, tokenCheck{"environment", checkFail, fmt.Sprintf("issued by %s, not by %s the sample is configured for", c.Issuer, azure.PublicCloud.Name)})
+	}
+
+	switch {
+	case tenantID == "":
+	case !guidPattern.MatchString(tenantID):
+		checks = append(checks, tokenCheck{"tenant", checkWarn, fmt.Sprintf("configured tenant %s is not an id, the token is for tenant %s", tenantID, c.TenantID)})
+	case strings.EqualFold(tenantID, c.TenantID):
+		checks = append(checks, tokenCheck{"tenant", checkOK, c.TenantID})
+	default:
+		checks = append(checks, tokenCheck{"tenant", checkFail, fmt.Sprintf("token is for tenant %s, configured tenant is %s", c.TenantID, tenantID)})
+	}
+
+	switch {
+	case clientID == "":
+	case strings.EqualFold(clientID, c.AppID):
+		checks = append(checks, tokenCheck{"client", checkOK, c.AppID})
+	default:
+		checks = append(checks, tokenCheck{"client", checkFail, fmt.Sprintf("token is for application %s, configured client is %s", c.AppID, clientID)})
+	}
+	return checks
+}
+
+// checkSubscription reads the subscription with the token
+func checkSubscription(subscriptionID string, c tokenClaims) tokenCheck {
+	client := autorest.NewClientWithUserAgent("")
+	client.Authorizer = armAuthorizer
+	useARMSender(&client, subscriptionID)
+	req, err := autorest.Prepare(&http.Request{},
+		autorest.AsGet(),
+		autorest.WithBaseURL(azure.PublicCloud.ResourceManagerEndpoint),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}", map[string]interface{}{
+			"subscriptionId": autorest.Encode("path", subscriptionID),
+		}),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": tokenCheckSubscriptionAPI}))
+	if err != nil {
+		return tokenCheck{"subscription", checkFail, err.Error()}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return tokenCheck{"subscription", checkFail, err.Error()}
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var sub struct {
+			DisplayName string `json:"displayName"`
+			State       string `json:"state"`
+		}
+		if err := autorest.Respond(resp, autorest.ByUnmarshallingJSON(&sub)); err != nil {
+			return tokenCheck{"subscription", checkFail, err.Error()}
+		}
+		if sub.State != "Enabled" {
+			return tokenCheck{"subscription", checkWarn, fmt.Sprintf("%s (%s) is %s", subscriptionID, sub.DisplayName, sub.State)}
+		}
+		return tokenCheck{"subscription", checkOK, fmt.Sprintf("%s (%s)", subscriptionID, sub.DisplayName)}
+	case http.StatusUnauthorized:
+		m := authorizationURIPattern.FindStringSubmatch(resp.Header.Get("WWW-Authenticate"))
+		if m != nil && !strings.EqualFold(m[1], c.TenantID) {
+			return tokenCheck{"subscription", checkFail, fmt.Sprintf("%s belongs to tenant %s, the token is for tenant %s", subscriptionID, m[1], c.TenantID)}
+		}
+		return tokenCheck{"subscription", checkFail, fmt.Sprintf("ARM rejected the token for %s (%s)", subscriptionID, resp.Status)}
+	case http.StatusForbidden, http.StatusNotFound:
+		return tokenCheck{"subscription", checkFail, fmt.Sprintf("object %s has no access to %s or it does not exist (%s)", c.ObjectID, subscriptionID, resp.Status)}
+	default:
+		return tokenCheck{"subscription", checkWarn, fmt.Sprintf("reading %s returned %s", subscriptionID, resp.Status)}
+	}
+}
+
+func writeTokenReport(w io.Writer, format string, r tokenReport) {
+	if format == "json" {
+		fmt.Fprintln(w, toJSON(r))
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if r.Account != "" {
+		fmt.Fprintf(tw, "Account:\t%s\n", r.Account)
+	}
+	fmt.Fprintf(tw, "Configured tenant:\t%s\n", r.TenantID)
+	fmt.Fprintf(tw, "Configured client:\t%s\n", r.ClientID)
+	fmt.Fprintf(tw, "Subscription:\t%s\n", r.SubscriptionID)
+	c := r.Claims
+	fmt.Fprintf(tw, "tid:\t%s\n", c.TenantID)
+	fmt.Fprintf(tw, "appid:\t%s\n", c.AppID)
+	fmt.Fprintf(tw, "oid:\t%s\n", c.ObjectID)
+	if c.User != "" {
+		fmt.Fprintf(tw, "upn:\t%s\n", c.User)
+	}
+	fmt.Fprintf(tw, "aud:\t%s\n", c.Audience)
+	fmt.Fprintf(tw, "iss:\t%s\n", c.Issuer)
+	fmt.Fprintf(tw, "roles:\t%s\n", strings.Join(c.Roles, ", "))
+	if c.Scopes != "" {
+		fmt.Fprintf(tw, "scp:\t%s\n", c.Scopes)
+	}
+	if c.Expires != nil {
+		fmt.Fprintf(tw, "exp:\t%s\n", c.Expires.Format(time.RFC3339))
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAILS")
+	for _, check := range r.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Check, check.Result, check.Details)
+	}
+	tw.Flush()
+}